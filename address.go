@@ -0,0 +1,107 @@
+package unclog
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// plusRule says that a domain supports subaddressing:
+// mail to local+tag@domain is delivered to local@domain
+// (for the separator "+").
+type plusRule struct {
+	// Domain is the domain the rule applies to, in lowercase ASCII (punycode) form.
+	Domain string
+
+	// Sep is the separator between the local part and the tag, usually "+".
+	Sep string
+}
+
+// Produces plusRules from parallel lists of domains and separators,
+// checking them for validity.
+// An empty separator means "+".
+func parsePlusRules(domainVals, sepVals []string) ([]plusRule, error) {
+	if len(domainVals) != len(sepVals) {
+		return nil, fmt.Errorf("got %d domain(s) but %d separator(s)", len(domainVals), len(sepVals))
+	}
+
+	var (
+		result []plusRule
+		seen   = make(map[string]bool)
+	)
+	for i, domainVal := range domainVals {
+		domain := canonicalDomain(strings.TrimPrefix(strings.TrimSpace(domainVal), "@"))
+		if domain == "" || !strings.Contains(domain, ".") || strings.ContainsAny(domain, "@* \t") {
+			return nil, fmt.Errorf("invalid domain %q", domainVal)
+		}
+		if seen[domain] {
+			return nil, fmt.Errorf("duplicate domain %s", domainVal)
+		}
+		seen[domain] = true
+
+		sep := strings.TrimSpace(sepVals[i])
+		if sep == "" {
+			sep = "+"
+		}
+		if len(sep) != 1 || strings.ContainsAny(sep, "@. \t") {
+			return nil, fmt.Errorf("invalid separator %q for domain %s", sep, domainVal)
+		}
+
+		result = append(result, plusRule{Domain: domain, Sep: sep})
+	}
+	return result, nil
+}
+
+// Returns the canonical form of an e-mail address,
+// so that addresses delivering to the same mailbox compare equal.
+// The domain is lowercased and converted to punycode
+// (so "user@Bücher.example" becomes "user@xn--bcher-kva.example"),
+// and the local part is lowercased.
+// For Gmail addresses, "googlemail.com" becomes "gmail.com"
+// and dots and any "+tag" suffix are removed from the local part.
+// For domains with a plus rule in p.PlusRules,
+// any tag suffix is removed from the local part.
+func (p matchPolicy) canonicalAddr(addr string) string {
+	idx := strings.LastIndex(addr, "@")
+	if idx < 0 {
+		return strings.ToLower(addr)
+	}
+	var (
+		local  = strings.ToLower(addr[:idx])
+		domain = canonicalDomain(addr[idx+1:])
+	)
+
+	switch domain {
+	case "gmail.com", "googlemail.com":
+		domain = "gmail.com"
+		if i := strings.Index(local, "+"); i > 0 {
+			local = local[:i]
+		}
+		local = strings.ReplaceAll(local, ".", "")
+
+	default:
+		for _, r := range p.PlusRules {
+			if r.Domain == domain {
+				if i := strings.Index(local, r.Sep); i > 0 {
+					local = local[:i]
+				}
+				break
+			}
+		}
+	}
+
+	return local + "@" + domain
+}
+
+// Returns the canonical form of a domain name:
+// lowercase, without a trailing dot, and in ASCII (punycode) form.
+// If the domain is not a valid internationalized domain name,
+// it is only lowercased and trimmed.
+func canonicalDomain(domain string) string {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if ascii, err := idna.Lookup.ToASCII(domain); err == nil {
+		return ascii
+	}
+	return domain
+}
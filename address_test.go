@@ -0,0 +1,73 @@
+package unclog
+
+import "testing"
+
+func TestCanonicalAddr(t *testing.T) {
+	p := matchPolicy{PlusRules: []plusRule{
+		{Domain: "fastmail.com", Sep: "+"},
+		{Domain: "yahoo.com", Sep: "-"},
+	}}
+
+	cases := []struct {
+		addr, want string
+	}{
+		{"firstlast@gmail.com", "firstlast@gmail.com"},
+		{"FirstLast@gmail.com", "firstlast@gmail.com"},
+		{"first.last+news@gmail.com", "firstlast@gmail.com"},
+		{"firstlast@googlemail.com", "firstlast@gmail.com"},
+		{"First.Last@GMail.com.", "firstlast@gmail.com"},
+		{"first.last+news@example.com", "first.last+news@example.com"},
+		{"alice+lists@fastmail.com", "alice@fastmail.com"},
+		{"Alice+Lists@FastMail.com", "alice@fastmail.com"},
+		{"bob-shopping@yahoo.com", "bob@yahoo.com"},
+		{"bob+shopping@yahoo.com", "bob+shopping@yahoo.com"},
+		{"+tag@fastmail.com", "+tag@fastmail.com"},
+		{"user@Bücher.example", "user@xn--bcher-kva.example"},
+		{"user@xn--bcher-kva.example", "user@xn--bcher-kva.example"},
+		{"no-at-sign", "no-at-sign"},
+	}
+	for _, c := range cases {
+		if got := p.canonicalAddr(c.addr); got != c.want {
+			t.Errorf("canonicalAddr(%s): got %s, want %s", c.addr, got, c.want)
+		}
+	}
+}
+
+func TestParsePlusRules(t *testing.T) {
+	got, err := parsePlusRules([]string{"FastMail.com", "@yahoo.com", "Bücher.example"}, []string{"", "-", "+"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []plusRule{
+		{Domain: "fastmail.com", Sep: "+"},
+		{Domain: "yahoo.com", Sep: "-"},
+		{Domain: "xn--bcher-kva.example", Sep: "+"},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("rule %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	bad := []struct {
+		name          string
+		domains, seps []string
+	}{
+		{"mismatched", []string{"a.com"}, nil},
+		{"no dot", []string{"localhost"}, []string{""}},
+		{"wildcard", []string{"*.a.com"}, []string{""}},
+		{"long separator", []string{"a.com"}, []string{"++"}},
+		{"dot separator", []string{"a.com"}, []string{"."}},
+		{"duplicate", []string{"a.com", "A.com"}, []string{"", "-"}},
+	}
+	for _, b := range bad {
+		t.Run(b.name, func(t *testing.T) {
+			if _, err := parsePlusRules(b.domains, b.seps); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package unclog
+
+import (
+	"fmt"
+	"strings"
+)
+
+// allowRule treats every sender in a domain as a contact,
+// without the user having to add each one to their address book.
+type allowRule struct {
+	// Domain is the domain the rule matches, in lowercase.
+	// If it begins with "*.", the rule matches any subdomain of the rest
+	// (so "*.partner.org" matches "mail.partner.org" but not "partner.org").
+	// Otherwise the rule matches only that exact domain.
+	Domain string
+
+	// Starred tells whether matching senders are treated as starred contacts
+	// rather than plain ones.
+	Starred bool
+}
+
+// Parses an allow-rule pattern such as "@ourcompany.com" or "*.partner.org".
+// A leading "@" is optional.
+// Internationalized domain names are converted to punycode.
+func parseAllowRule(pattern string, starred bool) (allowRule, error) {
+	domain := strings.ToLower(strings.TrimSpace(pattern))
+	domain = strings.TrimPrefix(domain, "@")
+
+	var prefix string
+	if strings.HasPrefix(domain, "*.") {
+		prefix = "*."
+		domain = domain[2:]
+	}
+	domain = canonicalDomain(domain)
+	if domain == "" || !strings.Contains(domain, ".") || strings.ContainsAny(domain, "@* \t") || strings.Contains(domain, "..") || strings.HasPrefix(domain, ".") {
+		return allowRule{}, fmt.Errorf("invalid domain pattern %q", pattern)
+	}
+	return allowRule{Domain: prefix + domain, Starred: starred}, nil
+}
+
+// Pattern is the rule's domain pattern as shown to the user.
+func (r allowRule) Pattern() string {
+	if strings.HasPrefix(r.Domain, "*.") {
+		return r.Domain
+	}
+	return "@" + r.Domain
+}
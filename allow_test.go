@@ -0,0 +1,47 @@
+package unclog
+
+import "testing"
+
+func TestParseAllowRules(t *testing.T) {
+	got, err := parseAllowRules(
+		[]string{"@OurCompany.com", " *.partner.org ", "boss.example."},
+		[]string{"contacts", "contacts", "starred"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []allowRule{
+		{Domain: "ourcompany.com"},
+		{Domain: "*.partner.org"},
+		{Domain: "boss.example", Starred: true},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("rule %d: got %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	bad := []struct {
+		name            string
+		patterns, tiers []string
+	}{
+		{"mismatched", []string{"@a.com"}, nil},
+		{"unknown tier", []string{"@a.com"}, []string{"family"}},
+		{"empty", []string{"@"}, []string{"contacts"}},
+		{"no dot", []string{"@localhost"}, []string{"contacts"}},
+		{"address", []string{"bob@a.com"}, []string{"contacts"}},
+		{"inner wildcard", []string{"a.*.com"}, []string{"contacts"}},
+		{"bare wildcard", []string{"*.com."}, []string{"contacts"}},
+		{"duplicate", []string{"@a.com", "A.com"}, []string{"contacts", "starred"}},
+	}
+	for _, b := range bad {
+		t.Run(b.name, func(t *testing.T) {
+			if _, err := parseAllowRules(b.patterns, b.tiers); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
@@ -1,16 +1,13 @@
 package unclog
 
 import (
-	"context"
-	"encoding/json"
 	"net/http"
+	"time"
 
 	"cloud.google.com/go/datastore"
-	"github.com/bobg/aesite"
 	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 	"google.golang.org/api/gmail/v1"
-	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 )
 
@@ -18,7 +15,7 @@ import (
 func (s *Server) handleAuth(w http.ResponseWriter, req *http.Request) error {
 	ctx := req.Context()
 
-	sess, err := aesite.GetSession(ctx, s.dsClient, req)
+	sess, err := s.store.GetSession(ctx, req)
 	if err != nil {
 		return errors.Wrap(err, "getting session")
 	}
@@ -48,7 +45,7 @@ func (s *Server) handleAuth2(w http.ResponseWriter, req *http.Request) error {
 	if err != nil {
 		return errors.Wrap(err, "decoding session key")
 	}
-	sess, err := aesite.GetSessionByKey(ctx, s.dsClient, sessKey)
+	sess, err := s.store.GetSessionByKey(ctx, sessKey)
 	if err != nil {
 		return errors.Wrap(err, "getting session")
 	}
@@ -68,7 +65,11 @@ func (s *Server) handleAuth2(w http.ResponseWriter, req *http.Request) error {
 		return errors.Wrap(err, "creating gmail service client")
 	}
 
-	prof, err := gmailSvc.Users.GetProfile("me").Do()
+	var prof *gmail.Profile
+	err = retry(ctx, func() (err error) {
+		prof, err = gmailSvc.Users.GetProfile("me").Context(ctx).Do()
+		return err
+	})
 	if err != nil {
 		return errors.Wrap(err, "getting gmail profile")
 	}
@@ -78,10 +79,10 @@ func (s *Server) handleAuth2(w http.ResponseWriter, req *http.Request) error {
 		addr = prof.EmailAddress
 	)
 
-	err = aesite.LookupUser(ctx, s.dsClient, addr, &u)
-	if errors.Is(err, datastore.ErrNoSuchEntity) {
+	err = s.store.lookupUser(ctx, addr, &u)
+	if errors.Is(err, ErrNotFound) {
 		u.InboxOnly = true // Force true for now. Later, add a UI for toggling this.
-		err = aesite.NewUser(ctx, s.dsClient, addr, "", &u)
+		err = s.store.newUser(ctx, addr, &u)
 		if err != nil {
 			return errors.Wrapf(err, "creating user %s", addr)
 		}
@@ -90,42 +91,34 @@ func (s *Server) handleAuth2(w http.ResponseWriter, req *http.Request) error {
 	}
 
 	sess.UserKey = u.Key()
-	_, err = s.dsClient.Put(ctx, sess.Key(), sess)
+	err = s.store.PutSession(ctx, sess)
 	if err != nil {
 		return errors.Wrap(err, "storing session")
 	}
 
-	tokenJSON, err := json.Marshal(token)
+	u.Token, err = s.encodeToken(ctx, addr, token)
 	if err != nil {
-		return errors.Wrap(err, "JSON-marshaling OAuth token")
+		return errors.Wrap(err, "encoding OAuth token")
 	}
-	u.Token = string(tokenJSON)
+	u.ExpiredReason = ""
+	u.ExpiredTime = time.Time{}
 
-	err = s.maybeCreateLabel(ctx, gmailSvc, "✔")
+	err = s.ensureLabels(ctx, NewGmailProvider(gmailSvc, oauthClient), &u)
 	if err != nil {
-		return errors.Wrap(err, "creating ✔ label")
-	}
-	err = s.maybeCreateLabel(ctx, gmailSvc, "✔/★")
-	if err != nil {
-		return errors.Wrap(err, "creating ✔/★ label")
+		return errors.Wrap(err, "creating labels")
 	}
 
-	labelsResp, err := gmailSvc.Users.Labels.List("me").Do()
+	err = s.store.putUser(ctx, &u)
 	if err != nil {
-		return errors.Wrap(err, "listing labels")
-	}
-	for _, label := range labelsResp.Labels {
-		switch label.Name {
-		case "✔":
-			u.ContactsLabelID = label.Id
-		case "✔/★":
-			u.StarredLabelID = label.Id
-		}
+		return errors.Wrap(err, "updating user")
 	}
 
-	_, err = s.dsClient.Put(ctx, u.Key(), &u)
-	if err != nil {
-		return errors.Wrap(err, "updating user")
+	if len(u.RetiredLabels) > 0 {
+		// Resume stripping labels retired while the user had no token.
+		err = s.queueStrip(ctx, addr, 1)
+		if err != nil {
+			return errors.Wrap(err, "queueing strip task")
+		}
 	}
 
 	sess.SetCookie(w)
@@ -134,24 +127,3 @@ func (s *Server) handleAuth2(w http.ResponseWriter, req *http.Request) error {
 
 	return nil
 }
-
-// Create the ✔ and ✔/★ labels as needed.
-func (s *Server) maybeCreateLabel(ctx context.Context, gmailSvc *gmail.Service, name string) error {
-	label := &gmail.Label{
-		LabelListVisibility:   "labelShow",
-		MessageListVisibility: "show",
-		Name:                  name,
-		Type:                  "user",
-	}
-	_, err := gmailSvc.Users.Labels.Create("me", label).Do()
-	if err == nil {
-		return nil
-	}
-	if g, ok := err.(*googleapi.Error); ok {
-		switch g.Code {
-		case http.StatusConflict, http.StatusNotModified:
-			return nil
-		}
-	}
-	return err
-}
@@ -0,0 +1,192 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxBatchModify is the most message IDs allowed in one MailProvider.BatchModify call.
+const maxBatchModify = 1000
+
+// labelChange is a decided change to the labels of a thread's messages.
+type labelChange struct {
+	threadID   string
+	messageIDs []string
+	add        []string
+	remove     []string
+}
+
+// labelBatcher gathers the label changes decided during an update
+// and applies them with as few MailProvider.BatchModify calls as possible:
+// changes with the same labels to add and remove are grouped together,
+// in chunks of up to maxBatchModify message IDs.
+//
+// It is safe for concurrent use.
+// Batches are applied without holding its lock,
+// so one caller's MailProvider calls don't hold up the others' adds.
+type labelBatcher struct {
+	mp MailProvider
+
+	mu      sync.Mutex             // protects the following
+	batches map[string]*labelBatch // keyed by labelBatchKey
+	order   []string               // keys of batches, in order of creation
+	errs    threadErrors
+}
+
+// labelBatch is a group of pending changes with the same labels to add and remove.
+type labelBatch struct {
+	add, remove []string
+	changes     []*labelChange
+	nmsgs       int
+}
+
+func newLabelBatcher(mp MailProvider) *labelBatcher {
+	return &labelBatcher{
+		mp:      mp,
+		batches: make(map[string]*labelBatch),
+		errs:    make(threadErrors),
+	}
+}
+
+func labelBatchKey(add, remove []string) string {
+	add = append([]string(nil), add...)
+	remove = append([]string(nil), remove...)
+	sort.Strings(add)
+	sort.Strings(remove)
+	return strings.Join(add, ",") + "/" + strings.Join(remove, ",")
+}
+
+// Adds a change to its batch,
+// applying the batch first if the change would make it too big.
+// Errors are reported by flush.
+func (b *labelBatcher) add(ctx context.Context, ch *labelChange) {
+	var full *labelBatch
+
+	b.mu.Lock()
+	key := labelBatchKey(ch.add, ch.remove)
+	batch, ok := b.batches[key]
+	if !ok {
+		batch = &labelBatch{add: ch.add, remove: ch.remove}
+		b.batches[key] = batch
+		b.order = append(b.order, key)
+	}
+	if batch.nmsgs > 0 && batch.nmsgs+len(ch.messageIDs) > maxBatchModify {
+		full = batch.take()
+	}
+	batch.changes = append(batch.changes, ch)
+	batch.nmsgs += len(ch.messageIDs)
+	b.mu.Unlock()
+
+	if full != nil {
+		b.apply(ctx, full)
+	}
+}
+
+// Removes and returns the pending changes in batch.
+func (batch *labelBatch) take() *labelBatch {
+	taken := *batch
+	batch.changes = nil
+	batch.nmsgs = 0
+	return &taken
+}
+
+// Applies all pending changes.
+// If any could not be applied,
+// the result is a threadErrors telling which threads failed and why.
+func (b *labelBatcher) flush(ctx context.Context) error {
+	var pending []*labelBatch
+
+	b.mu.Lock()
+	for _, key := range b.order {
+		pending = append(pending, b.batches[key].take())
+	}
+	b.mu.Unlock()
+
+	for _, batch := range pending {
+		b.apply(ctx, batch)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.errs) == 0 {
+		return nil
+	}
+	errs := b.errs
+	b.errs = make(threadErrors)
+	return errs
+}
+
+// Applies the changes in batch,
+// which has been taken from b's pending batches (see labelBatch.take).
+// A thread with more than maxBatchModify messages gets a call of its own.
+// If a BatchModify call fails,
+// its threads are retried one at a time with ModifyThread
+// to find out which ones fail.
+func (b *labelBatcher) apply(ctx context.Context, batch *labelBatch) {
+	var (
+		msgIDs  []string
+		changes []*labelChange
+	)
+	send := func() {
+		if len(changes) == 0 {
+			return
+		}
+		if err := b.mp.BatchModify(ctx, msgIDs, batch.add, batch.remove); err != nil {
+			for _, ch := range changes {
+				b.modifyThread(ctx, ch)
+			}
+		}
+		msgIDs, changes = nil, nil
+	}
+
+	for _, ch := range batch.changes {
+		if len(msgIDs)+len(ch.messageIDs) > maxBatchModify {
+			send()
+		}
+		if len(ch.messageIDs) > maxBatchModify {
+			b.modifyThread(ctx, ch)
+			continue
+		}
+		msgIDs = append(msgIDs, ch.messageIDs...)
+		changes = append(changes, ch)
+	}
+	send()
+}
+
+// Applies one thread's change with ModifyThread,
+// recording any error for flush.
+func (b *labelBatcher) modifyThread(ctx context.Context, ch *labelChange) {
+	err := b.mp.ModifyThread(ctx, ch.threadID, ch.add, ch.remove)
+	if err == nil {
+		return
+	}
+	b.mu.Lock()
+	b.errs[ch.threadID] = err
+	b.mu.Unlock()
+}
+
+// threadErrors is an error reporting failures to change the labels of some threads.
+// It maps thread IDs to errors.
+type threadErrors map[string]error
+
+func (e threadErrors) Error() string {
+	threadIDs := make([]string, 0, len(e))
+	for threadID := range e {
+		threadIDs = append(threadIDs, threadID)
+	}
+	sort.Strings(threadIDs)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "updating %d thread(s): ", len(e))
+	for i, threadID := range threadIDs {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		fmt.Fprintf(&b, "thread %s: %s", threadID, e[threadID])
+	}
+	return b.String()
+}
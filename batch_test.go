@@ -0,0 +1,191 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestLabelBatcher(t *testing.T) {
+	var (
+		ctx = context.Background()
+		mb  = NewMemMailbox()
+		b   = newLabelBatcher(mb)
+	)
+
+	addThread := func(threadID string, nmsgs int) *labelChange {
+		thread := &Thread{ID: threadID}
+		ch := &labelChange{threadID: threadID}
+		for i := 0; i < nmsgs; i++ {
+			msgID := fmt.Sprintf("%s-%d", threadID, i)
+			thread.Messages = append(thread.Messages, &Message{ID: msgID, LabelIDs: []string{"L1"}})
+			ch.messageIDs = append(ch.messageIDs, msgID)
+		}
+		mb.AddThread(thread)
+		return ch
+	}
+
+	// 1,500 one-message threads getting L2: two batches.
+	for i := 0; i < 1500; i++ {
+		ch := addThread(fmt.Sprintf("a%d", i), 1)
+		ch.add = []string{"L2"}
+		b.add(ctx, ch)
+	}
+
+	// Ten threads moving from L1 to L3, with the label lists in varying order: one batch.
+	for i := 0; i < 10; i++ {
+		ch := addThread(fmt.Sprintf("b%d", i), 3)
+		ch.add = []string{"L3"}
+		ch.remove = []string{"L1", "L2"}
+		if i%2 == 0 {
+			ch.remove = []string{"L2", "L1"}
+		}
+		b.add(ctx, ch)
+	}
+
+	// A thread too big for a batch: a ModifyThread call of its own.
+	ch := addThread("big", 1200)
+	ch.remove = []string{"L1"}
+	b.add(ctx, ch)
+
+	if err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := mb.BatchModifyCalls(); got != 3 {
+		t.Errorf("got %d BatchModify calls, want 3", got)
+	}
+
+	check := func(threadID string, want ...string) {
+		t.Helper()
+		for _, msg := range mb.Thread(threadID).Messages {
+			if !sameStrings(msg.LabelIDs, want) {
+				t.Errorf("message %s: got labels %v, want %v", msg.ID, msg.LabelIDs, want)
+				return
+			}
+		}
+	}
+	check("a0", "L1", "L2")
+	check("a1499", "L1", "L2")
+	check("b0", "L3")
+	check("b9", "L3")
+	check("big")
+	if got := mb.Modifications("big"); got != 1 {
+		t.Errorf("got %d modifications of big thread, want 1", got)
+	}
+}
+
+func TestLabelBatcherErrors(t *testing.T) {
+	var (
+		ctx     = context.Background()
+		mb      = NewMemMailbox()
+		b       = newLabelBatcher(mb)
+		errTest = errors.New("test error")
+	)
+	mb.ModifyErr = func(threadID string) error {
+		if threadID == "bad" {
+			return errTest
+		}
+		return nil
+	}
+
+	for _, threadID := range []string{"good1", "bad", "good2"} {
+		mb.AddThread(&Thread{ID: threadID, Messages: []*Message{{ID: threadID}}})
+		b.add(ctx, &labelChange{threadID: threadID, messageIDs: []string{threadID}, add: []string{"L1"}})
+	}
+
+	err := b.flush(ctx)
+	var terrs threadErrors
+	if !errors.As(err, &terrs) {
+		t.Fatalf("got error %v, want threadErrors", err)
+	}
+	if len(terrs) != 1 || !errors.Is(terrs["bad"], errTest) {
+		t.Errorf("got %v, want only thread bad to fail", terrs)
+	}
+
+	// The other threads in the failed batch were changed one at a time.
+	for _, threadID := range []string{"good1", "good2"} {
+		if got := mb.Thread(threadID).Messages[0].LabelIDs; !sameStrings(got, []string{"L1"}) {
+			t.Errorf("thread %s: got labels %v, want [L1]", threadID, got)
+		}
+	}
+
+	// The errors are reported only once.
+	if err = b.flush(ctx); err != nil {
+		t.Errorf("got error %v from second flush", err)
+	}
+}
+
+func TestLabelBatcherConcurrent(t *testing.T) {
+	var (
+		ctx = context.Background()
+		mb  = NewMemMailbox()
+		bp  = &blockingProvider{MailProvider: mb, started: make(chan struct{}, 10), release: make(chan struct{})}
+		b   = newLabelBatcher(bp)
+	)
+
+	change := func(threadID string, nmsgs int, add string) *labelChange {
+		thread := &Thread{ID: threadID}
+		ch := &labelChange{threadID: threadID, add: []string{add}}
+		for i := 0; i < nmsgs; i++ {
+			msgID := fmt.Sprintf("%s-%d", threadID, i)
+			thread.Messages = append(thread.Messages, &Message{ID: msgID})
+			ch.messageIDs = append(ch.messageIDs, msgID)
+		}
+		mb.AddThread(thread)
+		return ch
+	}
+
+	var (
+		full  = change("full", maxBatchModify, "L1")
+		over  = change("over", 1, "L1")
+		other = change("other", 1, "L2")
+	)
+	b.add(ctx, full)
+
+	// This add applies the full batch, which blocks in BatchModify.
+	applied := make(chan struct{})
+	go func() {
+		b.add(ctx, over)
+		close(applied)
+	}()
+	<-bp.started
+
+	// Meanwhile another add goes through.
+	added := make(chan struct{})
+	go func() {
+		b.add(ctx, other)
+		close(added)
+	}()
+	select {
+	case <-added:
+	case <-time.After(5 * time.Second):
+		t.Fatal("add blocked while another batch was being applied")
+	}
+
+	close(bp.release)
+	<-applied
+	if err := b.flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for threadID, want := range map[string]string{"full": "L1", "over": "L1", "other": "L2"} {
+		if got := mb.Thread(threadID).Messages[0].LabelIDs; !sameStrings(got, []string{want}) {
+			t.Errorf("thread %s: got labels %v, want [%s]", threadID, got, want)
+		}
+	}
+}
+
+// blockingProvider is a MailProvider whose BatchModify calls
+// signal on started and then wait for release to be closed.
+type blockingProvider struct {
+	MailProvider
+	started, release chan struct{}
+}
+
+func (p *blockingProvider) BatchModify(ctx context.Context, messageIDs, add, remove []string) error {
+	p.started <- struct{}{}
+	<-p.release
+	return p.MailProvider.BatchModify(ctx, messageIDs, add, remove)
+}
@@ -0,0 +1,358 @@
+package unclog
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"math"
+	"math/big"
+	"net/http"
+	"reflect"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bobg/aesite"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a store in a single bbolt database file.
+// Users, sessions, settings, and contact snapshots are kept in separate buckets.
+// Sessions are keyed and cookied the same way as in DatastoreStore.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+var _ store = &BoltStore{}
+
+var (
+	boltUsers    = []byte("users")
+	boltSessions = []byte("sessions")
+	boltSettings = []byte("settings")
+	boltContacts = []byte("contacts")
+)
+
+// This must match the cookie name used by aesite.Session.SetCookie.
+const sessionCookieName = "s"
+
+// ErrBoltLocked is the error produced by OpenBoltStore
+// when another process (such as a running server) has the database file open.
+// Only one process at a time can use the file.
+var ErrBoltLocked = errors.New("database file is in use by another process")
+
+// How long OpenBoltStore waits for another process to release the database file.
+var boltLockTimeout = 5 * time.Second
+
+// OpenBoltStore opens the BoltStore in the given file,
+// creating it if necessary.
+// If another process has the file open,
+// the result is ErrBoltLocked.
+func OpenBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: boltLockTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, errors.Wrapf(ErrBoltLocked, "opening %s", path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltUsers, boltSessions, boltSettings, boltContacts} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return errors.Wrapf(err, "creating bucket %s", name)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltStore{db: db}, nil
+}
+
+// Close closes the database file.
+func (b *BoltStore) Close() error {
+	return b.db.Close()
+}
+
+// GetSetting implements store.GetSetting.
+func (b *BoltStore) GetSetting(_ context.Context, name string) ([]byte, error) {
+	var result []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltSettings).Get([]byte(name))
+		if val == nil {
+			return ErrNotFound
+		}
+		result = bytes.Clone(val)
+		return nil
+	})
+	return result, err
+}
+
+// SetSetting implements store.SetSetting.
+func (b *BoltStore) SetSetting(_ context.Context, name string, value []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltSettings).Put([]byte(name), value)
+	})
+}
+
+// NewSession implements store.NewSession.
+func (b *BoltStore) NewSession(ctx context.Context, dur time.Duration) (*aesite.Session, error) {
+	id, err := rand.Int(rand.Reader, big.NewInt(math.MaxInt64))
+	if err != nil {
+		return nil, errors.Wrap(err, "choosing random session ID")
+	}
+	sess := &aesite.Session{
+		ID:      id.Int64(),
+		CSRFKey: make([]byte, 32),
+		Active:  true,
+		Exp:     time.Now().Add(dur),
+	}
+	_, err = rand.Read(sess.CSRFKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "choosing random CSRF key")
+	}
+	return sess, b.PutSession(ctx, sess)
+}
+
+// GetSession implements store.GetSession.
+func (b *BoltStore) GetSession(ctx context.Context, req *http.Request) (*aesite.Session, error) {
+	cookie, err := req.Cookie(sessionCookieName)
+	if errors.Is(err, http.ErrNoCookie) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "getting session cookie from HTTP request")
+	}
+	key, err := datastore.DecodeKey(cookie.Value)
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding session cookie")
+	}
+	return b.GetSessionByKey(ctx, key)
+}
+
+// GetSessionByKey implements store.GetSessionByKey.
+func (b *BoltStore) GetSessionByKey(_ context.Context, key *datastore.Key) (*aesite.Session, error) {
+	var sess aesite.Session
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltSessions), sessionID(key.ID), &sess)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !sess.Active || sess.Exp.Before(time.Now()) {
+		return nil, aesite.ErrInactive
+	}
+	return &sess, nil
+}
+
+// PutSession implements store.PutSession.
+func (b *BoltStore) PutSession(_ context.Context, sess *aesite.Session) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(boltSessions), sessionID(sess.ID), sess)
+	})
+}
+
+func sessionID(id int64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(id))
+	return buf[:]
+}
+
+func (b *BoltStore) lookupUser(_ context.Context, email string, u *user) error {
+	email, err := aesite.CanonicalizeEmail(email)
+	if err != nil {
+		return errors.Wrapf(err, "canonicalizing e-mail address %s", email)
+	}
+	return b.db.View(func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltUsers), []byte(email), u)
+	})
+}
+
+func (b *BoltStore) sessionUser(ctx context.Context, sess *aesite.Session, u *user) error {
+	if sess.UserKey == nil {
+		return aesite.ErrAnonymous
+	}
+	return b.lookupUser(ctx, sess.UserKey.Name, u)
+}
+
+func (b *BoltStore) newUser(_ context.Context, email string, u *user) error {
+	email, err := aesite.CanonicalizeEmail(email)
+	if err != nil {
+		return errors.Wrap(err, "canonicalizing e-mail address")
+	}
+
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return errors.Wrap(err, "generating random user secret")
+	}
+	u.User = aesite.User{
+		Email:  email,
+		Secret: secret,
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUsers)
+		if bucket.Get([]byte(email)) != nil {
+			return errors.Errorf("user %s already exists", email)
+		}
+		return boltPut(bucket, []byte(email), u)
+	})
+}
+
+func (b *BoltStore) putUser(_ context.Context, u *user) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return boltPut(tx.Bucket(boltUsers), []byte(u.Email), u)
+	})
+}
+
+// Bolt transactions are serialized,
+// so unlike DatastoreStore.updateUser,
+// this never produces aesite.ErrUpdateConflict.
+func (b *BoltStore) updateUser(_ context.Context, email string, u *user, f func() error) error {
+	email, err := aesite.CanonicalizeEmail(email)
+	if err != nil {
+		return errors.Wrapf(err, "canonicalizing e-mail address %s", email)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltUsers)
+		err := boltGet(bucket, []byte(email), u)
+		if err != nil {
+			return errors.Wrapf(err, "looking up user %s", email)
+		}
+		err = f()
+		if err != nil {
+			return err
+		}
+		u.UpdateCounter++
+		return boltPut(bucket, []byte(email), u)
+	})
+}
+
+func (b *BoltStore) forUsersWatchExpiring(ctx context.Context, after, before time.Time, f func(*user) error) error {
+	return b.forUsers(ctx, func(u *user) bool {
+		return u.WatchExpiry.After(after) && u.WatchExpiry.Before(before)
+	}, f)
+}
+
+func (b *BoltStore) forUsersUpdatedBefore(ctx context.Context, t time.Time, f func(*user) error) error {
+	return b.forUsers(ctx, func(u *user) bool {
+		return u.LastUpdate.Before(t)
+	}, f)
+}
+
+func (b *BoltStore) forEachUser(ctx context.Context, f func(*user) error) error {
+	return b.forUsers(ctx, func(*user) bool { return true }, f)
+}
+
+// Calls f on each user satisfying pred.
+// The users are collected first,
+// so that f may itself update the store.
+func (b *BoltStore) forUsers(_ context.Context, pred func(*user) bool, f func(*user) error) error {
+	var users []*user
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltUsers).ForEach(func(_, val []byte) error {
+			var u user
+			err := gob.NewDecoder(bytes.NewReader(val)).Decode(&u)
+			if err != nil {
+				return errors.Wrap(err, "decoding user")
+			}
+			if pred(&u) {
+				users = append(users, &u)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return errors.Wrap(err, "iterating over users")
+	}
+	for _, u := range users {
+		err = f(u)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *BoltStore) getContacts(_ context.Context, email string) ([]byte, error) {
+	var result []byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		val := tx.Bucket(boltContacts).Get([]byte(email))
+		if val == nil {
+			return ErrNotFound
+		}
+		result = bytes.Clone(val)
+		return nil
+	})
+	return result, err
+}
+
+func (b *BoltStore) putContacts(_ context.Context, email string, data []byte) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltContacts).Put([]byte(email), data)
+	})
+}
+
+func (b *BoltStore) deleteUser(_ context.Context, email string) error {
+	email, err := aesite.CanonicalizeEmail(email)
+	if err != nil {
+		return errors.Wrapf(err, "canonicalizing e-mail address %s", email)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		sessions := tx.Bucket(boltSessions)
+
+		// Keys can't be deleted during ForEach, so collect them first.
+		var keys [][]byte
+		err := sessions.ForEach(func(key, val []byte) error {
+			var sess aesite.Session
+			if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&sess); err != nil {
+				return errors.Wrap(err, "decoding session")
+			}
+			if sess.UserKey != nil && sess.UserKey.Name == email {
+				keys = append(keys, bytes.Clone(key))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := sessions.Delete(key); err != nil {
+				return errors.Wrap(err, "deleting session")
+			}
+		}
+
+		if err := tx.Bucket(boltContacts).Delete([]byte(email)); err != nil {
+			return errors.Wrap(err, "deleting contacts")
+		}
+		return tx.Bucket(boltUsers).Delete([]byte(email))
+	})
+}
+
+// Decodes into obj, which must be a pointer.
+func boltGet(bucket *bolt.Bucket, key []byte, obj interface{}) error {
+	val := bucket.Get(key)
+	if val == nil {
+		return ErrNotFound
+	}
+
+	// Gob does not encode zero-valued fields,
+	// so clear obj first to avoid leaving stale values in them.
+	v := reflect.ValueOf(obj).Elem()
+	v.Set(reflect.Zero(v.Type()))
+
+	return gob.NewDecoder(bytes.NewReader(val)).Decode(obj)
+}
+
+func boltPut(bucket *bolt.Bucket, key []byte, obj interface{}) error {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(obj)
+	if err != nil {
+		return errors.Wrap(err, "gob-encoding")
+	}
+	return bucket.Put(key, buf.Bytes())
+}
@@ -0,0 +1,234 @@
+package unclog
+
+import (
+	"context"
+	"errors"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bobg/aesite"
+)
+
+func TestBoltStore(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// Settings.
+
+	_, err = bs.GetSetting(ctx, "master-key")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v for missing setting, want ErrNotFound", err)
+	}
+	err = bs.SetSetting(ctx, "master-key", []byte("xyzzy"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	val, err := bs.GetSetting(ctx, "master-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "xyzzy" {
+		t.Errorf("got setting %q, want xyzzy", val)
+	}
+
+	// Users.
+
+	var u user
+	err = bs.lookupUser(ctx, "alice@example.com", &u)
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("got error %v for missing user, want ErrNotFound", err)
+	}
+
+	u.InboxOnly = true
+	err = bs.newUser(ctx, "Alice@Example.com", &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "alice@example.com" {
+		t.Errorf("got email %s, want alice@example.com", u.Email)
+	}
+	if err = bs.newUser(ctx, "alice@example.com", new(user)); err == nil {
+		t.Error("got no error creating duplicate user")
+	}
+
+	now := time.Now()
+	err = bs.updateUser(ctx, "alice@example.com", &u, func() error {
+		u.WatchExpiry = now.Add(time.Hour)
+		u.LastUpdate = now.Add(-48 * time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var u2 user
+	err = bs.lookupUser(ctx, "alice@example.com", &u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u2.InboxOnly || !u2.WatchExpiry.Equal(u.WatchExpiry) || u2.UpdateCounter != 1 {
+		t.Errorf("got user %+v after update", u2)
+	}
+
+	// Zero values must overwrite nonzero ones on lookup.
+	u2.WatchExpiry = time.Time{}
+	err = bs.putUser(ctx, &u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bs.lookupUser(ctx, "alice@example.com", &u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.WatchExpiry.IsZero() {
+		t.Errorf("got WatchExpiry %s, want zero", u.WatchExpiry)
+	}
+
+	// Sessions.
+
+	sess, err := bs.NewSession(ctx, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = bs.sessionUser(ctx, sess, &u)
+	if !errors.Is(err, aesite.ErrAnonymous) {
+		t.Errorf("got error %v for anonymous session, want ErrAnonymous", err)
+	}
+
+	sess.UserKey = u.Key()
+	err = bs.PutSession(ctx, sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	sess.SetCookie(rec)
+	req := httptest.NewRequest("GET", "/s/data", nil)
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	sess2, err := bs.GetSession(ctx, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrf, err := sess.CSRFToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = sess2.CSRFCheck(csrf); err != nil {
+		t.Errorf("CSRF check on reloaded session: %s", err)
+	}
+	err = bs.sessionUser(ctx, sess2, &u2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u2.Email != u.Email {
+		t.Errorf("got session user %s, want %s", u2.Email, u.Email)
+	}
+
+	_, err = bs.GetSession(ctx, httptest.NewRequest("GET", "/s/data", nil))
+	if !aesite.IsNoSession(err) {
+		t.Errorf("got error %v for request without cookie, want a no-session error", err)
+	}
+
+	sess.Active = false
+	err = bs.PutSession(ctx, sess)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = bs.GetSessionByKey(ctx, sess.Key())
+	if !errors.Is(err, aesite.ErrInactive) {
+		t.Errorf("got error %v for inactive session, want ErrInactive", err)
+	}
+}
+
+func TestBoltStoreQueries(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	var (
+		now       = time.Now()
+		yesterday = now.Add(-24 * time.Hour)
+		tomw      = now.Add(24 * time.Hour)
+	)
+
+	users := []struct {
+		email                   string
+		watchExpiry, lastUpdate time.Time
+	}{
+		{"disabled@example.com", time.Time{}, time.Time{}},
+		{"expiring@example.com", now.Add(time.Hour), now},
+		{"expired@example.com", now.Add(-time.Hour), now.Add(-25 * time.Hour)},
+		{"long-ago@example.com", now.Add(-48 * time.Hour), now},
+		{"fresh@example.com", now.Add(48 * time.Hour), now.Add(-time.Hour)},
+		{"boundary@example.com", tomw, yesterday},
+	}
+	for _, uu := range users {
+		var u user
+		err = bs.newUser(ctx, uu.email, &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.WatchExpiry = uu.watchExpiry
+		u.LastUpdate = uu.lastUpdate
+		err = bs.putUser(ctx, &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var got []string
+	err = bs.forUsersWatchExpiring(ctx, yesterday, tomw, func(u *user) error {
+		got = append(got, u.Email)
+
+		// Updating the store during iteration must not deadlock.
+		return bs.putUser(ctx, u)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"expired@example.com", "expiring@example.com"}; !sameStrings(got, want) {
+		t.Errorf("got watch-expiring users %v, want %v", got, want)
+	}
+
+	got = nil
+	err = bs.forUsersUpdatedBefore(ctx, yesterday, func(u *user) error {
+		got = append(got, u.Email)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"disabled@example.com", "expired@example.com"}; !sameStrings(got, want) {
+		t.Errorf("got not-recently-updated users %v, want %v", got, want)
+	}
+}
+
+func TestBoltStoreLocked(t *testing.T) {
+	defer func(d time.Duration) { boltLockTimeout = d }(boltLockTimeout)
+	boltLockTimeout = 100 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "unclog.db")
+	bs, err := OpenBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	_, err = OpenBoltStore(path)
+	if !errors.Is(err, ErrBoltLocked) {
+		t.Errorf("got error %v opening a database in use, want ErrBoltLocked", err)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"net/http"
 	"strings"
 
-	"github.com/bobg/aesite"
 	"github.com/bobg/mid"
 	"github.com/pkg/errors"
 	"google.golang.org/api/idtoken"
@@ -24,7 +23,7 @@ func (s *Server) getMasterKey(ctx context.Context) (string, error) {
 	defer s.mu.Unlock()
 
 	if s.masterKey == "" {
-		masterKey, err := aesite.GetSetting(ctx, s.dsClient, "master-key")
+		masterKey, err := s.store.GetSetting(ctx, "master-key")
 		if err != nil {
 			return "", err
 		}
@@ -53,14 +52,20 @@ func (s *Server) checkMasterKey(req *http.Request) error {
 	return nil
 }
 
+// Check that the request comes from App Engine cron.
+//
+// Outside of the App Engine context,
+// where that header can't be trusted,
+// the request must instead have the right X-Unclog-Key header field.
+// (A standalone server runs the cron jobs in-process; see Server.RunScheduler.)
 func (s *Server) checkCron(req *http.Request) error {
-	if !appengine.IsAppEngine() {
-		return nil
-	}
 	err := s.checkMasterKey(req)
 	if err == nil { // sic
 		return nil
 	}
+	if !appengine.IsAppEngine() {
+		return mid.CodeErr{C: http.StatusUnauthorized, Err: err}
+	}
 	h := strings.TrimSpace(req.Header.Get("X-Appengine-Cron"))
 	if h != "true" {
 		return mid.CodeErr{C: http.StatusUnauthorized}
@@ -72,12 +77,16 @@ func (s *Server) checkCron(req *http.Request) error {
 // (See
 // https://cloud.google.com/tasks/docs/creating-appengine-handlers#reading_app_engine_task_request_headers.)
 //
-// This is a no-op outside of the App Engine context.
+// Requests delivered in-process by a LocalTaskQueue are always admitted
+// (see localTasks).
+// Otherwise, outside of the App Engine context,
+// where that header can't be trusted,
+// the request must have the right X-Unclog-Key header field.
 //
 // It can be bypassed with the right X-Unclog-Key header field.
 // See checkMasterKey, above.
 func (s *Server) checkTaskQueue(req *http.Request) error {
-	if !appengine.IsAppEngine() {
+	if local, _ := req.Context().Value(localTaskKey{}).(bool); local {
 		return nil
 	}
 
@@ -85,12 +94,15 @@ func (s *Server) checkTaskQueue(req *http.Request) error {
 	if err == nil { // sic
 		return nil
 	}
+	if !appengine.IsAppEngine() {
+		return mid.CodeErr{C: http.StatusUnauthorized, Err: err}
+	}
 
 	h := strings.TrimSpace(req.Header.Get("X-AppEngine-QueueName"))
 	if h != queueName {
 		return mid.CodeErr{
 			C:   http.StatusUnauthorized,
-			Err: fmt.Errorf("header value %s does not match queue name %s", h, s.queueName()),
+			Err: fmt.Errorf("header value %s does not match queue name %s", h, queueName),
 		}
 	}
 	return nil
@@ -0,0 +1,56 @@
+package unclog
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckTaskQueue(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	if err := bs.SetSetting(ctx, "master-key", []byte("sekrit")); err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(bs, nil, "")
+
+	// Outside App Engine, task and cron requests from the network need the master key.
+	req := httptest.NewRequest("GET", "/t/update?email=alice@example.com", nil)
+	if err := s.checkTaskQueue(req); err == nil {
+		t.Error("task request without master key admitted")
+	}
+	if err := s.checkCron(req); err == nil {
+		t.Error("cron request without master key admitted")
+	}
+
+	req.Header.Set("X-Unclog-Key", "wrong")
+	if err := s.checkTaskQueue(req); err == nil {
+		t.Error("task request with wrong master key admitted")
+	}
+
+	req.Header.Set("X-Unclog-Key", "sekrit")
+	if err := s.checkTaskQueue(req); err != nil {
+		t.Errorf("task request with master key: %s", err)
+	}
+	if err := s.checkCron(req); err != nil {
+		t.Errorf("cron request with master key: %s", err)
+	}
+
+	// Requests delivered in-process are admitted.
+	var checkErr error
+	h := localTasks(http.HandlerFunc(func(_ http.ResponseWriter, req *http.Request) {
+		checkErr = s.checkTaskQueue(req)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/t/update?email=alice@example.com", nil))
+	if checkErr != nil {
+		t.Errorf("in-process task request: %s", checkErr)
+	}
+}
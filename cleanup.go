@@ -0,0 +1,402 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bobg/mid"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// cleanupJob is the state of a background job
+// that strips a user's labels from all threads in the mailbox,
+// after the user has disabled Unclog and asked for the cleanup.
+// It runs in chunks,
+// each a task that strips at most cleanupChunk threads
+// and then queues the next
+// (see Server.doCleanup).
+type cleanupJob struct {
+	// Started is when the job started (to the microsecond).
+	// It is zero if there is no job.
+	// It also identifies the job to its tasks,
+	// so that tasks of an abandoned job can tell to stop.
+	Started time.Time
+
+	// DeleteLabels tells whether to delete the labels once they are stripped from all threads.
+	DeleteLabels bool
+
+	// DeleteUser tells whether to delete the user's account when the job finishes
+	// (see Server.DeleteUser).
+	DeleteUser bool
+
+	// Threads is the number of threads stripped so far.
+	Threads int
+
+	// Done is when the job finished, successfully or not.
+	Done time.Time
+
+	// Err, if not empty, is why the job failed.
+	Err string
+}
+
+// Tells whether the job has started and not finished.
+func (j cleanupJob) running() bool {
+	return !j.Started.IsZero() && j.Done.IsZero()
+}
+
+// cleanupChunk is the most threads one cleanup task strips.
+const cleanupChunk = 200
+
+// errEnoughThreads is for stopping LabelThreads in stripLabels.
+var errEnoughThreads = errors.New("enough threads")
+
+func (s *Server) cleanupTaskURL(email string, started time.Time, chunk int) string {
+	u, _ := url.Parse("/t/cleanup")
+
+	v := url.Values{}
+	v.Set("email", email)
+	v.Set("job", strconv.FormatInt(started.UnixMicro(), 10))
+	v.Set("chunk", strconv.Itoa(chunk))
+	u.RawQuery = v.Encode()
+
+	return u.String()
+}
+
+// Queues the given chunk of the user's cleanup job, to run now.
+func (s *Server) queueCleanup(ctx context.Context, email string, started time.Time, chunk int) error {
+	name := taskName(fmt.Sprintf("%s cleanup %d", email, chunk), started)
+	err := s.tasks.Enqueue(ctx, name, s.cleanupTaskURL(email, started, chunk), time.Now())
+	if errors.Is(err, ErrTaskExists) {
+		return nil
+	}
+	return errors.Wrapf(err, "enqueueing cleanup task %d for %s", chunk, email)
+}
+
+// Starts a cleanup job for the user,
+// replacing any that is already running
+// (unless that one is to delete the user and this one isn't),
+// and cancels the user's pending update tasks,
+// which would otherwise put back labels that the job has stripped.
+func (s *Server) startCleanup(ctx context.Context, email string, deleteLabels, deleteUser bool) error {
+	var (
+		u   user
+		now = time.Now().Truncate(time.Microsecond) // the precision of Datastore and of cleanupTaskURL
+	)
+	err := s.store.updateUser(ctx, email, &u, func() error {
+		if u.Token == "" {
+			return mid.CodeErr{C: http.StatusBadRequest, Err: fmt.Errorf("cannot clean up labels for %s, who has no token", email)}
+		}
+		if u.Cleanup.running() && u.Cleanup.DeleteUser && !deleteUser {
+			return mid.CodeErr{C: http.StatusConflict, Err: fmt.Errorf("account %s is being deleted", email)}
+		}
+		u.Cleanup = cleanupJob{Started: now, DeleteLabels: deleteLabels, DeleteUser: deleteUser}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "starting cleanup for %s", email)
+	}
+
+	n, err := s.tasks.Cancel(ctx, isUpdateTaskFor(email))
+	if err != nil {
+		return errors.Wrapf(err, "canceling update tasks for %s", email)
+	}
+	if n > 0 {
+		log.Printf("canceled %d update task(s) for %s", n, email)
+	}
+
+	return s.queueCleanup(ctx, email, now, 1)
+}
+
+// GET/POST /t/cleanup
+func (s *Server) handleCleanup(_ http.ResponseWriter, req *http.Request) (err error) {
+	defer func() {
+		if err != nil {
+			log.Printf("ERROR %s", err)
+		}
+	}()
+
+	err = s.checkTaskQueue(req)
+	if err != nil {
+		return err
+	}
+
+	job, err := strconv.ParseInt(req.FormValue("job"), 10, 64)
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "parsing job")}
+	}
+	chunk, err := strconv.Atoi(req.FormValue("chunk"))
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "parsing chunk")}
+	}
+
+	return s.doCleanup(req.Context(), req.FormValue("email"), time.UnixMicro(job), chunk)
+}
+
+// Executes one chunk of a cleanup job (see cleanupJob):
+// strips the user's labels from up to cleanupChunk threads
+// and queues the next chunk.
+// When no threads remain, it deletes the labels if the job calls for that,
+// and marks the job done.
+//
+// A task for a job other than the user's current one does nothing.
+// So does a task for a finished job,
+// e.g. because the user has re-enabled Unclog in the meantime.
+func (s *Server) doCleanup(ctx context.Context, email string, started time.Time, chunk int) (err error) {
+	defer func() {
+		if reason := revocation(err); reason != "" {
+			err = s.expireUser(ctx, email, reason)
+			if err == nil {
+				err = s.finishCleanup(ctx, email, started, func(u *user) {
+					u.Cleanup.Err = reason
+				})
+			}
+		}
+	}()
+
+	var u user
+	err = s.store.lookupUser(ctx, email, &u)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("not cleaning up for %s, who has been deleted", email)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "looking up user %s", email)
+	}
+	if !u.Cleanup.Started.Equal(started) || !u.Cleanup.Done.IsZero() {
+		log.Printf("skipping cleanup task for %s from abandoned or finished job", email)
+		return nil
+	}
+
+	oauthClient, err := s.oauthClient(ctx, &u)
+	if errors.Is(err, errNoToken) {
+		return s.finishCleanup(ctx, email, started, func(u *user) {
+			u.Cleanup.Err = "no token"
+		})
+	}
+	if err != nil {
+		return errors.Wrap(err, "getting oauth client")
+	}
+	gmailSvc, err := gmail.NewService(ctx, option.WithHTTPClient(oauthClient))
+	if err != nil {
+		return errors.Wrap(err, "allocating gmail service")
+	}
+	limits, err := s.getUpdateLimits(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting update limits")
+	}
+	lim, release := s.userLimiter(email, limits)
+	defer release()
+	mp := newLimitedProvider(NewGmailProvider(gmailSvc, oauthClient), lim)
+
+	n, more, err := stripLabels(ctx, mp, u.ownedLabels(), cleanupChunk)
+	if err != nil {
+		return errors.Wrapf(err, "stripping labels for %s", email)
+	}
+
+	log.Printf("cleanup chunk %d for %s stripped labels from %d thread(s)", chunk, email, n)
+	if more {
+		err = s.store.updateUser(ctx, email, &u, func() error {
+			if !u.Cleanup.Started.Equal(started) {
+				return nil
+			}
+			u.Cleanup.Threads += n
+			return nil
+		})
+		if err != nil {
+			return errors.Wrapf(err, "recording cleanup progress for %s", email)
+		}
+		return s.queueCleanup(ctx, email, started, chunk+1)
+	}
+
+	// The retired labels have been stripped along with the others.
+	retired := make(map[string]bool)
+	for _, l := range u.RetiredLabels {
+		retired[l.ID] = true
+	}
+
+	if u.Cleanup.DeleteLabels {
+		updated := u
+		updated.GroupLabels = append([]groupLabel(nil), u.GroupLabels...)
+		updated.RetiredLabels = append([]Label(nil), u.RetiredLabels...)
+		err = s.deleteLabels(ctx, mp, &updated)
+		if err != nil {
+			return errors.Wrapf(err, "deleting labels for %s", email)
+		}
+		return s.finishCleanup(ctx, email, started, func(u *user) {
+			u.ContactsLabelID = updated.ContactsLabelID
+			u.StarredLabelID = updated.StarredLabelID
+			u.CorrespondentsLabelID = updated.CorrespondentsLabelID
+			u.CreatedLabels = updated.CreatedLabels
+			u.GroupLabels = updated.GroupLabels
+			u.dropRetired(retired)
+			u.Cleanup.Threads += n
+		})
+	}
+	return s.finishCleanup(ctx, email, started, func(u *user) {
+		u.dropRetired(retired)
+		u.Cleanup.Threads += n
+	})
+}
+
+// Marks the user's cleanup job done, after calling f to modify the user,
+// unless the job has been replaced.
+// If the job is to delete the user,
+// the user is then deleted,
+// even if the job has failed
+// (e.g. because the user's OAuth grant is dead,
+// so the labels can't be removed anyway).
+func (s *Server) finishCleanup(ctx context.Context, email string, started time.Time, f func(*user)) error {
+	var u user
+	err := s.store.updateUser(ctx, email, &u, func() error {
+		if !u.Cleanup.Started.Equal(started) {
+			return nil
+		}
+		f(&u)
+		u.Cleanup.Done = time.Now()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "finishing cleanup for %s", email)
+	}
+	log.Printf("finished cleanup for %s after %d thread(s)", email, u.Cleanup.Threads)
+
+	if u.Cleanup.Started.Equal(started) && u.Cleanup.DeleteUser {
+		return s.DeleteUser(ctx, email, false)
+	}
+	return nil
+}
+
+// Removes the given labels from up to max threads carrying any of them,
+// with as few BatchModify calls as possible (see labelBatcher).
+// Threads are found by label ID (see MailProvider.LabelThreads),
+// so the labels' names don't matter.
+// Returns the number of threads changed,
+// and whether there may be more:
+// true if it stopped at max threads.
+// Threads that the listing produces but that no longer carry the labels
+// (the listing can lag behind recent label changes,
+// e.g. those made by the previous chunk of a job)
+// are neither changed nor counted;
+// the listing continues past them,
+// so there may be more only if some threads were changed.
+func stripLabels(ctx context.Context, mp MailProvider, labels []managedLabel, max int) (int, bool, error) {
+	var (
+		remove []string
+		seen   = make(map[string]bool)
+		b      = newLabelBatcher(mp)
+		n      int
+		more   bool
+	)
+	for _, ml := range labels {
+		remove = append(remove, *ml.id)
+	}
+
+	strip := func(threadIDs []string) error {
+		var fresh []string
+		for _, id := range threadIDs {
+			if !seen[id] {
+				seen[id] = true
+				fresh = append(fresh, id)
+			}
+		}
+		if len(fresh) == 0 {
+			return nil
+		}
+		threads, err := mp.GetThreads(ctx, fresh)
+		if err != nil {
+			return errors.Wrap(err, "getting threads")
+		}
+		for _, thread := range threads {
+			var (
+				ch      = &labelChange{threadID: thread.ID, remove: remove}
+				labeled bool
+			)
+			for _, msg := range thread.Messages {
+				ch.messageIDs = append(ch.messageIDs, msg.ID)
+				for _, labelID := range remove {
+					labeled = labeled || contains(msg.LabelIDs, labelID)
+				}
+			}
+			if !labeled {
+				continue
+			}
+			if n >= max {
+				more = true
+				return errEnoughThreads
+			}
+			b.add(ctx, ch)
+			n++
+		}
+		return nil
+	}
+
+	for _, ml := range labels {
+		err := mp.LabelThreads(ctx, *ml.id, strip)
+		if errors.Is(err, errEnoughThreads) {
+			break
+		}
+		if err != nil {
+			return 0, false, errors.Wrapf(err, "listing threads with label %s", ml.name)
+		}
+	}
+
+	if err := b.flush(ctx); err != nil {
+		return 0, false, errors.Wrap(err, "removing labels")
+	}
+	return n, more, nil
+}
+
+// Prepares a user to be re-enabled after a cleanup job:
+// stops the job if it is still running
+// (its remaining tasks then do nothing),
+// and recreates the labels if it deleted them.
+// A job that is to delete the user can't be stopped this way.
+func (s *Server) resumeFromCleanup(ctx context.Context, u *user) error {
+	if u.Cleanup.Started.IsZero() {
+		return nil
+	}
+	if u.Cleanup.running() && u.Cleanup.DeleteUser {
+		return mid.CodeErr{C: http.StatusConflict, Err: fmt.Errorf("account %s is being deleted", u.Email)}
+	}
+	if u.Cleanup.Done.IsZero() {
+		err := s.finishCleanup(ctx, u.Email, u.Cleanup.Started, func(u *user) {
+			u.Cleanup.Err = "canceled by re-enabling Unclog"
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if u.ContactsLabelID != "" && u.StarredLabelID != "" {
+		return nil
+	}
+
+	oauthClient, err := s.oauthClient(ctx, u)
+	if err != nil {
+		return errors.Wrap(err, "getting oauth client")
+	}
+	gmailSvc, err := gmail.NewService(ctx, option.WithHTTPClient(oauthClient))
+	if err != nil {
+		return errors.Wrap(err, "allocating gmail service")
+	}
+	updated := *u
+	updated.GroupLabels = append([]groupLabel(nil), u.GroupLabels...)
+	err = s.ensureLabels(ctx, NewGmailProvider(gmailSvc, oauthClient), &updated)
+	if err != nil {
+		return errors.Wrap(err, "creating labels")
+	}
+	return s.store.updateUser(ctx, u.Email, u, func() error {
+		u.ContactsLabelID = updated.ContactsLabelID
+		u.StarredLabelID = updated.StarredLabelID
+		u.CorrespondentsLabelID = updated.CorrespondentsLabelID
+		u.CreatedLabels = updated.CreatedLabels
+		u.GroupLabels = updated.GroupLabels
+		return nil
+	})
+}
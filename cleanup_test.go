@@ -0,0 +1,224 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStripLabels(t *testing.T) {
+	ctx := context.Background()
+
+	mb := NewMemMailbox()
+
+	u := &user{}
+	if err := (&Server{}).ensureLabels(ctx, mb, u); err != nil {
+		t.Fatal(err)
+	}
+	other, err := mb.CreateLabel(ctx, "Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const n = 450
+	for i := 0; i < n+50; i++ {
+		var labels []string
+		switch {
+		case i >= n:
+			labels = []string{other.ID} // not Unclog's
+		case i%3 == 0:
+			labels = []string{u.StarredLabelID}
+		case i%3 == 1:
+			labels = []string{u.ContactsLabelID, other.ID}
+		default:
+			labels = []string{u.ContactsLabelID, u.StarredLabelID} // counted once
+		}
+		mb.AddThread(&Thread{
+			ID:       fmt.Sprintf("t%03d", i),
+			Messages: []*Message{{ID: fmt.Sprintf("m%03d", i), LabelIDs: append([]string{"INBOX"}, labels...)}},
+		})
+	}
+
+	var chunks []int
+	for {
+		stripped, more, err := stripLabels(ctx, mb, u.ownedLabels(), 200)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, stripped)
+		if !more {
+			break
+		}
+		if len(chunks) > 10 {
+			t.Fatal("too many chunks")
+		}
+	}
+	if want := []int{200, 200, 50}; fmt.Sprint(chunks) != fmt.Sprint(want) {
+		t.Errorf("got chunks %v, want %v", chunks, want)
+	}
+	if got := mb.BatchModifyCalls(); got != 3 {
+		t.Errorf("got %d BatchModify calls, want one per chunk", got)
+	}
+
+	for i := 0; i < n+50; i++ {
+		labels := mb.Thread(fmt.Sprintf("t%03d", i)).Messages[0].LabelIDs
+		if contains(labels, u.ContactsLabelID) || contains(labels, u.StarredLabelID) {
+			t.Errorf("thread %d still has labels %v", i, labels)
+		}
+		if (i%3 == 1 || i >= n) && !contains(labels, other.ID) {
+			t.Errorf("thread %d lost label Other: %v", i, labels)
+		}
+	}
+}
+
+func TestStripLabelsStaleSearch(t *testing.T) {
+	ctx := context.Background()
+
+	mb := NewMemMailbox()
+
+	u := &user{}
+	if err := (&Server{}).ensureLabels(ctx, mb, u); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		mb.AddThread(&Thread{
+			ID:       fmt.Sprintf("t%d", i),
+			Messages: []*Message{{ID: fmt.Sprintf("m%d", i), LabelIDs: []string{u.ContactsLabelID}}},
+		})
+	}
+	var stale []string
+	for i := 0; i < 250; i++ {
+		id := fmt.Sprintf("s%03d", i)
+		mb.AddThread(&Thread{ID: id, Messages: []*Message{{ID: "m" + id}}})
+		stale = append(stale, id)
+	}
+
+	// The listing first produces more threads than a chunk
+	// whose labels were already stripped.
+	mp := &staleListing{MailProvider: mb, stale: stale}
+	n, more, err := stripLabels(ctx, mp, u.ownedLabels(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || more {
+		t.Errorf("got %d thread(s) stripped and more=%v, want 5 and false", n, more)
+	}
+	for _, id := range stale {
+		if got := mb.Modifications(id); got != 0 {
+			t.Errorf("thread %s modified %d time(s), want 0", id, got)
+		}
+	}
+	for i := 0; i < 5; i++ {
+		if got := mb.Thread(fmt.Sprintf("t%d", i)).Messages[0].LabelIDs; len(got) != 0 {
+			t.Errorf("thread t%d still has labels %v", i, got)
+		}
+	}
+}
+
+// staleListing is a MailProvider whose label listings start with some extra thread IDs,
+// like Gmail's just after labels are removed.
+type staleListing struct {
+	MailProvider
+	stale []string
+}
+
+func (s *staleListing) LabelThreads(ctx context.Context, labelID string, f func([]string) error) error {
+	if err := f(s.stale); err != nil {
+		return err
+	}
+	return s.MailProvider.LabelThreads(ctx, labelID, f)
+}
+
+func TestCleanupJob(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	tasks, err := NewLocalTaskQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(bs, tasks, "")
+
+	const email = "alice@example.com"
+	u := user{Token: "{}", ContactsLabelID: "c", StarredLabelID: "s"}
+	if err := bs.newUser(ctx, email, &u); err != nil {
+		t.Fatal(err)
+	}
+
+	// An update task queued before the cleanup starts is canceled.
+	if err := tasks.Enqueue(ctx, "update", s.taskURL(email, "", false), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.startCleanup(ctx, email, true, false); err != nil {
+		t.Fatal(err)
+	}
+	if n := tasks.Pending(); n != 1 {
+		t.Fatalf("got %d pending task(s), want 1", n)
+	}
+	if err := bs.lookupUser(ctx, email, &u); err != nil {
+		t.Fatal(err)
+	}
+	started := u.Cleanup.Started
+	if started.IsZero() || !u.Cleanup.DeleteLabels {
+		t.Fatalf("got cleanup job %+v", u.Cleanup)
+	}
+
+	// An update that runs anyway does nothing while the job runs,
+	// even if the watch is (somehow) still on.
+	err = bs.updateUser(ctx, email, &u, func() error {
+		u.WatchExpiry = time.Now().Add(time.Hour)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.doUpdate(ctx, email, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.lookupUser(ctx, email, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !u.LastUpdate.IsZero() {
+		t.Errorf("got last update %s during cleanup, want none", u.LastUpdate)
+	}
+
+	// A task from some other job does nothing.
+	if err := s.doCleanup(ctx, email, started.Add(-time.Hour), 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Re-enabling stops the job.
+	if err := s.resumeFromCleanup(ctx, &u); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.lookupUser(ctx, email, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Cleanup.Done.IsZero() || u.Cleanup.Err == "" {
+		t.Errorf("got cleanup job %+v after re-enabling, want canceled", u.Cleanup)
+	}
+
+	// Its remaining tasks do nothing.
+	if err := s.doCleanup(ctx, email, started, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cleanup tasks are among those canceled when the user is deleted.
+	if err := s.startCleanup(ctx, email, false, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tasks.Cancel(ctx, isTaskFor(email)); err != nil {
+		t.Fatal(err)
+	}
+	if n := tasks.Pending(); n != 0 {
+		t.Errorf("got %d pending task(s) after canceling, want 0", n)
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"net/http"
 
 	"cloud.google.com/go/datastore"
-	"github.com/bobg/aesite"
 	"github.com/bobg/subcmd/v2"
 	"github.com/pkg/errors"
 
@@ -40,16 +39,23 @@ func (c admincmd) Subcmds() subcmd.Map {
 		"session", c.cliAdminSession, "show the details of a session", subcmd.Params(
 			"cookie", subcmd.String, "", "session cookie",
 		),
+		"delete", c.cliAdminDelete, "delete a user's account", subcmd.Params(
+			"-labels", subcmd.Bool, false, "also remove Unclog's labels from the user's mailbox",
+			"-location", subcmd.String, defaultRegion, "location ID of the update task queue",
+			"addr", subcmd.String, "", "Gmail address",
+		),
+		"reencrypt", c.cliAdminReencrypt, "re-encrypt all users' OAuth tokens with the current token key", nil,
 	)
 }
 
 func (c admincmd) cliAdminGet(ctx context.Context, param string, _ []string) error {
-	dsClient, err := c.dsClient(ctx)
+	s, closeStore, err := c.server(ctx, nil, "")
 	if err != nil {
-		return errors.Wrap(err, "creating datastore client")
+		return err
 	}
+	defer closeStore()
 
-	val, err := aesite.GetSetting(ctx, dsClient, param)
+	val, err := s.GetSetting(ctx, param)
 	if err != nil {
 		return err
 	}
@@ -59,21 +65,23 @@ func (c admincmd) cliAdminGet(ctx context.Context, param string, _ []string) err
 }
 
 func (c admincmd) cliAdminSet(ctx context.Context, param, val string, _ []string) error {
-	dsClient, err := c.dsClient(ctx)
+	s, closeStore, err := c.server(ctx, nil, "")
 	if err != nil {
-		return errors.Wrap(err, "creating datastore client")
+		return err
 	}
+	defer closeStore()
 
-	return aesite.SetSetting(ctx, dsClient, param, []byte(val))
+	return s.SetSetting(ctx, param, []byte(val))
 }
 
 func (c admincmd) cliAdminKick(ctx context.Context, date, addr string, _ []string) error {
-	dsClient, err := c.dsClient(ctx)
+	s, closeStore, err := c.server(ctx, nil, "")
 	if err != nil {
-		return errors.Wrap(err, "creating datastore client")
+		return err
 	}
+	defer closeStore()
 
-	masterKey, err := aesite.GetSetting(ctx, dsClient, "master-key")
+	masterKey, err := s.GetSetting(ctx, "master-key")
 	if err != nil {
 		return errors.Wrap(err, "getting master key")
 	}
@@ -110,17 +118,18 @@ func (c admincmd) cliAdminKick(ctx context.Context, date, addr string, _ []strin
 }
 
 func (c admincmd) cliAdminSession(ctx context.Context, cookie string, _ []string) error {
-	dsClient, err := c.dsClient(ctx)
+	s, closeStore, err := c.server(ctx, nil, "")
 	if err != nil {
-		return errors.Wrap(err, "creating datastore client")
+		return err
 	}
+	defer closeStore()
 
 	key, err := datastore.DecodeKey(cookie)
 	if err != nil {
 		return errors.Wrap(err, "decoding cookie")
 	}
 
-	sess, err := aesite.GetSessionByKey(ctx, dsClient, key)
+	sess, err := s.GetSessionByKey(ctx, key)
 	if err != nil {
 		return errors.Wrap(err, "getting session")
 	}
@@ -129,3 +138,40 @@ func (c admincmd) cliAdminSession(ctx context.Context, cookie string, _ []string
 
 	return nil
 }
+
+func (c admincmd) cliAdminReencrypt(ctx context.Context, _ []string) error {
+	s, closeStore, err := c.server(ctx, nil, "")
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+
+	n, err := s.ReencryptTokens(ctx)
+	fmt.Printf("Re-encrypted %d token(s)\n", n)
+	return err
+}
+
+// With -db, no update tasks are canceled,
+// since the in-process task queue belongs to the running server;
+// any that remain do nothing for a deleted user.
+// For the same reason, -labels (which needs a task queue for its cleanup job)
+// is not possible with -db.
+func (c admincmd) cliAdminDelete(ctx context.Context, removeLabels bool, locationID, addr string, _ []string) error {
+	var (
+		tasks unclog.TaskQueue
+		err   error
+	)
+	if c.db == "" {
+		tasks, err = c.cloudTasks(ctx, locationID)
+		if err != nil {
+			return err
+		}
+	}
+
+	s, closeStore, err := c.server(ctx, tasks, "")
+	if err != nil {
+		return err
+	}
+	defer closeStore()
+	return s.DeleteUser(ctx, addr, removeLabels)
+}
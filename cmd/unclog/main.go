@@ -5,6 +5,7 @@ import (
 	"flag"
 	"log"
 	"os"
+	"time"
 
 	"cloud.google.com/go/datastore"
 	"github.com/bobg/aesite"
@@ -12,6 +13,8 @@ import (
 	"github.com/pkg/errors"
 	"google.golang.org/api/option"
 	"google.golang.org/appengine"
+
+	"github.com/bobg/unclog"
 )
 
 const (
@@ -25,6 +28,8 @@ func main() {
 		creds     = flag.String("creds", "", "credentials file")
 		projectID = flag.String("project", defaultProject, "project ID")
 		test      = flag.Bool("test", false, "run in test mode")
+		db        = flag.String("db", "", "embedded database file (default: use Google Cloud Datastore)")
+		tokenKeys = flag.String("token-keys", "", "file of keys for encrypting OAuth tokens (default: use the token-keys setting)")
 	)
 	flag.Parse()
 
@@ -32,13 +37,14 @@ func main() {
 		log.Fatal("Cannot supply both -test and -creds")
 	}
 
+	c := maincmd{creds: *creds, projectID: *projectID, test: *test, db: *db, tokenKeys: *tokenKeys}
+
 	if appengine.IsAppEngine() && len(os.Args) < 2 {
-		err := doServe(context.Background(), *creds, *projectID, defaultRegion, defaultDir, *test)
+		err := c.doServe(context.Background(), defaultRegion, defaultDir, "", 0, 0)
 		if err != nil {
 			log.Fatal(err)
 		}
 	} else {
-		c := maincmd{creds: *creds, projectID: *projectID, test: *test}
 		err := subcmd.Run(context.Background(), c, flag.Args())
 		if err != nil {
 			log.Fatal(err)
@@ -50,6 +56,8 @@ type maincmd struct {
 	creds     string
 	projectID string
 	test      bool
+	db        string
+	tokenKeys string
 }
 
 func (c maincmd) Subcmds() subcmd.Map {
@@ -58,12 +66,48 @@ func (c maincmd) Subcmds() subcmd.Map {
 		"serve", c.cliServe, "run a server", subcmd.Params(
 			"-location", subcmd.String, defaultRegion, "location ID",
 			"-dir", subcmd.String, defaultDir, "content dir",
+			"-tasks", subcmd.String, "", "file for an in-process task queue (default: use Google Cloud Tasks)",
+			"-test", subcmd.Bool, false, "run in test mode",
+			"-standalone", subcmd.Bool, false, "run without Google Cloud: in-process task queue and scheduler (requires -db)",
+			"-renew", subcmd.Duration, time.Hour, "with -standalone, how often to renew Gmail watches",
+			"-catchup", subcmd.Duration, time.Hour, "with -standalone, how often to queue catch-up updates",
 		),
 	)
 }
 
-func (c maincmd) dsClient(ctx context.Context) (*datastore.Client, error) {
-	return getDSClient(ctx, c.creds, c.projectID, c.test)
+// Produces a new Server
+// using the embedded database if c.db is set,
+// otherwise Google Cloud Datastore,
+// and loading its token keys from c.tokenKeys if that is set.
+// The caller must call the returned close function when done.
+func (c maincmd) server(ctx context.Context, tasks unclog.TaskQueue, contentDir string) (*unclog.Server, func() error, error) {
+	var (
+		s          *unclog.Server
+		closeStore func() error
+	)
+	if c.db != "" {
+		bs, err := unclog.OpenBoltStore(c.db)
+		if errors.Is(err, unclog.ErrBoltLocked) {
+			return nil, nil, errors.Errorf("%s is in use, probably by a running server; stop the server before using -db with another command", c.db)
+		}
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "opening embedded database")
+		}
+		s, closeStore = unclog.NewBoltServer(bs, tasks, contentDir), bs.Close
+	} else {
+		dsClient, err := getDSClient(ctx, c.creds, c.projectID, c.test)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "creating datastore client")
+		}
+		s, closeStore = unclog.NewDatastoreServer(unclog.NewDatastoreStore(dsClient), tasks, contentDir), dsClient.Close
+	}
+	if c.tokenKeys != "" {
+		if err := s.LoadTokenKeys(c.tokenKeys); err != nil {
+			closeStore()
+			return nil, nil, err
+		}
+	}
+	return s, closeStore, nil
 }
 
 func getDSClient(ctx context.Context, creds, projectID string, test bool) (*datastore.Client, error) {
@@ -5,6 +5,8 @@ import (
 	"log"
 	"os"
 	"os/signal"
+	"sync"
+	"time"
 
 	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
 	"github.com/pkg/errors"
@@ -13,19 +15,36 @@ import (
 	"github.com/bobg/unclog"
 )
 
-func (c maincmd) cliServe(ctx context.Context, locationID, contentDir string, test bool, _ []string) error {
-	return doServe(ctx, c.creds, c.projectID, locationID, contentDir, test)
+const defaultTasksFile = "unclog-tasks.json"
+
+func (c maincmd) cliServe(ctx context.Context, locationID, contentDir, tasksFile string, test, standalone bool, renewInterval, catchupInterval time.Duration, _ []string) error {
+	c.test = c.test || test
+	if !standalone {
+		return c.doServe(ctx, locationID, contentDir, tasksFile, 0, 0)
+	}
+	if c.db == "" {
+		return errors.New("-standalone requires -db")
+	}
+	if renewInterval <= 0 || catchupInterval <= 0 {
+		return errors.New("-standalone requires positive -renew and -catchup intervals")
+	}
+	if tasksFile == "" {
+		tasksFile = defaultTasksFile
+	}
+	return c.doServe(ctx, locationID, contentDir, tasksFile, renewInterval, catchupInterval)
 }
 
-func doServe(ctx context.Context, creds, projectID, locationID, contentDir string, test bool) error {
+// If tasksFile is non-empty,
+// update tasks are queued in-process and persisted to that file
+// instead of using Google Cloud Tasks.
+//
+// If renewInterval and catchupInterval are non-zero,
+// the jobs of the /t/cron handler run in-process on that schedule
+// instead of relying on App Engine cron.
+func (c maincmd) doServe(ctx context.Context, locationID, contentDir, tasksFile string, renewInterval, catchupInterval time.Duration) error {
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	dsClient, err := getDSClient(ctx, creds, projectID, test)
-	if err != nil {
-		return errors.Wrap(err, "creating datastore client")
-	}
-
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt)
 	go func() {
@@ -34,17 +53,59 @@ func doServe(ctx context.Context, creds, projectID, locationID, contentDir strin
 		cancel()
 	}()
 
-	var options []option.ClientOption
-	if creds != "" {
-		options = append(options, option.WithCredentialsFile(creds))
+	var (
+		tasks unclog.TaskQueue
+		err   error
+	)
+	if tasksFile != "" {
+		tasks, err = unclog.NewLocalTaskQueue(tasksFile)
+		if err != nil {
+			return errors.Wrap(err, "creating local task queue")
+		}
+	} else {
+		tasks, err = c.cloudTasks(ctx, locationID)
+		if err != nil {
+			return err
+		}
 	}
-	ctClient, err := cloudtasks.NewClient(ctx, options...)
+
+	s, closeStore, err := c.server(ctx, tasks, contentDir)
 	if err != nil {
-		return errors.Wrap(err, "creating cloudtasks client")
+		return err
+	}
+	defer closeStore()
+
+	var wg sync.WaitGroup
+	if renewInterval > 0 && catchupInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.RunScheduler(ctx, renewInterval, catchupInterval)
+			if err != nil {
+				log.Printf("ERROR running scheduler: %s", err)
+			}
+		}()
 	}
 
-	s := unclog.NewServer(dsClient, ctClient, projectID, locationID, contentDir)
 	err = s.Serve(ctx)
 
+	// Stop the scheduler (if the server exited on its own)
+	// and wait for it before closing the store.
+	cancel()
+	wg.Wait()
+
 	return errors.Wrap(err, "running server")
 }
+
+// Connects to the Google Cloud Tasks queue in the given location.
+func (c maincmd) cloudTasks(ctx context.Context, locationID string) (*unclog.CloudTaskQueue, error) {
+	var options []option.ClientOption
+	if c.creds != "" {
+		options = append(options, option.WithCredentialsFile(c.creds))
+	}
+	ctClient, err := cloudtasks.NewClient(ctx, options...)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cloudtasks client")
+	}
+	return unclog.NewCloudTaskQueue(ctClient, c.projectID, locationID), nil
+}
@@ -0,0 +1,257 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/people/v1"
+)
+
+// Contact is an entry in a user's address book, normalized from its source.
+type Contact struct {
+	// ID identifies the contact in its source.
+	ID string
+
+	// Addrs are the contact's e-mail addresses.
+	Addrs []string
+
+	// Groups are the IDs of the contact groups the contact belongs to,
+	// such as "starred".
+	Groups []string
+}
+
+// ContactGroup is a group in a user's address book.
+type ContactGroup struct {
+	// ID is the group's ID, as it appears in Contact.Groups.
+	ID string
+
+	// Name is the group's name as shown to the user.
+	Name string
+}
+
+// starredGroup is the ID of the system contact group for starred contacts.
+const starredGroup = "starred"
+
+// InGroup tells whether c belongs to the contact group with the given ID.
+func (c *Contact) InGroup(groupID string) bool {
+	return contains(c.Groups, groupID)
+}
+
+// ContactSource is a source of a user's contacts.
+// PeopleContactSource is the production implementation.
+// StaticContacts is a fixed set of contacts for tests and local runs.
+type ContactSource interface {
+	// Contacts returns the contacts having at least one e-mail address.
+	Contacts(ctx context.Context) ([]*Contact, error)
+
+	// Groups returns the contact groups.
+	Groups(ctx context.Context) ([]*ContactGroup, error)
+}
+
+// ContactSyncer is a ContactSource that can report just the changes since an earlier listing.
+type ContactSyncer interface {
+	ContactSource
+
+	// SyncContacts lists the contacts changed since the listing that produced the given sync token,
+	// or all contacts if the token is empty.
+	// Changed contacts having at least one e-mail address are in changed.
+	// The IDs of other changed contacts,
+	// including deleted ones and ones that no longer have addresses,
+	// are in removed.
+	// The result includes a new sync token for the next call.
+	// If the sync token has expired, the error is ErrSyncTokenExpired,
+	// and the caller should start over with an empty token.
+	SyncContacts(ctx context.Context, syncToken string) (changed []*Contact, removed []string, nextToken string, err error)
+}
+
+// ErrSyncTokenExpired is the error returned by ContactSyncer.SyncContacts
+// when its sync token is no longer valid.
+var ErrSyncTokenExpired = errors.New("sync token expired")
+
+// PeopleContactSource is a ContactSource backed by the Google People API.
+type PeopleContactSource struct {
+	svc *people.Service
+}
+
+var _ ContactSyncer = &PeopleContactSource{}
+
+// NewPeopleContactSource produces a new PeopleContactSource using the given People service.
+func NewPeopleContactSource(svc *people.Service) *PeopleContactSource {
+	return &PeopleContactSource{svc: svc}
+}
+
+// Contacts implements ContactSource.Contacts.
+func (p *PeopleContactSource) Contacts(ctx context.Context) ([]*Contact, error) {
+	var result []*Contact
+
+	peopleConnSvc := people.NewPeopleConnectionsService(p.svc)
+	call := peopleConnSvc.List("people/me").PersonFields("emailAddresses,names,memberships").Context(ctx)
+	err := retryPages(ctx, connectionsFetcher(call), func(resp *people.ListConnectionsResponse) error {
+		for _, person := range resp.Connections {
+			if c := contactFromPerson(person); c != nil {
+				result = append(result, c)
+			}
+		}
+		return nil
+	})
+	return result, err
+}
+
+// SyncContacts implements ContactSyncer.SyncContacts.
+func (p *PeopleContactSource) SyncContacts(ctx context.Context, syncToken string) ([]*Contact, []string, string, error) {
+	var (
+		changed   []*Contact
+		removed   []string
+		nextToken string
+	)
+
+	peopleConnSvc := people.NewPeopleConnectionsService(p.svc)
+	call := peopleConnSvc.List("people/me").PersonFields("emailAddresses,names,memberships").RequestSyncToken(true).Context(ctx)
+	if syncToken != "" {
+		call = call.SyncToken(syncToken)
+	}
+	err := retryPages(ctx, connectionsFetcher(call), func(resp *people.ListConnectionsResponse) error {
+		for _, person := range resp.Connections {
+			if person.Metadata != nil && person.Metadata.Deleted {
+				removed = append(removed, person.ResourceName)
+			} else if c := contactFromPerson(person); c != nil {
+				changed = append(changed, c)
+			} else {
+				removed = append(removed, person.ResourceName)
+			}
+		}
+		if resp.NextSyncToken != "" {
+			nextToken = resp.NextSyncToken
+		}
+		return nil
+	})
+	if isSyncTokenExpired(err) {
+		return nil, nil, "", ErrSyncTokenExpired
+	}
+	if err != nil {
+		return nil, nil, "", errors.Wrap(err, "listing connections")
+	}
+	return changed, removed, nextToken, nil
+}
+
+// Returns a page-fetching function for retryPages.
+func connectionsFetcher(call *people.PeopleConnectionsListCall) func(string) (*people.ListConnectionsResponse, string, error) {
+	return pageFetcher(call, func(resp *people.ListConnectionsResponse) string { return resp.NextPageToken })
+}
+
+// The People API reports an expired sync token
+// with the reason EXPIRED_SYNC_TOKEN
+// (and, formerly, with the status 410 Gone).
+func isSyncTokenExpired(err error) bool {
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+	return gerr.Code == http.StatusGone || strings.Contains(gerr.Body, "EXPIRED_SYNC_TOKEN") || strings.Contains(gerr.Message, "EXPIRED_SYNC_TOKEN")
+}
+
+// Groups implements ContactSource.Groups.
+func (p *PeopleContactSource) Groups(ctx context.Context) ([]*ContactGroup, error) {
+	var result []*ContactGroup
+
+	call := p.svc.ContactGroups.List().Context(ctx)
+	fetch := pageFetcher(call, func(resp *people.ListContactGroupsResponse) string { return resp.NextPageToken })
+	err := retryPages(ctx, fetch, func(resp *people.ListContactGroupsResponse) error {
+		for _, g := range resp.ContactGroups {
+			result = append(result, &ContactGroup{
+				ID:   strings.TrimPrefix(g.ResourceName, "contactGroups/"),
+				Name: g.FormattedName,
+			})
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Returns nil if the person has no e-mail addresses.
+func contactFromPerson(person *people.Person) *Contact {
+	c := Contact{ID: person.ResourceName}
+	for _, a := range person.EmailAddresses {
+		if a.Value != "" {
+			c.Addrs = append(c.Addrs, a.Value)
+		}
+	}
+	if len(c.Addrs) == 0 {
+		return nil
+	}
+	for _, m := range person.Memberships {
+		if m.ContactGroupMembership != nil {
+			c.Groups = append(c.Groups, m.ContactGroupMembership.ContactGroupId)
+		}
+	}
+	return &c
+}
+
+// StaticContacts is a ContactSource with a fixed set of contacts.
+type StaticContacts []*Contact
+
+var _ ContactSyncer = StaticContacts{}
+
+// staticSyncToken is the sync token produced by StaticContacts.SyncContacts.
+const staticSyncToken = "static"
+
+// Contacts implements ContactSource.Contacts.
+func (s StaticContacts) Contacts(context.Context) ([]*Contact, error) {
+	var result []*Contact
+	for _, c := range s {
+		if len(c.Addrs) > 0 {
+			result = append(result, c)
+		}
+	}
+	return result, nil
+}
+
+// SyncContacts implements ContactSyncer.SyncContacts.
+// Since the contacts never change,
+// only a call with an empty sync token produces any.
+// Contacts without IDs are identified by their position.
+func (s StaticContacts) SyncContacts(ctx context.Context, syncToken string) ([]*Contact, []string, string, error) {
+	switch syncToken {
+	case "":
+		var result []*Contact
+		for i, c := range s {
+			if len(c.Addrs) == 0 {
+				continue
+			}
+			if c.ID == "" {
+				cc := *c
+				cc.ID = fmt.Sprintf("static/%d", i)
+				c = &cc
+			}
+			result = append(result, c)
+		}
+		return result, nil, staticSyncToken, nil
+
+	case staticSyncToken:
+		return nil, nil, staticSyncToken, nil
+	}
+	return nil, nil, "", ErrSyncTokenExpired
+}
+
+// Groups implements ContactSource.Groups.
+// The groups are the ones the contacts belong to,
+// each named by its ID.
+func (s StaticContacts) Groups(context.Context) ([]*ContactGroup, error) {
+	var (
+		result []*ContactGroup
+		seen   = make(map[string]bool)
+	)
+	for _, c := range s {
+		for _, g := range c.Groups {
+			if !seen[g] {
+				seen[g] = true
+				result = append(result, &ContactGroup{ID: g, Name: g})
+			}
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,123 @@
+package unclog
+
+import (
+	"context"
+	"testing"
+
+	"google.golang.org/api/people/v1"
+)
+
+func TestContactFromPerson(t *testing.T) {
+	person := &people.Person{
+		EmailAddresses: []*people.EmailAddress{{Value: ""}, {Value: "alice@example.com"}},
+		Memberships: []*people.Membership{
+			{ContactGroupMembership: &people.ContactGroupMembership{ContactGroupId: "myContacts"}},
+			{DomainMembership: &people.DomainMembership{InViewerDomain: true}},
+			{ContactGroupMembership: &people.ContactGroupMembership{ContactGroupId: "starred"}},
+		},
+	}
+	c := contactFromPerson(person)
+	if c == nil {
+		t.Fatal("got nil contact")
+	}
+	if !sameStrings(c.Addrs, []string{"alice@example.com"}) {
+		t.Errorf("got addrs %v", c.Addrs)
+	}
+	if !sameStrings(c.Groups, []string{"myContacts", "starred"}) {
+		t.Errorf("got groups %v", c.Groups)
+	}
+
+	person = &people.Person{EmailAddresses: []*people.EmailAddress{{Value: ""}}}
+	if c := contactFromPerson(person); c != nil {
+		t.Errorf("got %+v, want nil for person without addresses", c)
+	}
+}
+
+func TestLabelTiers(t *testing.T) {
+	src := StaticContacts{
+		{Addrs: []string{"alice@example.com"}, Groups: []string{"myContacts", "starred", "family"}},
+		{Addrs: []string{"bob@example.com"}, Groups: []string{"myContacts", "family", "work"}},
+		{Addrs: []string{"carol@example.com", "carol@example.org"}, Groups: []string{"work"}},
+		{Addrs: []string{"dave@example.com"}},
+		{Groups: []string{"starred"}}, // no addresses
+	}
+	contacts, err := src.Contacts(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &user{
+		ContactsLabelID: "L1",
+		StarredLabelID:  "L2",
+		GroupLabels: []groupLabel{
+			{GroupID: "family", Name: "✔/Family", LabelID: "L3"},
+			{GroupID: "clients", Name: "✔/Clients"}, // label not yet created
+			{GroupID: "work", Name: "✔/Work", LabelID: "L4"},
+		},
+	}
+	tiers := u.labelTiers(contacts, nil)
+
+	want := []struct {
+		labelID string
+		addrs   []string
+	}{
+		{"L2", []string{"alice@example.com"}},
+		{"L3", []string{"bob@example.com"}},
+		{"L4", []string{"carol@example.com", "carol@example.org"}},
+		{"L1", []string{"dave@example.com"}},
+	}
+	if len(tiers) != len(want) {
+		t.Fatalf("got %d tiers, want %d", len(tiers), len(want))
+	}
+	for i, w := range want {
+		if tiers[i].labelID != w.labelID {
+			t.Errorf("tier %d: got label %s, want %s", i, tiers[i].labelID, w.labelID)
+		}
+		var addrs []string
+		for _, c := range tiers[i].contacts {
+			addrs = append(addrs, c.Addrs...)
+		}
+		if !sameStrings(addrs, w.addrs) {
+			t.Errorf("tier %d: got addrs %v, want %v", i, addrs, w.addrs)
+		}
+	}
+}
+
+func TestResolveGroupLabels(t *testing.T) {
+	groups := []*ContactGroup{
+		{ID: "starred", Name: "Starred"},
+		{ID: "abc123", Name: "Family"},
+		{ID: "def456", Name: "Work"},
+	}
+
+	got, err := resolveGroupLabels(groups, []string{"family", "def456"}, []string{"✔/Family", " ✔/Work "}, contactsLabelName, starredLabelName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []groupLabel{
+		{GroupID: "abc123", Name: "✔/Family"},
+		{GroupID: "def456", Name: "✔/Work"},
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	bad := []struct {
+		name           string
+		groups, labels []string
+	}{
+		{"unknown group", []string{"Clients"}, []string{"✔/Clients"}},
+		{"starred", []string{"Starred"}, []string{"✔/Fave"}},
+		{"duplicate group", []string{"Family", "abc123"}, []string{"✔/A", "✔/B"}},
+		{"duplicate label", []string{"Family", "Work"}, []string{"✔/A", "✔/A"}},
+		{"builtin label", []string{"Family"}, []string{"✔"}},
+		{"empty label", []string{"Family"}, []string{" "}},
+	}
+	for _, b := range bad {
+		t.Run(b.name, func(t *testing.T) {
+			if _, err := resolveGroupLabels(groups, b.groups, b.labels, contactsLabelName, starredLabelName); err == nil {
+				t.Error("got no error")
+			}
+		})
+	}
+}
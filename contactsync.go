@@ -0,0 +1,202 @@
+package unclog
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// contactSnapshot is a user's contacts as of the last sync with their ContactSyncer,
+// stored between updates so that each update need only apply the changes.
+// It also holds the user's correspondents,
+// which are kept out of the user record for the same reasons as the contacts:
+// there can be many of them,
+// and their addresses are keyed the same way.
+type contactSnapshot struct {
+	// SyncToken is the token for getting the changes since the snapshot.
+	SyncToken string
+
+	// Keying describes how the addresses in Contacts and Correspondents were keyed (see user.addrKeying).
+	// If it no longer matches the user's settings,
+	// the snapshot is discarded, the contacts are resynced in full,
+	// and the correspondents are rescanned.
+	Keying string
+
+	// Contacts maps contact IDs to contacts,
+	// whose addresses are keys produced by user.addrKey.
+	Contacts map[string]*Contact
+
+	// Correspondents is the set of people the user has written to
+	// within CorrespondentsLookback,
+	// as of CorrespondentsTime.
+	// See refreshCorrespondents.
+	Correspondents []correspondent
+
+	// CorrespondentsTime is the timestamp of the latest sent message contemplated in Correspondents.
+	CorrespondentsTime time.Time
+
+	// CorrespondentsLookback is the lookback period (see user.CorrespondentsLookback)
+	// that Correspondents covers.
+	CorrespondentsLookback time.Duration
+}
+
+// Gets the user's stored contact snapshot.
+// If there is none,
+// or it can't be decoded,
+// or its addresses were keyed with different settings,
+// the result is an empty snapshot.
+func (s *Server) getContactSnapshot(ctx context.Context, u *user) (*contactSnapshot, error) {
+	var (
+		snap   contactSnapshot
+		keying = u.addrKeying()
+	)
+
+	data, err := s.store.getContacts(ctx, u.Email)
+	if errors.Is(err, ErrNotFound) {
+		// No snapshot yet.
+	} else if err != nil {
+		return nil, errors.Wrap(err, "getting contact snapshot")
+	} else if err = decodeContactSnapshot(data, &snap); err != nil {
+		log.Printf("discarding undecodable contact snapshot for %s: %s", u.Email, err)
+		snap = contactSnapshot{}
+	}
+	if snap.Keying != keying {
+		snap = contactSnapshot{Keying: keying}
+	}
+	return &snap, nil
+}
+
+// Stores the user's contact snapshot.
+func (s *Server) putContactSnapshot(ctx context.Context, email string, snap *contactSnapshot) error {
+	data, err := encodeContactSnapshot(snap)
+	if err != nil {
+		return errors.Wrap(err, "encoding contact snapshot")
+	}
+	err = s.store.putContacts(ctx, email, data)
+	return errors.Wrap(err, "storing contact snapshot")
+}
+
+// Returns the key under which the address addr is stored and looked up:
+// its canonical form (see matchPolicy.canonicalAddr),
+// hashed if u.HashContacts is set.
+func (u *user) addrKey(addr string) string {
+	addr = u.MatchPolicy.canonicalAddr(addr)
+	if hash := u.addrHasher(); hash != nil {
+		return hash(addr)
+	}
+	return addr
+}
+
+// Returns the function that hashes canonical addresses into keys,
+// or nil if u.HashContacts is not set.
+// The hash is keyed with the user's secret,
+// so stored hashes can't be checked against a list of known addresses
+// without it.
+func (u *user) addrHasher() func(string) string {
+	if !u.HashContacts {
+		return nil
+	}
+	secret := u.Secret
+	return func(addr string) string {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte(addr))
+		return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:18])
+	}
+}
+
+// Describes the settings that affect u.addrKey,
+// so a snapshot keyed with different settings can be detected.
+func (u *user) addrKeying() string {
+	var b strings.Builder
+	if u.HashContacts {
+		b.WriteString("hashed")
+	} else {
+		b.WriteString("plain")
+	}
+	for _, r := range u.MatchPolicy.PlusRules {
+		fmt.Fprintf(&b, " %s%s", r.Sep, r.Domain)
+	}
+	return b.String()
+}
+
+// Returns a copy of c with its addresses replaced by their keys (see user.addrKey).
+func (u *user) keyContact(c *Contact) *Contact {
+	result := &Contact{ID: c.ID, Groups: c.Groups}
+	for _, addr := range c.Addrs {
+		result.Addrs = append(result.Addrs, u.addrKey(addr))
+	}
+	return result
+}
+
+// Brings the contacts in snap (from Server.getContactSnapshot) up to date with src
+// and returns them, with keyed addresses (see user.addrKey).
+// Only the changes since the last sync are fetched,
+// unless snap is empty or its sync token has expired,
+// in which case all contacts are fetched.
+// The caller is responsible for storing snap (see Server.putContactSnapshot).
+func syncContacts(ctx context.Context, src ContactSyncer, u *user, snap *contactSnapshot) ([]*Contact, error) {
+	changed, removed, nextToken, err := src.SyncContacts(ctx, snap.SyncToken)
+	if errors.Is(err, ErrSyncTokenExpired) {
+		log.Printf("contact sync token for %s expired, resyncing", u.Email)
+		snap.SyncToken = ""
+		changed, removed, nextToken, err = src.SyncContacts(ctx, "")
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "syncing contacts")
+	}
+
+	if snap.SyncToken == "" || snap.Contacts == nil {
+		// Full sync.
+		snap.Contacts = make(map[string]*Contact)
+	}
+	for _, id := range removed {
+		delete(snap.Contacts, id)
+	}
+	for _, c := range changed {
+		snap.Contacts[c.ID] = u.keyContact(c)
+	}
+	snap.SyncToken = nextToken
+
+	ids := make([]string, 0, len(snap.Contacts))
+	for id := range snap.Contacts {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	result := make([]*Contact, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, snap.Contacts[id])
+	}
+	return result, nil
+}
+
+func encodeContactSnapshot(snap *contactSnapshot) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if err := gob.NewEncoder(w).Encode(snap); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeContactSnapshot(data []byte, snap *contactSnapshot) error {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(r).Decode(snap)
+}
@@ -0,0 +1,183 @@
+package unclog
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/bobg/aesite"
+)
+
+// fakeSyncer is a ContactSyncer whose contacts can be changed between syncs.
+// Its sync tokens are version numbers.
+type fakeSyncer struct {
+	StaticContacts
+
+	versions []fakeVersion // versions[i] is the state after the ith change
+	expired  bool          // whether all nonempty sync tokens are expired
+	calls    []string      // sync tokens received
+}
+
+type fakeVersion struct {
+	changed []*Contact
+	removed []string
+}
+
+func (f *fakeSyncer) SyncContacts(ctx context.Context, syncToken string) ([]*Contact, []string, string, error) {
+	f.calls = append(f.calls, syncToken)
+
+	var (
+		all     = make(map[string]*Contact)
+		changed []*Contact
+		removed []string
+		from    = -1
+	)
+	if syncToken != "" {
+		if f.expired {
+			return nil, nil, "", ErrSyncTokenExpired
+		}
+		from = strings.Count(syncToken, "v") - 1
+	}
+	for i, v := range f.versions {
+		for _, c := range v.changed {
+			all[c.ID] = c
+			if i > from {
+				changed = append(changed, c)
+			}
+		}
+		for _, id := range v.removed {
+			delete(all, id)
+			if i > from {
+				removed = append(removed, id)
+			}
+		}
+	}
+	if from < 0 {
+		changed, removed = nil, nil
+		for _, c := range all {
+			changed = append(changed, c)
+		}
+	}
+	return changed, removed, strings.Repeat("v", len(f.versions)), nil
+}
+
+func TestSyncContacts(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	var (
+		s = &Server{store: bs}
+		u = &user{User: aesite.User{Email: "me@example.com", Secret: []byte("xyzzy")}}
+		f = &fakeSyncer{versions: []fakeVersion{{
+			changed: []*Contact{
+				{ID: "people/1", Addrs: []string{"Alice@Example.com"}},
+				{ID: "people/2", Addrs: []string{"bob.smith+x@googlemail.com"}, Groups: []string{"starred"}},
+			},
+		}}}
+	)
+
+	// As in an update.
+	sync := func() ([]*Contact, error) {
+		snap, err := s.getContactSnapshot(ctx, u)
+		if err != nil {
+			return nil, err
+		}
+		contacts, err := syncContacts(ctx, f, u, snap)
+		if err != nil {
+			return nil, err
+		}
+		return contacts, s.putContactSnapshot(ctx, u.Email, snap)
+	}
+
+	check := func(wantToken string, want ...string) {
+		t.Helper()
+
+		contacts, err := sync()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range contacts {
+			got = append(got, c.Addrs...)
+		}
+		if !sameStrings(got, want) {
+			t.Errorf("got addrs %v, want %v", got, want)
+		}
+		if last := f.calls[len(f.calls)-1]; last != wantToken {
+			t.Errorf("got last sync token %q, want %q", last, wantToken)
+		}
+	}
+
+	// Full sync.
+	check("", "alice@example.com", "bobsmith@gmail.com")
+
+	// Incremental sync.
+	f.versions = append(f.versions, fakeVersion{
+		changed: []*Contact{{ID: "people/3", Addrs: []string{"carol@example.com"}}},
+		removed: []string{"people/1"},
+	})
+	check("v", "bobsmith@gmail.com", "carol@example.com")
+
+	// Nothing new.
+	check("vv", "bobsmith@gmail.com", "carol@example.com")
+
+	// Expired token.
+	f.expired = true
+	check("", "bobsmith@gmail.com", "carol@example.com")
+	if n := len(f.calls); n != 5 || f.calls[3] != "vv" {
+		t.Errorf("got calls %v, want a failed incremental sync followed by a full one", f.calls)
+	}
+	f.expired = false
+
+	// Changing the plus rules discards the snapshot.
+	u.MatchPolicy.PlusRules = []plusRule{{Domain: "example.com", Sep: "+"}}
+	f.versions = append(f.versions, fakeVersion{
+		changed: []*Contact{{ID: "people/4", Addrs: []string{"dave+lists@example.com"}}},
+	})
+	check("", "bobsmith@gmail.com", "carol@example.com", "dave@example.com")
+
+	// So does switching to hashed addresses.
+	u.HashContacts = true
+	hash := u.addrHasher()
+	check("", hash("bobsmith@gmail.com"), hash("carol@example.com"), hash("dave@example.com"))
+
+	data, err := bs.getContacts(ctx, u.Email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var snap contactSnapshot
+	if err = decodeContactSnapshot(data, &snap); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range snap.Contacts {
+		for _, addr := range c.Addrs {
+			if strings.Contains(addr, "@") {
+				t.Errorf("found unhashed address %s in snapshot", addr)
+			}
+		}
+	}
+
+	// Hashed contacts still match senders.
+	contacts, err := sync()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.ContactsLabelID, u.StarredLabelID = "L1", "L2"
+	index := newTierIndex(u.labelTiers(contacts, nil), u.addrHasher())
+	for addr, want := range map[string]int{
+		"Bob.Smith@gmail.com":                            0,
+		"dave+other@example.com":                         1,
+		"stranger@example.com":                           -1,
+		u.MatchPolicy.canonicalAddr("carol@example.com"): 1,
+	} {
+		if got := index.lookup(u.MatchPolicy.canonicalAddr(addr)); got != want {
+			t.Errorf("lookup(%s): got %d, want %d", addr, got, want)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	correspondentsLabelName = "✔/✉"
+
+	// The most correspondents kept in a contact snapshot.
+	// When there are more, the ones least recently written to are dropped.
+	maxCorrespondents = 5000
+)
+
+// correspondent is someone the user has sent mail to.
+type correspondent struct {
+	// Addr is the recipient's address, in lowercase.
+	Addr string
+
+	// Last is the time of the latest message the user sent to Addr.
+	Last time.Time
+}
+
+// Returns the name of u's label for correspondents.
+func (u *user) correspondentsLabel() string {
+	if u.CorrespondentsLabelName != "" {
+		return u.CorrespondentsLabelName
+	}
+	return correspondentsLabelName
+}
+
+// Brings the correspondents in snap (from Server.getContactSnapshot) up to date
+// by scanning the To and Cc headers of mail that u sent since the last refresh
+// (fetching the threads in batches with MailProvider.GetThreads)
+// (but no earlier than u.CorrespondentsLookback before now),
+// and dropping any correspondents not written to within the lookback period.
+// If snap covers a shorter lookback period than u's,
+// the scan starts over.
+// The caller is responsible for storing snap (see Server.putContactSnapshot).
+func refreshCorrespondents(ctx context.Context, mp MailProvider, u *user, snap *contactSnapshot, now time.Time) error {
+	if snap.CorrespondentsLookback < u.CorrespondentsLookback {
+		snap.Correspondents = nil
+		snap.CorrespondentsTime = time.Time{}
+	}
+
+	var (
+		cutoff    = now.Add(-u.CorrespondentsLookback)
+		startTime = snap.CorrespondentsTime.Add(-5 * time.Second) // a little overlap, so nothing gets missed
+		latest    = snap.CorrespondentsTime
+		last      = make(map[string]time.Time)
+	)
+	if startTime.Before(cutoff) {
+		startTime = cutoff
+	}
+	for _, c := range snap.Correspondents {
+		last[c.Addr] = c.Last
+	}
+
+	query := fmt.Sprintf("in:sent after:%d", startTime.Unix())
+	err := mp.ListThreads(ctx, query, func(threadIDs []string) error {
+		threads, err := mp.GetThreads(ctx, threadIDs, "to", "cc")
+		if err != nil {
+			return errors.Wrap(err, "getting threads")
+		}
+		for _, thread := range threads {
+			for _, msg := range thread.Messages {
+				if !contains(msg.LabelIDs, "SENT") || msg.Time.Before(startTime) {
+					continue
+				}
+				if msg.Time.After(latest) {
+					latest = msg.Time
+				}
+				for _, header := range msg.Headers {
+					if !strings.EqualFold(header.Name, "To") && !strings.EqualFold(header.Name, "Cc") {
+						continue
+					}
+					addrs, err := mail.ParseAddressList(header.Value)
+					if err != nil {
+						log.Printf("skipping unparseable %s header %s: %s", header.Name, header.Value, err)
+						continue
+					}
+					for _, addr := range addrs {
+						a := u.addrKey(addr.Address)
+						if msg.Time.After(last[a]) {
+							last[a] = msg.Time
+						}
+					}
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "scanning sent mail")
+	}
+
+	var (
+		self   = u.addrKey(u.Email)
+		result []correspondent
+	)
+	for addr, t := range last {
+		if t.Before(cutoff) || addr == self {
+			continue
+		}
+		result = append(result, correspondent{Addr: addr, Last: t})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if !result[i].Last.Equal(result[j].Last) {
+			return result[i].Last.After(result[j].Last)
+		}
+		return result[i].Addr < result[j].Addr
+	})
+	if len(result) > maxCorrespondents {
+		result = result[:maxCorrespondents]
+	}
+
+	snap.Correspondents = result
+	snap.CorrespondentsTime = latest
+	snap.CorrespondentsLookback = u.CorrespondentsLookback
+	return nil
+}
+
+// Clears the correspondents in snap.
+func (snap *contactSnapshot) forgetCorrespondents() {
+	snap.Correspondents = nil
+	snap.CorrespondentsTime = time.Time{}
+	snap.CorrespondentsLookback = 0
+}
+
+// Removes the correspondents from the user's stored contact snapshot
+// when the user turns off the correspondents tier,
+// rather than leaving them until the next update.
+func (s *Server) forgetCorrespondents(ctx context.Context, u *user) error {
+	snap, err := s.getContactSnapshot(ctx, u)
+	if err != nil {
+		return err
+	}
+	if len(snap.Correspondents) == 0 {
+		return nil
+	}
+	snap.forgetCorrespondents()
+	return s.putContactSnapshot(ctx, u.Email, snap)
+}
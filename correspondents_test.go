@@ -0,0 +1,125 @@
+package unclog
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/bobg/aesite"
+)
+
+func TestRefreshCorrespondents(t *testing.T) {
+	var (
+		ctx = context.Background()
+		mb  = NewMemMailbox()
+		now = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		day = 24 * time.Hour
+	)
+
+	mb.AddThread(&Thread{ID: "t1", Messages: []*Message{{
+		ID:       "m1",
+		Time:     now.Add(-2 * day),
+		LabelIDs: []string{"SENT"},
+		Headers: []Header{
+			{Name: "To", Value: "Alice <Alice@Example.com>, bob@example.com"},
+			{Name: "Cc", Value: "me@example.com"},
+		},
+	}, {
+		// Received, not sent.
+		ID:       "m2",
+		Time:     now.Add(-day),
+		LabelIDs: []string{"INBOX"},
+		Headers:  []Header{{Name: "To", Value: "me@example.com, stranger@example.com"}},
+	}}})
+	mb.AddThread(&Thread{ID: "t2", Messages: []*Message{{
+		// Too old.
+		ID:       "m3",
+		Time:     now.Add(-40 * day),
+		LabelIDs: []string{"SENT"},
+		Headers:  []Header{{Name: "To", Value: "carol@example.com"}},
+	}}})
+
+	u := &user{
+		User:                   aesite.User{Email: "me@example.com"},
+		CorrespondentsLookback: 30 * day,
+	}
+
+	snap := &contactSnapshot{}
+	if err := refreshCorrespondents(ctx, mb, u, snap, now); err != nil {
+		t.Fatal(err)
+	}
+	checkCorrespondents(t, snap.Correspondents, "alice@example.com", "bob@example.com")
+	if !snap.CorrespondentsTime.Equal(now.Add(-2 * day)) {
+		t.Errorf("got time %s, want %s", snap.CorrespondentsTime, now.Add(-2*day))
+	}
+
+	// An incremental refresh ten days later adds new correspondents
+	// and keeps old ones still within the lookback.
+	mb.AddThread(&Thread{ID: "t3", Messages: []*Message{{
+		ID:       "m4",
+		Time:     now.Add(9 * day),
+		LabelIDs: []string{"SENT"},
+		Headers:  []Header{{Name: "to", Value: "dave@example.com, bob@example.com"}},
+	}}})
+
+	later := now.Add(10 * day)
+	if err := refreshCorrespondents(ctx, mb, u, snap, later); err != nil {
+		t.Fatal(err)
+	}
+	checkCorrespondents(t, snap.Correspondents, "bob@example.com", "dave@example.com", "alice@example.com")
+	if !snap.CorrespondentsTime.Equal(now.Add(9 * day)) {
+		t.Errorf("got time %s, want %s", snap.CorrespondentsTime, now.Add(9*day))
+	}
+	for _, c := range snap.Correspondents {
+		if c.Addr == "bob@example.com" && !c.Last.Equal(now.Add(9*day)) {
+			t.Errorf("got last time %s for bob, want %s", c.Last, now.Add(9*day))
+		}
+	}
+
+	// Correspondents not written to within the lookback are dropped.
+	if err := refreshCorrespondents(ctx, mb, u, snap, now.Add(35*day)); err != nil {
+		t.Fatal(err)
+	}
+	checkCorrespondents(t, snap.Correspondents, "bob@example.com", "dave@example.com")
+
+	// A longer lookback starts the scan over.
+	u.CorrespondentsLookback = 60 * day
+	if err := refreshCorrespondents(ctx, mb, u, snap, now.Add(10*day)); err != nil {
+		t.Fatal(err)
+	}
+	checkCorrespondents(t, snap.Correspondents, "bob@example.com", "dave@example.com", "alice@example.com", "carol@example.com")
+
+	// With hashed contacts, correspondents are hashed too.
+	u.HashContacts = true
+	u.Secret = []byte("xyzzy")
+	hash := u.addrHasher()
+	snap = &contactSnapshot{}
+	if err := refreshCorrespondents(ctx, mb, u, snap, now); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, c := range snap.Correspondents {
+		got = append(got, c.Addr)
+	}
+	if want := []string{hash("alice@example.com"), hash("bob@example.com"), hash("carol@example.com"), hash("dave@example.com")}; !sameStrings(got, want) {
+		t.Errorf("got hashed correspondents %v, want %v", got, want)
+	}
+}
+
+func checkCorrespondents(t *testing.T, corrs []correspondent, want ...string) {
+	t.Helper()
+
+	var got []string
+	for _, c := range corrs {
+		got = append(got, c.Addr)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v (most recent first)", got, want)
+			break
+		}
+	}
+}
@@ -1,13 +1,12 @@
 package unclog
 
 import (
+	"context"
 	"log"
 	"net/http"
 	"time"
 
-	"cloud.google.com/go/datastore"
 	"github.com/pkg/errors"
-	"google.golang.org/api/iterator"
 )
 
 // GET/POST /t/cron
@@ -17,56 +16,111 @@ func (s *Server) handleCron(_ http.ResponseWriter, req *http.Request) error {
 		return err
 	}
 
+	ctx := req.Context()
+
 	// Part 1: renew any gmail watches that are close to expiration.
 
+	err = s.runCronJob(ctx, "renew", s.renewWatches)
+	if err != nil {
+		return err
+	}
+
+	// Part 2: queue catch-up updates for addresses with no update in the past 24 hours.
+	// Maybe pubsub notifications stopped arriving, which is a thing that happens sometimes.
+
+	return s.runCronJob(ctx, "catch-up", s.queueCatchups)
+}
+
+// Runs a cron job unless another one is already running
+// (e.g. from both /t/cron and RunScheduler, or from a slow previous run).
+func (s *Server) runCronJob(ctx context.Context, name string, job func(context.Context) error) error {
+	if !s.cronMu.TryLock() {
+		log.Printf("skipping %s job, another cron job is running", name)
+		return nil
+	}
+	defer s.cronMu.Unlock()
+
+	return job(ctx)
+}
+
+func (s *Server) renewWatches(ctx context.Context) error {
 	var (
-		ctx       = req.Context()
 		now       = time.Now()
 		yesterday = now.Add(-24 * time.Hour)
 		tomw      = now.Add(24 * time.Hour)
 	)
-	q := datastore.NewQuery("User").Filter("WatchExpiry >", yesterday).Filter("WatchExpiry <", tomw)
-	it := s.dsClient.Run(ctx, q)
-	for {
-		var u user
-		_, err := it.Next(&u)
-		if errors.Is(err, iterator.Done) {
-			break
+	err := s.store.forUsersWatchExpiring(ctx, yesterday, tomw, func(u *user) error {
+		if u.Token == "" {
+			return nil
 		}
-		if err != nil {
-			return errors.Wrap(err, "iterating over users for renew")
-		}
-
-		err = s.watch(ctx, &u)
+		err := s.watch(ctx, u)
 		if err != nil {
 			log.Printf("renewing gmail watch for %s: %s", u.Email, err)
 		} else {
 			log.Printf("renewed gmail watch for %s, new expiry %s", u.Email, u.WatchExpiry)
 		}
-	}
-
-	// Part 2: queue catch-up updates for addresses with no update in the past 24 hours.
-	// Maybe pubsub notifications stopped arriving, which is a thing that happens sometimes.
+		return nil
+	})
+	return errors.Wrap(err, "renewing watches")
+}
 
-	q = datastore.NewQuery("User").Filter("LastUpdate <", yesterday)
-	it = s.dsClient.Run(ctx, q)
-	for {
-		var u user
-		_, err := it.Next(&u)
-		if errors.Is(err, iterator.Done) {
-			break
+func (s *Server) queueCatchups(ctx context.Context) error {
+	yesterday := time.Now().Add(-24 * time.Hour)
+	err := s.store.forUsersUpdatedBefore(ctx, yesterday, func(u *user) error {
+		if u.Token == "" {
+			return nil
 		}
-		if err != nil {
-			return errors.Wrap(err, "iterating over users for update")
-		}
-
-		err = s.queueUpdate(ctx, u.Email, "", true)
+		err := s.queueUpdate(ctx, u.Email, "", true)
 		if err != nil {
 			log.Printf("queueing catch-up update for %s: %s", u.Email, err)
 		} else {
 			log.Printf("queued catch-up update for %s", u.Email)
 		}
+		return nil
+	})
+	return errors.Wrap(err, "queueing catch-up updates")
+}
+
+// RunScheduler runs the jobs of the /t/cron handler in-process,
+// for servers running without App Engine cron.
+// Watches are renewed every renewInterval
+// and catch-up updates queued every catchupInterval.
+// Both jobs run once at startup.
+//
+// Jobs never overlap:
+// a job that comes due while another is running is skipped until its next interval.
+//
+// RunScheduler returns when ctx is canceled,
+// after any running job has finished.
+func (s *Server) RunScheduler(ctx context.Context, renewInterval, catchupInterval time.Duration) error {
+	if renewInterval <= 0 || catchupInterval <= 0 {
+		return errors.New("scheduler intervals must be positive")
 	}
 
-	return nil
+	renewTicker := time.NewTicker(renewInterval)
+	defer renewTicker.Stop()
+
+	catchupTicker := time.NewTicker(catchupInterval)
+	defer catchupTicker.Stop()
+
+	run := func(name string, job func(context.Context) error) {
+		err := s.runCronJob(ctx, name, job)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("ERROR in scheduled %s job: %s", name, err)
+		}
+	}
+
+	run("renew", s.renewWatches)
+	run("catch-up", s.queueCatchups)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-renewTicker.C:
+			run("renew", s.renewWatches)
+		case <-catchupTicker.C:
+			run("catch-up", s.queueCatchups)
+		}
+	}
 }
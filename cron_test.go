@@ -0,0 +1,79 @@
+package unclog
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRunScheduler(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	tasks, err := NewLocalTaskQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	for _, email := range []string{"stale@example.com", "fresh@example.com"} {
+		var u user
+		err = bs.newUser(ctx, email, &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.Token = "{}"                          // connected; see Server.queueUpdate
+		u.WatchExpiry = now.Add(72 * time.Hour) // not due for renewal
+		if email == "fresh@example.com" {
+			u.LastUpdate = now
+		}
+		err = bs.putUser(ctx, &u)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newServer(bs, tasks, "")
+
+	// Hold the cron lock, as if /t/cron were running, so the startup jobs are skipped.
+	s.cronMu.Lock()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.RunScheduler(ctx, time.Hour, 50*time.Millisecond)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	if n := tasks.Pending(); n != 0 {
+		t.Errorf("got %d pending tasks while cron lock held, want 0", n)
+	}
+	s.cronMu.Unlock()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for tasks.Pending() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for catch-up task")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := tasks.Pending(); n != 1 {
+		t.Errorf("got %d pending tasks, want 1", n)
+	}
+
+	cancel()
+	select {
+	case err := <-errCh:
+		if err != nil {
+			t.Errorf("got error %v from RunScheduler", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("RunScheduler did not return after cancel")
+	}
+}
@@ -0,0 +1,196 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/bobg/mid"
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// revokeURL is Google's OAuth token revocation endpoint.
+var revokeURL = "https://oauth2.googleapis.com/revoke"
+
+// POST /s/delete
+//
+// Deletes the session user's account (see Server.DeleteUser).
+// If the "labels" value is true,
+// Unclog's labels are removed from the mailbox too.
+func (s *Server) handleDelete(w http.ResponseWriter, req *http.Request) error {
+	if !strings.EqualFold(req.Method, "POST") {
+		return mid.CodeErr{C: http.StatusMethodNotAllowed}
+	}
+
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var removeLabels bool
+	if val := req.FormValue("labels"); val != "" {
+		removeLabels, err = strconv.ParseBool(val)
+		if err != nil {
+			return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "parsing labels value")}
+		}
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	err = s.DeleteUser(ctx, u.Email, removeLabels)
+	if err != nil {
+		return errors.Wrapf(err, "deleting user %s", u.Email)
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// DeleteUser removes all trace of a user from Unclog.
+// It stops the user's Gmail watch,
+// revokes the user's OAuth token,
+// cancels any pending tasks,
+// and deletes the user's record, sessions, and contact snapshot.
+//
+// If removeLabels is true,
+// Unclog's labels must first be removed from the user's mailbox,
+// which can take longer than a request may.
+// So instead DeleteUser stops the watch
+// and starts a cleanup job (see cleanupJob) that deletes the labels
+// and then the user
+// (see Server.finishCleanup).
+//
+// Failures to stop the watch, revoke the token, or cancel tasks are logged
+// but do not prevent the deletion,
+// since the token may already be dead
+// and leftover tasks and notifications for a deleted user do nothing.
+func (s *Server) DeleteUser(ctx context.Context, email string, removeLabels bool) error {
+	var u user
+	err := s.store.lookupUser(ctx, email, &u)
+	if err != nil {
+		return errors.Wrapf(err, "looking up user %s", email)
+	}
+
+	if removeLabels {
+		if u.Token == "" {
+			return mid.CodeErr{C: http.StatusBadRequest, Err: fmt.Errorf("cannot remove labels for %s, who has no token", u.Email)}
+		}
+		if s.tasks == nil {
+			return fmt.Errorf("cannot remove labels for %s without a task queue", u.Email)
+		}
+		if !u.WatchExpiry.IsZero() {
+			if err := s.stop(ctx, &u); err != nil {
+				log.Printf("stopping gmail watch for %s: %s", u.Email, err)
+			}
+		}
+		err = s.startCleanup(ctx, u.Email, true, true)
+		if err != nil {
+			return errors.Wrap(err, "starting label removal")
+		}
+		log.Printf("removing labels for %s, who will then be deleted", u.Email)
+		return nil
+	}
+
+	if u.Token != "" {
+		if !u.WatchExpiry.IsZero() {
+			if err := s.stop(ctx, &u); err != nil {
+				log.Printf("stopping gmail watch for %s: %s", u.Email, err)
+			}
+		}
+		if err := s.revokeToken(ctx, &u); err != nil {
+			log.Printf("revoking token for %s: %s", u.Email, err)
+		}
+	}
+
+	if s.tasks != nil {
+		n, err := s.tasks.Cancel(ctx, isTaskFor(u.Email))
+		if err != nil {
+			log.Printf("canceling tasks for %s: %s", u.Email, err)
+		} else if n > 0 {
+			log.Printf("canceled %d task(s) for %s", n, u.Email)
+		}
+	}
+
+	err = s.store.deleteUser(ctx, u.Email)
+	if err != nil {
+		return errors.Wrapf(err, "deleting user %s", u.Email)
+	}
+	log.Printf("deleted user %s", u.Email)
+	return nil
+}
+
+// Removes the user's labels from the mailbox,
+// once a cleanup job has stripped them from all threads (see Server.doCleanup).
+// Labels that Unclog created (see user.CreatedLabels) are deleted.
+// Others, which may have been the user's own before Unclog adopted them,
+// are left in place.
+// Either way, u no longer records them.
+// The caller is responsible for storing u, if it is to be kept.
+func (s *Server) deleteLabels(ctx context.Context, mp MailProvider, u *user) error {
+	for _, ml := range u.ownedLabels() {
+		if contains(u.CreatedLabels, *ml.id) {
+			if err := mp.DeleteLabel(ctx, *ml.id); err != nil {
+				return errors.Wrapf(err, "deleting %s label", ml.name)
+			}
+		}
+		*ml.id = ""
+	}
+	u.CreatedLabels = nil
+	return nil
+}
+
+// Revokes the user's OAuth grant at Google,
+// which invalidates both the refresh token and any access tokens.
+func (s *Server) revokeToken(ctx context.Context, u *user) error {
+	token, err := s.decodeToken(ctx, u.Email, u.Token)
+	if err != nil {
+		return errors.Wrap(err, "decoding token")
+	}
+	tok := token.RefreshToken
+	if tok == "" {
+		tok = token.AccessToken
+	}
+
+	return retry(ctx, func() error {
+		req, err := http.NewRequestWithContext(ctx, "POST", revokeURL, strings.NewReader(url.Values{"token": {tok}}.Encode()))
+		if err != nil {
+			return errors.Wrap(err, "creating revocation request")
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusBadRequest:
+			// The token is already invalid (e.g. revoked by the user).
+			return nil
+		}
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &googleapi.Error{Code: resp.StatusCode, Body: string(body), Header: resp.Header}
+	})
+}
@@ -0,0 +1,220 @@
+package unclog
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"golang.org/x/oauth2"
+)
+
+func TestDeleteUser(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	tasks, err := NewLocalTaskQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var revoked []string
+	revokeSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		revoked = append(revoked, req.FormValue("token"))
+	}))
+	defer revokeSrv.Close()
+	defer func(u string) { revokeURL = u }(revokeURL)
+	revokeURL = revokeSrv.URL
+
+	s := newServer(bs, tasks, "")
+
+	sessions := make(map[string]int64)
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		token, err := s.encodeToken(ctx, email, &oauth2.Token{AccessToken: "a-" + email, RefreshToken: "r-" + email})
+		if err != nil {
+			t.Fatal(err)
+		}
+		u := user{Token: token}
+		if err := bs.newUser(ctx, email, &u); err != nil {
+			t.Fatal(err)
+		}
+		if err := bs.putContacts(ctx, email, []byte("contacts")); err != nil {
+			t.Fatal(err)
+		}
+		sess, err := bs.NewSession(ctx, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sess.UserKey = u.Key()
+		if err := bs.PutSession(ctx, sess); err != nil {
+			t.Fatal(err)
+		}
+		sessions[email] = sess.ID
+		if err := tasks.Enqueue(ctx, email, s.taskURL(email, "", false), time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.DeleteUser(ctx, "Alice@Example.com", false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(revoked) != 1 || revoked[0] != "r-alice@example.com" {
+		t.Errorf("got revoked tokens %v, want [r-alice@example.com]", revoked)
+	}
+	if n := tasks.Pending(); n != 1 {
+		t.Errorf("got %d pending task(s), want 1 (bob's)", n)
+	}
+
+	check := func(email string, wantGone bool) {
+		t.Helper()
+		var u user
+		err := bs.lookupUser(ctx, email, &u)
+		if gone := errors.Is(err, ErrNotFound); gone != wantGone {
+			t.Errorf("%s: got user lookup error %v", email, err)
+		}
+		_, err = bs.getContacts(ctx, email)
+		if gone := errors.Is(err, ErrNotFound); gone != wantGone {
+			t.Errorf("%s: got contacts lookup error %v", email, err)
+		}
+		_, err = bs.GetSessionByKey(ctx, datastore.IDKey("Session", sessions[email], nil))
+		if gone := errors.Is(err, ErrNotFound); gone != wantGone {
+			t.Errorf("%s: got session lookup error %v", email, err)
+		}
+	}
+	check("alice@example.com", true)
+	check("bob@example.com", false)
+
+	// An update task that runs anyway does nothing.
+	if err := s.doUpdate(ctx, "alice@example.com", "", false); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteLabels(t *testing.T) {
+	ctx := context.Background()
+
+	mb := NewMemMailbox()
+
+	// The user's own Friends label, adopted by Unclog for a contact group.
+	friends, err := mb.CreateLabel(ctx, "Friends")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &user{GroupLabels: []groupLabel{
+		{GroupID: "family", Name: "✔/Family"},
+		{GroupID: "friends", Name: "Friends"},
+	}}
+	if err := (&Server{}).ensureLabels(ctx, mb, u); err != nil {
+		t.Fatal(err)
+	}
+	if u.GroupLabels[1].LabelID != friends.ID {
+		t.Fatalf("got Friends label ID %s, want %s", u.GroupLabels[1].LabelID, friends.ID)
+	}
+	other, err := mb.CreateLabel(ctx, "Other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mb.AddThread(&Thread{ID: "t1", Messages: []*Message{{ID: "m1", LabelIDs: []string{"INBOX", u.ContactsLabelID, other.ID}}}})
+	mb.AddThread(&Thread{ID: "t2", Messages: []*Message{{ID: "m2", LabelIDs: []string{u.StarredLabelID, u.GroupLabels[0].LabelID}}}})
+	mb.AddThread(&Thread{ID: "t3", Messages: []*Message{{ID: "m3", LabelIDs: []string{friends.ID}}}})
+
+	// As in a cleanup job, the labels are stripped first.
+	if _, more, err := stripLabels(ctx, mb, u.ownedLabels(), cleanupChunk); err != nil || more {
+		t.Fatalf("got more=%v, error %v from stripping labels", more, err)
+	}
+	if err := (&Server{}).deleteLabels(ctx, mb, u); err != nil {
+		t.Fatal(err)
+	}
+
+	labels, err := mb.Labels(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, label := range labels {
+		names = append(names, label.Name)
+	}
+	if !sameStrings(names, []string{"Friends", "Other"}) {
+		t.Errorf("got labels %v, want only Friends and Other", names)
+	}
+	if got := mb.Thread("t1").Messages[0].LabelIDs; !sameStrings(got, []string{"INBOX", other.ID}) {
+		t.Errorf("got t1 labels %v, want [INBOX %s]", got, other.ID)
+	}
+	if got := mb.Thread("t2").Messages[0].LabelIDs; len(got) != 0 {
+		t.Errorf("got t2 labels %v, want none", got)
+	}
+	if got := mb.Thread("t3").Messages[0].LabelIDs; len(got) != 0 {
+		t.Errorf("got t3 labels %v, want none", got)
+	}
+	if u.ContactsLabelID != "" || u.StarredLabelID != "" || u.GroupLabels[0].LabelID != "" || u.GroupLabels[1].LabelID != "" {
+		t.Errorf("label IDs not cleared: %+v", u)
+	}
+}
+
+func TestDeleteUserRemovingLabels(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	tasks, err := NewLocalTaskQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(bs, tasks, "")
+
+	const email = "alice@example.com"
+	u := user{Token: "{}", ContactsLabelID: "c", StarredLabelID: "s"}
+	if err := bs.newUser(ctx, email, &u); err != nil {
+		t.Fatal(err)
+	}
+	if err := tasks.Enqueue(ctx, "update", s.taskURL(email, "", false), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The labels are removed by a cleanup job, in place of the pending update.
+	if err := s.DeleteUser(ctx, email, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.lookupUser(ctx, email, &u); err != nil {
+		t.Fatal(err)
+	}
+	if !u.Cleanup.running() || !u.Cleanup.DeleteLabels || !u.Cleanup.DeleteUser {
+		t.Fatalf("got cleanup job %+v", u.Cleanup)
+	}
+	if n := tasks.Pending(); n != 1 {
+		t.Errorf("got %d pending task(s), want 1", n)
+	}
+
+	// Neither re-enabling nor disabling with cleanup stops the job.
+	if err := s.resumeFromCleanup(ctx, &u); err == nil {
+		t.Error("re-enabling stopped the deletion")
+	}
+	if err := s.startCleanup(ctx, email, false, false); err == nil {
+		t.Error("a new cleanup job replaced the deletion")
+	}
+
+	// When the job finishes, the user is deleted.
+	if err := s.finishCleanup(ctx, email, u.Cleanup.Started, func(*user) {}); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.lookupUser(ctx, email, &u); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got user lookup error %v after the job, want ErrNotFound", err)
+	}
+	if n := tasks.Pending(); n != 0 {
+		t.Errorf("got %d pending task(s) after deletion, want 0", n)
+	}
+}
@@ -0,0 +1,57 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// Tells whether err means the user's OAuth grant is no longer any good,
+// as when the user has revoked Unclog's access
+// or the refresh token has expired,
+// so that retrying is pointless until the user authorizes Unclog again.
+// If so, the result describes why;
+// otherwise it is "".
+func revocation(err error) string {
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		if rerr.ErrorCode == "invalid_grant" {
+			return "access was revoked or has expired (invalid_grant)"
+		}
+		if rerr.Response != nil && rerr.Response.StatusCode == http.StatusUnauthorized {
+			return fmt.Sprintf("token refresh was refused (%s)", rerr.ErrorCode)
+		}
+		return ""
+	}
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) && gerr.Code == http.StatusUnauthorized {
+		return "Google rejected the credentials (401)"
+	}
+	return ""
+}
+
+// Puts the user into the "expired" state
+// after revocation has found their OAuth grant to be dead:
+// the token is discarded, the watch is forgotten
+// (so no more update tasks are queued; see Server.queueUpdate),
+// and the reason is recorded for the user to see (see homedata).
+// The user leaves this state by authorizing Unclog again.
+func (s *Server) expireUser(ctx context.Context, email, reason string) error {
+	log.Printf("expiring OAuth grant for %s: %s", email, reason)
+
+	var u user
+	err := s.store.updateUser(ctx, email, &u, func() error {
+		u.Token = ""
+		u.WatchExpiry = time.Time{}
+		u.ExpiredReason = reason
+		u.ExpiredTime = time.Now()
+		return nil
+	})
+	return errors.Wrapf(err, "expiring user %s", email)
+}
@@ -0,0 +1,113 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+func TestRevocation(t *testing.T) {
+	cases := []struct {
+		name    string
+		err     error
+		revoked bool
+	}{
+		{"invalid_grant", &oauth2.RetrieveError{ErrorCode: "invalid_grant"}, true},
+		{"wrapped invalid_grant", errors.Wrap(&url.Error{Op: "Get", Err: &oauth2.RetrieveError{ErrorCode: "invalid_grant"}}, "listing threads"), true},
+		{"refresh 401", &oauth2.RetrieveError{Response: &http.Response{StatusCode: 401}, ErrorCode: "unauthorized_client"}, true},
+		{"refresh 500", &oauth2.RetrieveError{Response: &http.Response{StatusCode: 500}}, false},
+		{"api 401", &googleapi.Error{Code: 401}, true},
+		{"api 403", &googleapi.Error{Code: 403}, false},
+		{"other", errors.New("other"), false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := revocation(c.err) != ""; got != c.revoked {
+				t.Errorf("got %v, want %v", got, c.revoked)
+			}
+		})
+	}
+}
+
+func TestExpireOnRevokedGrant(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	tasks, err := NewLocalTaskQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The token endpoint refuses to refresh.
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprint(w, `{"error": "invalid_grant", "error_description": "Token has been expired or revoked."}`)
+	}))
+	defer tokenSrv.Close()
+
+	s := newServer(bs, tasks, "")
+	s.oauthConf = &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: tokenSrv.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+
+	const email = "alice@example.com"
+	token, err := s.encodeToken(ctx, email, &oauth2.Token{AccessToken: "a0", RefreshToken: "r0", Expiry: time.Now().Add(-time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := user{Token: token, WatchExpiry: time.Now().Add(72 * time.Hour)}
+	if err := bs.newUser(ctx, email, &u); err != nil {
+		t.Fatal(err)
+	}
+
+	// The update does not fail (which would make the task queue retry it),
+	// but expires the user.
+	if err := s.doUpdate(ctx, email, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.lookupUser(ctx, email, &u); err != nil {
+		t.Fatal(err)
+	}
+	if u.Token != "" {
+		t.Error("token not cleared")
+	}
+	if !u.WatchExpiry.IsZero() {
+		t.Errorf("got watch expiry %s, want none", u.WatchExpiry)
+	}
+	if u.ExpiredReason == "" || u.ExpiredTime.IsZero() {
+		t.Errorf("got expired reason %q at %s, want both", u.ExpiredReason, u.ExpiredTime)
+	}
+
+	// No more updates are queued for the user.
+	if err := s.queueUpdate(ctx, email, "", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.queueCatchups(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := tasks.Pending(); n != 0 {
+		t.Errorf("got %d pending task(s), want 0", n)
+	}
+
+	// An update that runs anyway does nothing.
+	if err := s.doUpdate(ctx, email, "", false); err != nil {
+		t.Fatal(err)
+	}
+}
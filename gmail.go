@@ -0,0 +1,236 @@
+package unclog
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// GmailProvider is a MailProvider backed by the Gmail API.
+type GmailProvider struct {
+	svc *gmail.Service
+
+	// client is for requests the Gmail service can't make, namely batch requests.
+	client   *http.Client
+	batchURL string // for testing; default gmailBatchURL
+}
+
+var _ MailProvider = &GmailProvider{}
+
+// NewGmailProvider produces a new GmailProvider using the given Gmail service.
+// The HTTP client, which should be the authorized client used by the service,
+// is for batch requests.
+// If it is nil, GetThreads fetches threads one at a time.
+func NewGmailProvider(svc *gmail.Service, client *http.Client) *GmailProvider {
+	return &GmailProvider{svc: svc, client: client}
+}
+
+// ListThreads implements MailProvider.ListThreads.
+func (g *GmailProvider) ListThreads(ctx context.Context, q string, f func(threadIDs []string) error) error {
+	call := g.svc.Users.Threads.List("me").Q(q).Context(ctx)
+	fetch := pageFetcher(call, func(resp *gmail.ListThreadsResponse) string { return resp.NextPageToken })
+	return retryPages(ctx, fetch, func(resp *gmail.ListThreadsResponse) error {
+		threadIDs := make([]string, 0, len(resp.Threads))
+		for _, thread := range resp.Threads {
+			threadIDs = append(threadIDs, thread.Id)
+		}
+		return f(threadIDs)
+	})
+}
+
+// LabelThreads implements MailProvider.LabelThreads.
+func (g *GmailProvider) LabelThreads(ctx context.Context, labelID string, f func(threadIDs []string) error) error {
+	call := g.svc.Users.Threads.List("me").LabelIds(labelID).Context(ctx)
+	fetch := pageFetcher(call, func(resp *gmail.ListThreadsResponse) string { return resp.NextPageToken })
+	return retryPages(ctx, fetch, func(resp *gmail.ListThreadsResponse) error {
+		threadIDs := make([]string, 0, len(resp.Threads))
+		for _, thread := range resp.Threads {
+			threadIDs = append(threadIDs, thread.Id)
+		}
+		return f(threadIDs)
+	})
+}
+
+// History implements MailProvider.History.
+func (g *GmailProvider) History(ctx context.Context, startHistoryID uint64, labelID string, f func(threadIDs []string) error) (uint64, error) {
+	var (
+		latest = startHistoryID
+		seen   = make(map[string]bool)
+	)
+	call := g.svc.Users.History.List("me").StartHistoryId(startHistoryID).HistoryTypes("messageAdded").Context(ctx)
+	if labelID != "" {
+		call = call.LabelId(labelID)
+	}
+	fetch := pageFetcher(call, func(resp *gmail.ListHistoryResponse) string { return resp.NextPageToken })
+	err := retryPages(ctx, fetch, func(resp *gmail.ListHistoryResponse) error {
+		if resp.HistoryId > latest {
+			latest = resp.HistoryId
+		}
+		var threadIDs []string
+		for _, h := range resp.History {
+			for _, added := range h.MessagesAdded {
+				if added.Message == nil || seen[added.Message.ThreadId] {
+					continue
+				}
+				seen[added.Message.ThreadId] = true
+				threadIDs = append(threadIDs, added.Message.ThreadId)
+			}
+		}
+		if len(threadIDs) == 0 {
+			return nil
+		}
+		return f(threadIDs)
+	})
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return 0, ErrHistoryExpired
+	}
+	return latest, err
+}
+
+// CurrentHistoryID implements MailProvider.CurrentHistoryID.
+func (g *GmailProvider) CurrentHistoryID(ctx context.Context) (uint64, error) {
+	var prof *gmail.Profile
+	err := retry(ctx, func() (err error) {
+		prof, err = g.svc.Users.GetProfile("me").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "getting profile")
+	}
+	return prof.HistoryId, nil
+}
+
+// GetThread implements MailProvider.GetThread.
+func (g *GmailProvider) GetThread(ctx context.Context, threadID string, headers ...string) (*Thread, error) {
+	var thread *gmail.Thread
+	err := retry(ctx, func() (err error) {
+		thread, err = g.svc.Users.Threads.Get("me", threadID).Format("metadata").MetadataHeaders(headers...).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return threadFromGmail(thread), nil
+}
+
+func threadFromGmail(thread *gmail.Thread) *Thread {
+	result := &Thread{ID: thread.Id}
+	for _, msg := range thread.Messages {
+		m := &Message{
+			ID:       msg.Id,
+			Time:     timeFromMillis(msg.InternalDate),
+			LabelIDs: msg.LabelIds,
+		}
+		if msg.Payload != nil {
+			for _, h := range msg.Payload.Headers {
+				m.Headers = append(m.Headers, Header{Name: h.Name, Value: h.Value})
+			}
+		}
+		result.Messages = append(result.Messages, m)
+	}
+	return result
+}
+
+// ModifyThread implements MailProvider.ModifyThread.
+func (g *GmailProvider) ModifyThread(ctx context.Context, threadID string, add, remove []string) error {
+	req := &gmail.ModifyThreadRequest{
+		AddLabelIds:    add,
+		RemoveLabelIds: remove,
+	}
+	err := retry(ctx, func() error {
+		_, err := g.svc.Users.Threads.Modify("me", threadID, req).Context(ctx).Do()
+		return err
+	})
+	if googleapi.IsNotModified(err) {
+		return nil
+	}
+	return err
+}
+
+// BatchModify implements MailProvider.BatchModify.
+func (g *GmailProvider) BatchModify(ctx context.Context, messageIDs, add, remove []string) error {
+	req := &gmail.BatchModifyMessagesRequest{
+		Ids:            messageIDs,
+		AddLabelIds:    add,
+		RemoveLabelIds: remove,
+	}
+	return retry(ctx, func() error {
+		return g.svc.Users.Messages.BatchModify("me", req).Context(ctx).Do()
+	})
+}
+
+// Labels implements MailProvider.Labels.
+func (g *GmailProvider) Labels(ctx context.Context) ([]*Label, error) {
+	var resp *gmail.ListLabelsResponse
+	err := retry(ctx, func() (err error) {
+		resp, err = g.svc.Users.Labels.List("me").Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []*Label
+	for _, label := range resp.Labels {
+		result = append(result, &Label{ID: label.Id, Name: label.Name})
+	}
+	return result, nil
+}
+
+// CreateLabel implements MailProvider.CreateLabel.
+func (g *GmailProvider) CreateLabel(ctx context.Context, name string) (*Label, error) {
+	label := &gmail.Label{
+		LabelListVisibility:   "labelShow",
+		MessageListVisibility: "show",
+		Name:                  name,
+		Type:                  "user",
+	}
+	// If a failed attempt did create the label, a retry gets a conflict.
+	var created *gmail.Label
+	err := retry(ctx, func() (err error) {
+		created, err = g.svc.Users.Labels.Create("me", label).Context(ctx).Do()
+		return err
+	})
+	if isLabelConflict(err) {
+		return nil, ErrLabelExists
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "creating label %s", name)
+	}
+	return &Label{ID: created.Id, Name: created.Name}, nil
+}
+
+// RenameLabel implements MailProvider.RenameLabel.
+func (g *GmailProvider) RenameLabel(ctx context.Context, labelID, name string) error {
+	err := retry(ctx, func() error {
+		_, err := g.svc.Users.Labels.Patch("me", labelID, &gmail.Label{Name: name}).Context(ctx).Do()
+		return err
+	})
+	if isLabelConflict(err) {
+		return ErrLabelExists
+	}
+	return errors.Wrapf(err, "renaming label %s to %s", labelID, name)
+}
+
+// DeleteLabel implements MailProvider.DeleteLabel.
+func (g *GmailProvider) DeleteLabel(ctx context.Context, labelID string) error {
+	err := retry(ctx, func() error {
+		return g.svc.Users.Labels.Delete("me", labelID).Context(ctx).Do()
+	})
+	if gerr, ok := err.(*googleapi.Error); ok && gerr.Code == http.StatusNotFound {
+		return nil
+	}
+	return errors.Wrapf(err, "deleting label %s", labelID)
+}
+
+func isLabelConflict(err error) bool {
+	if gerr, ok := err.(*googleapi.Error); ok {
+		switch gerr.Code {
+		case http.StatusConflict, http.StatusNotModified:
+			return true
+		}
+	}
+	return false
+}
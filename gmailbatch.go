@@ -0,0 +1,189 @@
+package unclog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+const (
+	// gmailBatchURL is the Gmail API's batch endpoint.
+	// See https://developers.google.com/gmail/api/guides/batch.
+	gmailBatchURL = "https://gmail.googleapis.com/batch/gmail/v1"
+
+	// maxBatchGet is the most requests the Gmail API allows in one batch.
+	maxBatchGet = 100
+)
+
+// GetThreads implements MailProvider.GetThreads.
+// If g has an HTTP client,
+// the threads are fetched through the Gmail batch endpoint,
+// up to maxBatchGet per request.
+// Threads that the batch fails to produce are then fetched one at a time.
+func (g *GmailProvider) GetThreads(ctx context.Context, threadIDs []string, headers ...string) ([]*Thread, error) {
+	return getMissingThreads(ctx, g, threadIDs, g.batchThreads(ctx, threadIDs, headers...), headers...)
+}
+
+// batchThreadGetter is implemented by a MailProvider
+// whose GetThreads fetches threads in batches
+// and then fetches one at a time those that the batches failed to produce.
+// Its batchThreads method does only the first part,
+// leaving nil the elements of the result for the threads it could not get,
+// so that a wrapper (such as limitedProvider) can get the rest through its own GetThread.
+type batchThreadGetter interface {
+	batchThreads(ctx context.Context, threadIDs []string, headers ...string) []*Thread
+}
+
+var _ batchThreadGetter = &GmailProvider{}
+
+// Fetches the given threads through the Gmail batch endpoint,
+// if g has an HTTP client (see GmailProvider.GetThreads).
+// Elements of the result for threads that could not be fetched are nil.
+func (g *GmailProvider) batchThreads(ctx context.Context, threadIDs []string, headers ...string) []*Thread {
+	result := make([]*Thread, len(threadIDs))
+
+	if g.client != nil && len(threadIDs) > 1 {
+		for start := 0; start < len(threadIDs); start += maxBatchGet {
+			end := start + maxBatchGet
+			if end > len(threadIDs) {
+				end = len(threadIDs)
+			}
+			err := g.batchGetThreads(ctx, threadIDs[start:end], headers, result[start:end])
+			if err != nil {
+				log.Printf("batch-getting %d thread(s), falling back to single gets: %s", end-start, err)
+			}
+		}
+	}
+
+	return result
+}
+
+// Fills in the nil elements of result,
+// which correspond to the elements of threadIDs,
+// by calling mp.GetThread.
+func getMissingThreads(ctx context.Context, mp MailProvider, threadIDs []string, result []*Thread, headers ...string) ([]*Thread, error) {
+	for i, threadID := range threadIDs {
+		if result[i] != nil {
+			continue
+		}
+		thread, err := mp.GetThread(ctx, threadID, headers...)
+		if err != nil {
+			return nil, errors.Wrapf(err, "getting thread %s", threadID)
+		}
+		result[i] = thread
+	}
+	return result, nil
+}
+
+// Fetches the given threads in a single batch request,
+// placing them in the corresponding elements of result.
+// Elements whose parts of the batch fail are left nil.
+func (g *GmailProvider) batchGetThreads(ctx context.Context, threadIDs, headers []string, result []*Thread) error {
+	var (
+		body bytes.Buffer
+		w    = multipart.NewWriter(&body)
+	)
+	query := url.Values{"format": {"metadata"}, "metadataHeaders": headers}.Encode()
+	for i, threadID := range threadIDs {
+		pw, err := w.CreatePart(textproto.MIMEHeader{
+			"Content-Type": {"application/http"},
+			"Content-Id":   {fmt.Sprintf("<item%d>", i)},
+		})
+		if err != nil {
+			return errors.Wrap(err, "creating batch part")
+		}
+		fmt.Fprintf(pw, "GET /gmail/v1/users/me/threads/%s?%s HTTP/1.1\r\n\r\n", url.PathEscape(threadID), query)
+	}
+	if err := w.Close(); err != nil {
+		return errors.Wrap(err, "finishing batch request")
+	}
+
+	batchURL := g.batchURL
+	if batchURL == "" {
+		batchURL = gmailBatchURL
+	}
+	var (
+		req  *http.Request
+		resp *http.Response
+	)
+	err := retry(ctx, func() (err error) {
+		req, err = http.NewRequestWithContext(ctx, "POST", batchURL, bytes.NewReader(body.Bytes()))
+		if err != nil {
+			return errors.Wrap(err, "creating batch request")
+		}
+		req.Header.Set("Content-Type", "multipart/mixed; boundary="+w.Boundary())
+
+		resp, err = g.client.Do(req)
+		if err != nil {
+			return err
+		}
+		if err = googleapi.CheckResponse(resp); err != nil {
+			resp.Body.Close()
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "sending batch request")
+	}
+	defer resp.Body.Close()
+
+	mediaType, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return errors.Wrap(err, "parsing batch response content type")
+	}
+	if !strings.HasPrefix(mediaType, "multipart/") {
+		return fmt.Errorf("unexpected batch response content type %s", mediaType)
+	}
+
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "reading batch response")
+		}
+
+		// The Content-ID of a response part is that of its request part,
+		// with "response-" prepended.
+		cid := strings.Trim(part.Header.Get("Content-Id"), "<>")
+		i, err := strconv.Atoi(strings.TrimPrefix(cid, "response-item"))
+		if err != nil || i < 0 || i >= len(threadIDs) {
+			log.Printf("skipping batch response part with unexpected Content-ID %s", cid)
+			continue
+		}
+
+		partResp, err := http.ReadResponse(bufio.NewReader(part), req)
+		if err != nil {
+			return errors.Wrapf(err, "reading batch response for thread %s", threadIDs[i])
+		}
+		if partResp.StatusCode != http.StatusOK {
+			partResp.Body.Close()
+			continue // to be retried on its own
+		}
+		var thread gmail.Thread
+		err = json.NewDecoder(partResp.Body).Decode(&thread)
+		partResp.Body.Close()
+		if err != nil {
+			return errors.Wrapf(err, "decoding batch response for thread %s", threadIDs[i])
+		}
+		result[i] = threadFromGmail(&thread)
+	}
+}
@@ -0,0 +1,181 @@
+package unclog
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+func TestGmailGetThreads(t *testing.T) {
+	const nthreads = 250
+
+	var (
+		mu        sync.Mutex
+		batches   []int // number of parts in each batch request
+		singleIDs []string
+	)
+
+	gmailThread := func(id string) *gmail.Thread {
+		return &gmail.Thread{
+			Id: id,
+			Messages: []*gmail.Message{{
+				Id:           id + "-m",
+				InternalDate: 1000,
+				Payload: &gmail.MessagePart{
+					Headers: []*gmail.MessagePartHeader{{Name: "From", Value: id + "@example.com"}},
+				},
+			}},
+		}
+	}
+
+	// Every tenth thread fails in the batch and must be fetched on its own.
+	failInBatch := func(id string) bool {
+		return strings.HasSuffix(id, "0")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/batch/gmail/v1", func(w http.ResponseWriter, req *http.Request) {
+		_, params, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+		if err != nil {
+			t.Error(err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var (
+			out bytes.Buffer
+			mw  = multipart.NewWriter(&out)
+			mr  = multipart.NewReader(req.Body, params["boundary"])
+			n   int
+		)
+		for {
+			part, err := mr.NextPart()
+			if err != nil {
+				break
+			}
+			n++
+			inner, err := http.ReadRequest(bufio.NewReader(part))
+			if err != nil {
+				t.Error(err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if got := inner.URL.Query().Get("format"); got != "metadata" {
+				t.Errorf("got format %q, want metadata", got)
+			}
+			id := strings.TrimPrefix(inner.URL.Path, "/gmail/v1/users/me/threads/")
+
+			pw, _ := mw.CreatePart(textproto.MIMEHeader{
+				"Content-Type": {"application/http"},
+				"Content-Id":   {"<response-" + strings.Trim(part.Header.Get("Content-Id"), "<>") + ">"},
+			})
+			if failInBatch(id) {
+				fmt.Fprint(pw, "HTTP/1.1 429 Too Many Requests\r\nContent-Type: application/json\r\n\r\n{}")
+				continue
+			}
+			j, _ := json.Marshal(gmailThread(id))
+			fmt.Fprintf(pw, "HTTP/1.1 200 OK\r\nContent-Type: application/json\r\nContent-Length: %d\r\n\r\n%s", len(j), j)
+		}
+		mw.Close()
+
+		mu.Lock()
+		batches = append(batches, n)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "multipart/mixed; boundary="+mw.Boundary())
+		w.Write(out.Bytes())
+	})
+	mux.HandleFunc("/gmail/v1/users/me/threads/", func(w http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, "/gmail/v1/users/me/threads/")
+		mu.Lock()
+		singleIDs = append(singleIDs, id)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(gmailThread(id))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	svc, err := gmail.NewService(ctx, option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGmailProvider(svc, srv.Client())
+	g.batchURL = srv.URL + "/batch/gmail/v1"
+
+	var threadIDs []string
+	for i := 0; i < nthreads; i++ {
+		threadIDs = append(threadIDs, fmt.Sprintf("t%d", i))
+	}
+
+	// The batches are charged only for the threads they produce,
+	// and the rest as single gets,
+	// so each thread is charged once.
+	const burst = 10 * nthreads * quotaThreadsGet
+	lim := rate.NewLimiter(rate.Every(time.Hour), burst)
+	threads, err := newLimitedProvider(g, lim).GetThreads(ctx, threadIDs, "From")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := burst-lim.Tokens(), float64(nthreads*quotaThreadsGet); math.Abs(got-want) > 1 {
+		t.Errorf("limiter charged %.0f quota units, want %.0f", got, want)
+	}
+	if len(threads) != nthreads {
+		t.Fatalf("got %d threads, want %d", len(threads), nthreads)
+	}
+	for i, thread := range threads {
+		if thread.ID != threadIDs[i] {
+			t.Errorf("thread %d: got ID %s, want %s", i, thread.ID, threadIDs[i])
+			continue
+		}
+		if len(thread.Messages) != 1 {
+			t.Errorf("thread %s: got %d messages, want 1", thread.ID, len(thread.Messages))
+			continue
+		}
+		if got, want := thread.Messages[0].Headers[0].Value, thread.ID+"@example.com"; got != want {
+			t.Errorf("thread %s: got From %s, want %s", thread.ID, got, want)
+		}
+	}
+
+	if want := []int{100, 100, 50}; !sameInts(batches, want) {
+		t.Errorf("got batch sizes %v, want %v", batches, want)
+	}
+	if len(singleIDs) != nthreads/10 {
+		t.Errorf("got %d single gets, want %d", len(singleIDs), nthreads/10)
+	}
+	for _, id := range singleIDs {
+		if !failInBatch(id) {
+			t.Errorf("thread %s fetched singly but should have come from a batch", id)
+		}
+	}
+}
+
+func sameInts(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -20,13 +20,66 @@ type homedata struct {
 	Email string `json:"email"`
 
 	// The following are only present if Email is.
-	Enabled bool `json:"enabled"`
-	Expired bool `json:"expired"`
+	Enabled       bool        `json:"enabled"`
+	Expired       bool        `json:"expired"`
+	ExpiredReason string      `json:"expired_reason,omitempty"` // why Expired, if known
+	ContactsLabel string      `json:"contacts_label,omitempty"`
+	StarredLabel  string      `json:"starred_label,omitempty"`
+	Groups        []homeGroup `json:"groups,omitempty"`
+	Allow         []homeAllow `json:"allow,omitempty"`
+
+	// Headers are the message headers that may confer a label.
+	Headers []string `json:"headers,omitempty"`
+
+	// ThreadPolicy says which messages in a thread may confer a label.
+	ThreadPolicy string `json:"thread_policy,omitempty"`
+
+	// ScanStrategy says how a searching update chooses threads to examine.
+	ScanStrategy string `json:"scan_strategy,omitempty"`
+
+	// HashContacts tells whether stored contacts hold only hashed addresses.
+	HashContacts bool `json:"hash_contacts,omitempty"`
+
+	// Plus are the user's subaddressing rules.
+	Plus []homePlus `json:"plus,omitempty"`
+
+	// CorrespondentsDays is the correspondents lookback in days, zero if disabled.
+	CorrespondentsDays  int    `json:"correspondents_days,omitempty"`
+	CorrespondentsLabel string `json:"correspondents_label,omitempty"`
+
+	// Cleanup is the progress of the user's label cleanup job, if any.
+	Cleanup *homeCleanup `json:"cleanup,omitempty"`
+}
+
+// homeGroup is a contact group mapped to a label of its own.
+type homeGroup struct {
+	Group string `json:"group"`
+	Label string `json:"label"`
+}
+
+// homeAllow is a domain allow rule.
+type homeAllow struct {
+	Pattern string `json:"pattern"`
+	Tier    string `json:"tier"` // "contacts" or "starred"
+}
+
+// homeCleanup is the progress of a label cleanup job.
+type homeCleanup struct {
+	Threads      int    `json:"threads"` // threads stripped so far
+	DeleteLabels bool   `json:"delete_labels,omitempty"`
+	Done         bool   `json:"done"`
+	Error        string `json:"error,omitempty"`
+}
+
+// homePlus is a subaddressing rule.
+type homePlus struct {
+	Domain string `json:"domain"`
+	Sep    string `json:"sep"`
 }
 
 // GET /s/data
 func (s *Server) handleData(ctx context.Context) (*homedata, error) {
-	sess, err := aesite.GetSession(ctx, s.dsClient, mid.Request(ctx))
+	sess, err := s.store.GetSession(ctx, mid.Request(ctx))
 	if aesite.IsNoSession(err) {
 		return s.newSession(ctx)
 	}
@@ -42,7 +95,7 @@ const (
 )
 
 func (s *Server) newSession(ctx context.Context) (*homedata, error) {
-	sess, err := aesite.NewSessionWithDuration(ctx, s.dsClient, nil, sessionDur)
+	sess, err := s.store.NewSession(ctx, sessionDur)
 	if err != nil {
 		return nil, errors.Wrap(err, "creating new session")
 	}
@@ -56,13 +109,51 @@ func (s *Server) existingSession(ctx context.Context, sess *aesite.Session) (*ho
 		data homedata
 	)
 
-	err := sess.GetUser(ctx, s.dsClient, &u)
+	err := s.store.sessionUser(ctx, sess, &u)
 	if errors.Is(err, aesite.ErrAnonymous) {
 		// ok
 	} else if err != nil {
 		return nil, errors.Wrap(err, "getting session user")
 	} else {
 		data.Email = u.Email
+		data.ContactsLabel = u.contactsLabel()
+		data.StarredLabel = u.starredLabel()
+		data.Headers = u.MatchPolicy.headers()
+		data.ThreadPolicy = string(u.MatchPolicy.threadPolicy())
+		data.ScanStrategy = string(scanFull)
+		if u.ScanStrategy != "" {
+			data.ScanStrategy = string(u.ScanStrategy)
+		}
+		data.HashContacts = u.HashContacts
+		for _, r := range u.MatchPolicy.PlusRules {
+			data.Plus = append(data.Plus, homePlus{Domain: r.Domain, Sep: r.Sep})
+		}
+		if u.CorrespondentsLookback > 0 {
+			data.CorrespondentsDays = int(u.CorrespondentsLookback / dayDur)
+			data.CorrespondentsLabel = u.correspondentsLabel()
+		}
+		for _, gl := range u.GroupLabels {
+			data.Groups = append(data.Groups, homeGroup{Group: gl.GroupID, Label: gl.Name})
+		}
+		for _, r := range u.AllowRules {
+			a := homeAllow{Pattern: r.Pattern(), Tier: "contacts"}
+			if r.Starred {
+				a.Tier = "starred"
+			}
+			data.Allow = append(data.Allow, a)
+		}
+		if !u.Cleanup.Started.IsZero() {
+			data.Cleanup = &homeCleanup{
+				Threads:      u.Cleanup.Threads,
+				DeleteLabels: u.Cleanup.DeleteLabels,
+				Done:         !u.Cleanup.Done.IsZero(),
+				Error:        u.Cleanup.Err,
+			}
+		}
+		if u.Token == "" && u.ExpiredReason != "" {
+			data.Expired = true
+			data.ExpiredReason = u.ExpiredReason
+		}
 		if u.Token != "" {
 			client, err := s.oauthClient(ctx, &u)
 			if err != nil {
@@ -72,16 +163,22 @@ func (s *Server) existingSession(ctx context.Context, sess *aesite.Session) (*ho
 			if err != nil {
 				return nil, errors.Wrapf(err, "creating gmail client for %s", u.Email)
 			}
-			_, err = gmailSvc.Users.GetProfile("me").Do()
-			if err != nil {
-				log.Printf("Getting profile for %s: %s", u.Email, err)
-				u.Token = ""
-				_, err = s.dsClient.Put(ctx, u.Key(), &u)
+			err = retry(ctx, func() error {
+				_, err := gmailSvc.Users.GetProfile("me").Context(ctx).Do()
+				return err
+			})
+			if reason := revocation(err); reason != "" {
+				err = s.expireUser(ctx, u.Email, reason)
 				if err != nil {
-					return nil, errors.Wrapf(err, "updating user %s after token expiry", u.Email)
+					return nil, err
 				}
 				data.Expired = true
+				data.ExpiredReason = reason
 			} else {
+				if err != nil {
+					// Not a sign of a dead grant, so presumably transient.
+					log.Printf("Getting profile for %s: %s", u.Email, err)
+				}
 				// xxx check prof.EmailAddress == u.Email?
 				data.Enabled = u.WatchExpiry.After(time.Now())
 			}
@@ -0,0 +1,99 @@
+package unclog
+
+import "strings"
+
+// tierIndex maps sender addresses to labeling tiers.
+// It is built once per update (see Server.doUpdate)
+// so that looking up a sender takes constant time
+// regardless of the size of the user's address book.
+type tierIndex struct {
+	// labelIDs are the tiers' label IDs, in order of precedence.
+	labelIDs []string
+
+	// addrs maps each contact address key (see user.addrKey) to the index of its best tier.
+	addrs map[string]int
+
+	// hash, if not nil, turns a canonical address into its key.
+	hash func(string) string
+
+	// domains maps each domain in an exact-domain allow rule to the index of its best tier.
+	domains map[string]int
+
+	// wildcards maps each domain in a wildcard allow rule (without the "*.")
+	// to the index of its best tier.
+	wildcards map[string]int
+}
+
+// Builds a tierIndex from tiers in order of precedence (see user.labelTiers).
+// The addresses in the tiers should already be keys (see user.addrKey),
+// produced with the given hash function (see user.addrHasher).
+func newTierIndex(tiers []*tier, hash func(string) string) *tierIndex {
+	x := &tierIndex{
+		hash:      hash,
+		labelIDs:  make([]string, 0, len(tiers)),
+		addrs:     make(map[string]int),
+		domains:   make(map[string]int),
+		wildcards: make(map[string]int),
+	}
+	for i, t := range tiers {
+		x.labelIDs = append(x.labelIDs, t.labelID)
+		for _, c := range t.contacts {
+			for _, addr := range c.Addrs {
+				setIfAbsent(x.addrs, addr, i)
+			}
+		}
+		for _, r := range t.rules {
+			if suffix := strings.TrimPrefix(r.Domain, "*."); suffix != r.Domain {
+				setIfAbsent(x.wildcards, suffix, i)
+			} else {
+				setIfAbsent(x.domains, r.Domain, i)
+			}
+		}
+	}
+	return x
+}
+
+// Since tiers are added in order of precedence,
+// the first one recorded for a key is the best.
+func setIfAbsent(m map[string]int, key string, val int) {
+	if _, ok := m[key]; !ok {
+		m[key] = val
+	}
+}
+
+// Returns the index of the best tier for the canonical address addr,
+// or -1 if it belongs to none.
+func (x *tierIndex) lookup(addr string) int {
+	best := -1
+	consider := func(m map[string]int, key string) {
+		if i, ok := m[key]; ok && (best < 0 || i < best) {
+			best = i
+		}
+	}
+
+	if x.hash != nil {
+		consider(x.addrs, x.hash(addr))
+	} else {
+		consider(x.addrs, addr)
+	}
+
+	idx := strings.LastIndex(addr, "@")
+	if idx < 0 {
+		return best
+	}
+	domain := addr[idx+1:]
+	consider(x.domains, domain)
+	if len(x.wildcards) > 0 {
+		// Check each proper suffix of the domain:
+		// for "a.b.partner.org", check "b.partner.org", "partner.org", and "org".
+		for {
+			dot := strings.Index(domain, ".")
+			if dot < 0 {
+				break
+			}
+			domain = domain[dot+1:]
+			consider(x.wildcards, domain)
+		}
+	}
+	return best
+}
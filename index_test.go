@@ -0,0 +1,112 @@
+package unclog
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTierIndex(t *testing.T) {
+	index := newTierIndex([]*tier{{
+		labelID:  "starred",
+		contacts: []*Contact{{Addrs: []string{"alice@example.com"}}},
+		rules:    []allowRule{{Domain: "boss.example", Starred: true}},
+	}, {
+		labelID:  "family",
+		contacts: []*Contact{{Addrs: []string{"bob@example.com"}}},
+	}, {
+		labelID:  "contacts",
+		contacts: []*Contact{{Addrs: []string{"bob@example.com", "carol@example.com"}}},
+		rules:    []allowRule{{Domain: "ourcompany.com"}, {Domain: "*.partner.org"}, {Domain: "*.boss.example"}},
+	}}, nil)
+
+	cases := []struct {
+		addr string
+		want int
+	}{
+		{"alice@example.com", 0},
+		{"bob@example.com", 1}, // in two tiers, the first wins
+		{"carol@example.com", 2},
+		{"dave@example.com", -1},
+		{"anyone@ourcompany.com", 2},
+		{"anyone@mail.ourcompany.com", -1},
+		{"anyone@notourcompany.com", -1},
+		{"anyone@mail.partner.org", 2},
+		{"anyone@a.b.partner.org", 2},
+		{"anyone@partner.org", -1},
+		{"anyone@counterpartner.org", -1},
+		{"anyone@boss.example", 0},
+		{"anyone@vp.boss.example", 2},
+		{"not an address", -1},
+	}
+	for _, c := range cases {
+		if got := index.lookup(c.addr); got != c.want {
+			t.Errorf("lookup(%s): got %d, want %d", c.addr, got, c.want)
+		}
+	}
+}
+
+// Builds a synthetic address book of n contacts,
+// every tenth of them starred and every fifth of the rest in a group.
+func syntheticContacts(n int) []*Contact {
+	contacts := make([]*Contact, 0, n)
+	for i := 0; i < n; i++ {
+		c := &Contact{Addrs: []string{
+			fmt.Sprintf("Person.%d@example.com", i),
+			fmt.Sprintf("person%d+work@gmail.com", i),
+		}}
+		switch {
+		case i%10 == 0:
+			c.Groups = []string{"myContacts", starredGroup}
+		case i%5 == 0:
+			c.Groups = []string{"myContacts", "family"}
+		default:
+			c.Groups = []string{"myContacts"}
+		}
+		contacts = append(contacts, c)
+	}
+	return contacts
+}
+
+func benchmarkUser() *user {
+	return &user{
+		ContactsLabelID: "L1",
+		StarredLabelID:  "L2",
+		GroupLabels:     []groupLabel{{GroupID: "family", Name: "✔/Family", LabelID: "L3"}},
+		AllowRules:      []allowRule{{Domain: "ourcompany.com"}, {Domain: "*.partner.org"}},
+	}
+}
+
+func BenchmarkNewTierIndex(b *testing.B) {
+	var (
+		contacts = syntheticContacts(10000)
+		u        = benchmarkUser()
+	)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		newTierIndex(u.labelTiers(contacts, nil), nil)
+	}
+}
+
+func BenchmarkTierIndexLookup(b *testing.B) {
+	var (
+		u     = benchmarkUser()
+		index = newTierIndex(u.labelTiers(syntheticContacts(10000), nil), nil)
+		addrs = make([]string, 1000)
+	)
+	for i := range addrs {
+		switch i % 4 {
+		case 0:
+			addrs[i] = fmt.Sprintf("person.%d@example.com", i*7)
+		case 1:
+			addrs[i] = u.MatchPolicy.canonicalAddr(fmt.Sprintf("Person%d+news@googlemail.com", i*7))
+		case 2:
+			addrs[i] = fmt.Sprintf("someone%d@mail.partner.org", i)
+		default:
+			addrs[i] = fmt.Sprintf("stranger%d@elsewhere.example", i)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		index.lookup(addrs[i%len(addrs)])
+	}
+}
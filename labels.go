@@ -0,0 +1,212 @@
+package unclog
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// Default label names.
+// See user.ContactsLabelName and user.StarredLabelName.
+const (
+	contactsLabelName = "✔"
+	starredLabelName  = "✔/★"
+)
+
+// groupLabel maps one of a user's contact groups to a Gmail label.
+type groupLabel struct {
+	// GroupID is the ID of the contact group (see ContactGroup).
+	GroupID string
+
+	// Name is the name of the Gmail label, e.g. "✔/Family".
+	Name string
+
+	// LabelID is the Gmail ID of the label.
+	LabelID string
+}
+
+// A tier is a class of known senders whose threads all get the same label.
+type tier struct {
+	labelID  string
+	name     string // of the label
+	contacts []*Contact
+	rules    []allowRule
+}
+
+// Sorts contacts into labeling tiers, in order of precedence:
+//
+//   - starred contacts (labeled ✔/★ by default);
+//   - contacts in each of u.GroupLabels, in order;
+//   - all other contacts (labeled ✔ by default);
+//   - correspondents, if enabled (labeled ✔/✉ by default).
+//
+// A thread gets the label of the highest-precedence tier of any sender
+// (see handleThread).
+// Contact and correspondent addresses should already be keys produced by u.addrKey
+// (see syncContacts and refreshCorrespondents).
+// Each contact is placed only in the first tier it qualifies for.
+// Senders matching one of u.AllowRules belong to the starred or the unstarred tier,
+// as the rule specifies.
+// Tiers whose labels have not been created are omitted.
+func (u *user) labelTiers(contacts []*Contact, corrs []correspondent) []*tier {
+	var (
+		starred   = &tier{labelID: u.StarredLabelID, name: u.starredLabel()}
+		groups    = make([]*tier, len(u.GroupLabels))
+		unstarred = &tier{labelID: u.ContactsLabelID, name: u.contactsLabel()}
+	)
+	for i, gl := range u.GroupLabels {
+		groups[i] = &tier{labelID: gl.LabelID, name: gl.Name}
+	}
+
+CONTACTS:
+	for _, c := range contacts {
+		if c.InGroup(starredGroup) {
+			starred.contacts = append(starred.contacts, c)
+			continue
+		}
+		for i, gl := range u.GroupLabels {
+			if c.InGroup(gl.GroupID) {
+				groups[i].contacts = append(groups[i].contacts, c)
+				continue CONTACTS
+			}
+		}
+		unstarred.contacts = append(unstarred.contacts, c)
+	}
+	for _, r := range u.AllowRules {
+		if r.Starred {
+			starred.rules = append(starred.rules, r)
+		} else {
+			unstarred.rules = append(unstarred.rules, r)
+		}
+	}
+
+	all := append(append([]*tier{starred}, groups...), unstarred)
+	if u.CorrespondentsLookback > 0 {
+		c := &Contact{}
+		for _, corr := range corrs {
+			c.Addrs = append(c.Addrs, corr.Addr)
+		}
+		all = append(all, &tier{labelID: u.CorrespondentsLabelID, name: u.correspondentsLabel(), contacts: []*Contact{c}})
+	}
+
+	var result []*tier
+	for _, t := range all {
+		if t.labelID != "" {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// Returns the name of u's label for unstarred contacts.
+func (u *user) contactsLabel() string {
+	if u.ContactsLabelName != "" {
+		return u.ContactsLabelName
+	}
+	return contactsLabelName
+}
+
+// Returns the name of u's label for starred contacts.
+func (u *user) starredLabel() string {
+	if u.StarredLabelName != "" {
+		return u.StarredLabelName
+	}
+	return starredLabelName
+}
+
+// A managedLabel is one of a user's labels together with a pointer to where its ID is recorded.
+type managedLabel struct {
+	name string
+	id   *string
+}
+
+func (u *user) managedLabels() []managedLabel {
+	result := []managedLabel{
+		{name: u.contactsLabel(), id: &u.ContactsLabelID},
+		{name: u.starredLabel(), id: &u.StarredLabelID},
+	}
+	for i := range u.GroupLabels {
+		gl := &u.GroupLabels[i]
+		result = append(result, managedLabel{name: gl.Name, id: &gl.LabelID})
+	}
+	if u.CorrespondentsLookback > 0 {
+		result = append(result, managedLabel{name: u.correspondentsLabel(), id: &u.CorrespondentsLabelID})
+	}
+	return result
+}
+
+// Returns those of u's labels whose IDs are known,
+// including the correspondents label
+// if it was created before correspondents were turned off,
+// and any retired labels (see user.RetiredLabels).
+func (u *user) ownedLabels() []managedLabel {
+	all := u.managedLabels()
+	if u.CorrespondentsLookback == 0 {
+		all = append(all, managedLabel{name: u.correspondentsLabel(), id: &u.CorrespondentsLabelID})
+	}
+	for i := range u.RetiredLabels {
+		l := &u.RetiredLabels[i]
+		all = append(all, managedLabel{name: l.Name, id: &l.ID})
+	}
+	var (
+		result []managedLabel
+		seen   = make(map[string]bool)
+	)
+	for _, ml := range all {
+		if *ml.id != "" && !seen[*ml.id] {
+			result = append(result, ml)
+			seen[*ml.id] = true
+		}
+	}
+	return result
+}
+
+// Makes the mailbox's labels agree with u's label names
+// and records their IDs in u.
+// A label whose ID is already known is renamed if necessary,
+// so threads keep their labels when the user chooses a new name.
+// Otherwise a label with the right name is found or created.
+// Labels it creates are recorded in u.CreatedLabels.
+// The caller is responsible for storing u.
+func (s *Server) ensureLabels(ctx context.Context, mp MailProvider, u *user) error {
+	labels, err := mp.Labels(ctx)
+	if err != nil {
+		return errors.Wrap(err, "listing labels")
+	}
+	var (
+		byID   = make(map[string]*Label)
+		byName = make(map[string]*Label)
+	)
+	for _, label := range labels {
+		byID[label.ID] = label
+		byName[label.Name] = label
+	}
+
+	for _, ml := range u.managedLabels() {
+		if label, ok := byID[*ml.id]; ok {
+			if label.Name != ml.name {
+				err = mp.RenameLabel(ctx, label.ID, ml.name)
+				if err != nil {
+					return errors.Wrapf(err, "renaming label %s to %s", label.Name, ml.name)
+				}
+				delete(byName, label.Name)
+				label.Name = ml.name
+				byName[ml.name] = label
+			}
+			continue
+		}
+		if label, ok := byName[ml.name]; ok {
+			*ml.id = label.ID
+			continue
+		}
+		label, err := mp.CreateLabel(ctx, ml.name)
+		if err != nil {
+			return errors.Wrapf(err, "creating %s label", ml.name)
+		}
+		byID[label.ID] = label
+		byName[label.Name] = label
+		*ml.id = label.ID
+		u.CreatedLabels = append(u.CreatedLabels, label.ID)
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package unclog
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestEnsureLabels(t *testing.T) {
+	var (
+		ctx = context.Background()
+		mp  = NewMemMailbox()
+		s   = &Server{}
+		u   = &user{GroupLabels: []groupLabel{{GroupID: "family", Name: "✔/Family"}}}
+	)
+
+	// A label the user created by hand is adopted rather than duplicated.
+	existing, err := mp.CreateLabel(ctx, starredLabelName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = s.ensureLabels(ctx, mp, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.StarredLabelID != existing.ID {
+		t.Errorf("got starred label ID %s, want %s", u.StarredLabelID, existing.ID)
+	}
+	if u.ContactsLabelID == "" || u.GroupLabels[0].LabelID == "" {
+		t.Fatalf("labels not created: %+v", u)
+	}
+	checkLabels(t, mp, map[string]string{
+		u.ContactsLabelID:        contactsLabelName,
+		u.StarredLabelID:         starredLabelName,
+		u.GroupLabels[0].LabelID: "✔/Family",
+	})
+
+	// Renaming keeps the label IDs.
+	ids := []string{u.ContactsLabelID, u.StarredLabelID, u.GroupLabels[0].LabelID}
+	u.ContactsLabelName = "Known"
+	u.StarredLabelName = "Known/Starred"
+	u.GroupLabels[0].Name = "Known/Family"
+	err = s.ensureLabels(ctx, mp, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := []string{u.ContactsLabelID, u.StarredLabelID, u.GroupLabels[0].LabelID}; !sameStrings(got, ids) {
+		t.Errorf("got label IDs %v, want %v", got, ids)
+	}
+	checkLabels(t, mp, map[string]string{
+		ids[0]: "Known",
+		ids[1]: "Known/Starred",
+		ids[2]: "Known/Family",
+	})
+
+	// Renaming onto some other label's name fails.
+	if _, err = mp.CreateLabel(ctx, "Taken"); err != nil {
+		t.Fatal(err)
+	}
+	u.ContactsLabelName = "Taken"
+	err = s.ensureLabels(ctx, mp, u)
+	if !errors.Is(err, ErrLabelExists) {
+		t.Errorf("got error %v, want ErrLabelExists", err)
+	}
+	if u.ContactsLabelID != ids[0] {
+		t.Errorf("got contacts label ID %s, want %s", u.ContactsLabelID, ids[0])
+	}
+}
+
+func checkLabels(t *testing.T, mp MailProvider, want map[string]string) {
+	t.Helper()
+
+	labels, err := mp.Labels(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]string)
+	for _, label := range labels {
+		got[label.ID] = label.Name
+	}
+	for id, name := range want {
+		if got[id] != name {
+			t.Errorf("label %s: got name %q, want %q", id, got[id], name)
+		}
+	}
+}
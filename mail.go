@@ -0,0 +1,98 @@
+package unclog
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MailProvider is the interface to a user's mailbox
+// used for finding and labeling threads.
+// GmailProvider is the production implementation.
+// MemMailbox is an in-memory implementation for tests.
+type MailProvider interface {
+	// ListThreads calls f on successive pages of IDs of threads matching the Gmail search query q.
+	ListThreads(ctx context.Context, q string, f func(threadIDs []string) error) error
+
+	// LabelThreads calls f on successive pages of IDs of threads
+	// having messages with the label with the given ID.
+	// Unlike a search for the label's name with ListThreads,
+	// this does not depend on how the name is spelled in a query.
+	LabelThreads(ctx context.Context, labelID string, f func(threadIDs []string) error) error
+
+	// GetThread gets the metadata of the thread with the given ID.
+	// Only the named headers of each message are included.
+	GetThread(ctx context.Context, threadID string, headers ...string) (*Thread, error)
+
+	// GetThreads is like GetThread for many threads at once.
+	// The result has a thread for each thread ID, in the same order.
+	GetThreads(ctx context.Context, threadIDs []string, headers ...string) ([]*Thread, error)
+
+	// ModifyThread adds and removes labels (by ID) on the messages in the thread with the given ID.
+	ModifyThread(ctx context.Context, threadID string, add, remove []string) error
+
+	// BatchModify adds and removes labels (by ID) on the messages with the given IDs,
+	// of which there may be up to 1,000.
+	BatchModify(ctx context.Context, messageIDs, add, remove []string) error
+
+	// Labels lists the labels in the mailbox.
+	Labels(ctx context.Context) ([]*Label, error)
+
+	// CreateLabel creates a label with the given name.
+	// If the label already exists, the result is ErrLabelExists.
+	CreateLabel(ctx context.Context, name string) (*Label, error)
+
+	// RenameLabel gives a new name to the label with the given ID.
+	// If a different label already has that name, the result is ErrLabelExists.
+	RenameLabel(ctx context.Context, labelID, name string) error
+
+	// DeleteLabel deletes the label with the given ID,
+	// removing it from any messages that carry it.
+	// It is not an error if there is no such label.
+	DeleteLabel(ctx context.Context, labelID string) error
+
+	// History calls f on successive pages of IDs of threads
+	// to which messages have been added since the mailbox history record startHistoryID.
+	// If labelID is not empty, only messages with that label are considered.
+	// A thread may appear more than once.
+	// The result is the ID of the latest history record,
+	// for use as startHistoryID in the next call.
+	// If startHistoryID is too old, the result is ErrHistoryExpired.
+	History(ctx context.Context, startHistoryID uint64, labelID string, f func(threadIDs []string) error) (uint64, error)
+
+	// CurrentHistoryID returns the ID of the latest mailbox history record.
+	CurrentHistoryID(ctx context.Context) (uint64, error)
+}
+
+// ErrHistoryExpired is the error returned by MailProvider.History
+// when the requested history is no longer available.
+var ErrHistoryExpired = errors.New("history expired")
+
+// ErrLabelExists is the error returned by MailProvider.CreateLabel and MailProvider.RenameLabel
+// when a label with the requested name already exists.
+var ErrLabelExists = errors.New("label exists")
+
+// Thread is the metadata of a mail thread.
+type Thread struct {
+	ID       string
+	Messages []*Message
+}
+
+// Message is the metadata of a message in a mail thread.
+type Message struct {
+	ID       string
+	Time     time.Time
+	LabelIDs []string
+	Headers  []Header
+}
+
+// Header is a message header field.
+type Header struct {
+	Name, Value string
+}
+
+// Label is a mailbox label.
+type Label struct {
+	ID, Name string
+}
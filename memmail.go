@@ -0,0 +1,422 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemMailbox is an in-memory MailProvider, for tests.
+// Its ListThreads method ignores the query and lists all threads,
+// unless Search is true.
+// Its history records the threads added with AddThread.
+type MemMailbox struct {
+	// PageSize is the number of thread IDs per page in ListThreads and History.
+	// Default 100.
+	PageSize int
+
+	// ModifyErr, if not nil, is called by ModifyThread and BatchModify
+	// with the ID of each thread they would change.
+	// If it returns an error, the call fails with that error and changes nothing.
+	ModifyErr func(threadID string) error
+
+	// Search, if true, makes ListThreads list only the threads matching its query,
+	// which must be in the subset of Gmail's search syntax described at parseMemQuery.
+	Search bool
+
+	// GetErr, if not nil, is called by GetThread with the ID of the thread to get.
+	// If it returns an error, the call fails with that error.
+	GetErr func(threadID string) error
+
+	mu       sync.Mutex
+	threads  map[string]*Thread
+	labels   []*Label
+	nextID   int
+	modified map[string]int // thread ID -> count of ModifyThread and BatchModify calls
+	batches  int            // count of BatchModify calls
+
+	history       []string // history[i] is the ID of the thread added in history record i+1
+	historyOldest uint64   // history before this record has expired
+}
+
+var _ MailProvider = &MemMailbox{}
+
+// NewMemMailbox produces a new, empty MemMailbox.
+func NewMemMailbox() *MemMailbox {
+	return &MemMailbox{
+		threads:  make(map[string]*Thread),
+		modified: make(map[string]int),
+	}
+}
+
+// AddThread adds a thread to the mailbox, replacing any with the same ID.
+func (m *MemMailbox) AddThread(thread *Thread) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.threads[thread.ID] = copyThread(thread)
+	m.history = append(m.history, thread.ID)
+}
+
+// ExpireHistory discards the mailbox history up to the current record,
+// so that History calls starting earlier than that fail with ErrHistoryExpired.
+func (m *MemMailbox) ExpireHistory() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.historyOldest = uint64(len(m.history))
+}
+
+// Thread returns a copy of the thread with the given ID, or nil if there is none.
+func (m *MemMailbox) Thread(threadID string) *Thread {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	thread, ok := m.threads[threadID]
+	if !ok {
+		return nil
+	}
+	return copyThread(thread)
+}
+
+// Modifications tells how many times ModifyThread or BatchModify has changed the thread with the given ID.
+func (m *MemMailbox) Modifications(threadID string) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.modified[threadID]
+}
+
+// ListThreads implements MailProvider.ListThreads.
+func (m *MemMailbox) ListThreads(ctx context.Context, q string, f func(threadIDs []string) error) error {
+	var query memQuery
+	if m.Search {
+		var err error
+		if query, err = parseMemQuery(q); err != nil {
+			return err
+		}
+	}
+
+	m.mu.Lock()
+	threadIDs := make([]string, 0, len(m.threads))
+	for id, thread := range m.threads {
+		if m.Search {
+			ok, err := m.matchThread(query, thread)
+			if err != nil {
+				m.mu.Unlock()
+				return err
+			}
+			if !ok {
+				continue
+			}
+		}
+		threadIDs = append(threadIDs, id)
+	}
+	m.mu.Unlock()
+
+	sort.Strings(threadIDs)
+
+	return m.pages(threadIDs, f)
+}
+
+// LabelThreads implements MailProvider.LabelThreads.
+func (m *MemMailbox) LabelThreads(ctx context.Context, labelID string, f func(threadIDs []string) error) error {
+	m.mu.Lock()
+	var threadIDs []string
+	for id, thread := range m.threads {
+		for _, msg := range thread.Messages {
+			if contains(msg.LabelIDs, labelID) {
+				threadIDs = append(threadIDs, id)
+				break
+			}
+		}
+	}
+	m.mu.Unlock()
+
+	sort.Strings(threadIDs)
+
+	return m.pages(threadIDs, f)
+}
+
+// Calls f on successive pages of threadIDs.
+func (m *MemMailbox) pages(threadIDs []string, f func([]string) error) error {
+	pageSize := m.PageSize
+	if pageSize <= 0 {
+		pageSize = 100
+	}
+	for len(threadIDs) > 0 {
+		n := pageSize
+		if n > len(threadIDs) {
+			n = len(threadIDs)
+		}
+		if err := f(threadIDs[:n]); err != nil {
+			return err
+		}
+		threadIDs = threadIDs[n:]
+	}
+	return nil
+}
+
+// History implements MailProvider.History.
+func (m *MemMailbox) History(ctx context.Context, startHistoryID uint64, labelID string, f func(threadIDs []string) error) (uint64, error) {
+	m.mu.Lock()
+	if startHistoryID < m.historyOldest {
+		m.mu.Unlock()
+		return 0, ErrHistoryExpired
+	}
+	var (
+		latest    = uint64(len(m.history))
+		threadIDs []string
+	)
+	for i := startHistoryID; i < latest; i++ {
+		threadID := m.history[i]
+		if labelID != "" {
+			var found bool
+			for _, msg := range m.threads[threadID].Messages {
+				if contains(msg.LabelIDs, labelID) {
+					found = true
+					break
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		threadIDs = append(threadIDs, threadID)
+	}
+	m.mu.Unlock()
+
+	if err := m.pages(threadIDs, f); err != nil {
+		return 0, err
+	}
+	return latest, nil
+}
+
+// CurrentHistoryID implements MailProvider.CurrentHistoryID.
+func (m *MemMailbox) CurrentHistoryID(ctx context.Context) (uint64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return uint64(len(m.history)), nil
+}
+
+// GetThread implements MailProvider.GetThread.
+func (m *MemMailbox) GetThread(ctx context.Context, threadID string, headers ...string) (*Thread, error) {
+	if m.GetErr != nil {
+		if err := m.GetErr(threadID); err != nil {
+			return nil, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	thread, ok := m.threads[threadID]
+	if !ok {
+		return nil, fmt.Errorf("no thread %s", threadID)
+	}
+	result := copyThread(thread)
+	for _, msg := range result.Messages {
+		var kept []Header
+		for _, h := range msg.Headers {
+			for _, name := range headers {
+				if strings.EqualFold(h.Name, name) {
+					kept = append(kept, h)
+					break
+				}
+			}
+		}
+		msg.Headers = kept
+	}
+	return result, nil
+}
+
+// GetThreads implements MailProvider.GetThreads.
+func (m *MemMailbox) GetThreads(ctx context.Context, threadIDs []string, headers ...string) ([]*Thread, error) {
+	result := make([]*Thread, 0, len(threadIDs))
+	for _, threadID := range threadIDs {
+		thread, err := m.GetThread(ctx, threadID, headers...)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, thread)
+	}
+	return result, nil
+}
+
+// ModifyThread implements MailProvider.ModifyThread.
+func (m *MemMailbox) ModifyThread(ctx context.Context, threadID string, add, remove []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	thread, ok := m.threads[threadID]
+	if !ok {
+		return fmt.Errorf("no thread %s", threadID)
+	}
+	if m.ModifyErr != nil {
+		if err := m.ModifyErr(threadID); err != nil {
+			return err
+		}
+	}
+	for _, msg := range thread.Messages {
+		modifyMessage(msg, add, remove)
+	}
+	m.modified[threadID]++
+	return nil
+}
+
+// BatchModify implements MailProvider.BatchModify.
+func (m *MemMailbox) BatchModify(ctx context.Context, messageIDs, add, remove []string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(messageIDs) > 1000 {
+		return fmt.Errorf("%d message IDs in batch", len(messageIDs))
+	}
+
+	var (
+		msgs      []*Message
+		threadIDs = make(map[string]bool)
+	)
+	for _, msgID := range messageIDs {
+		var found bool
+		for threadID, thread := range m.threads {
+			for _, msg := range thread.Messages {
+				if msg.ID == msgID {
+					msgs = append(msgs, msg)
+					threadIDs[threadID] = true
+					found = true
+				}
+			}
+		}
+		if !found {
+			return fmt.Errorf("no message %s", msgID)
+		}
+	}
+	if m.ModifyErr != nil {
+		for threadID := range threadIDs {
+			if err := m.ModifyErr(threadID); err != nil {
+				return err
+			}
+		}
+	}
+	for _, msg := range msgs {
+		modifyMessage(msg, add, remove)
+	}
+	for threadID := range threadIDs {
+		m.modified[threadID]++
+	}
+	m.batches++
+	return nil
+}
+
+// BatchModifyCalls tells how many times BatchModify has succeeded.
+func (m *MemMailbox) BatchModifyCalls() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.batches
+}
+
+func modifyMessage(msg *Message, add, remove []string) {
+	var labelIDs []string
+	for _, id := range msg.LabelIDs {
+		if !contains(remove, id) && !contains(add, id) {
+			labelIDs = append(labelIDs, id)
+		}
+	}
+	msg.LabelIDs = append(labelIDs, add...)
+}
+
+// Labels implements MailProvider.Labels.
+func (m *MemMailbox) Labels(ctx context.Context) ([]*Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	result := make([]*Label, 0, len(m.labels))
+	for _, label := range m.labels {
+		l := *label
+		result = append(result, &l)
+	}
+	return result, nil
+}
+
+// CreateLabel implements MailProvider.CreateLabel.
+func (m *MemMailbox) CreateLabel(ctx context.Context, name string) (*Label, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, label := range m.labels {
+		if label.Name == name {
+			return nil, ErrLabelExists
+		}
+	}
+	m.nextID++
+	label := &Label{ID: fmt.Sprintf("Label_%d", m.nextID), Name: name}
+	m.labels = append(m.labels, label)
+	l := *label
+	return &l, nil
+}
+
+// RenameLabel implements MailProvider.RenameLabel.
+func (m *MemMailbox) RenameLabel(ctx context.Context, labelID, name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var found *Label
+	for _, label := range m.labels {
+		if label.Name == name && label.ID != labelID {
+			return ErrLabelExists
+		}
+		if label.ID == labelID {
+			found = label
+		}
+	}
+	if found == nil {
+		return fmt.Errorf("no label %s", labelID)
+	}
+	found.Name = name
+	return nil
+}
+
+// DeleteLabel implements MailProvider.DeleteLabel.
+func (m *MemMailbox) DeleteLabel(ctx context.Context, labelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, label := range m.labels {
+		if label.ID != labelID {
+			continue
+		}
+		m.labels = append(m.labels[:i], m.labels[i+1:]...)
+		for _, thread := range m.threads {
+			for _, msg := range thread.Messages {
+				modifyMessage(msg, nil, []string{labelID})
+			}
+		}
+		break
+	}
+	return nil
+}
+
+func copyThread(thread *Thread) *Thread {
+	result := &Thread{ID: thread.ID}
+	for _, msg := range thread.Messages {
+		m := *msg
+		m.LabelIDs = append([]string(nil), msg.LabelIDs...)
+		m.Headers = append([]Header(nil), msg.Headers...)
+		result.Messages = append(result.Messages, &m)
+	}
+	return result
+}
+
+func contains(strs []string, s string) bool {
+	for _, str := range strs {
+		if str == s {
+			return true
+		}
+	}
+	return false
+}
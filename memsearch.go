@@ -0,0 +1,176 @@
+package unclog
+
+import (
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// memQuery is a parsed Gmail search query for MemMailbox.
+// A thread matches if any one of its messages matches all the terms,
+// as in Gmail.
+type memQuery []memTerm
+
+type memTerm struct {
+	negate bool
+	op     string   // "label", "in", "from", "after", or "before"
+	vals   []string // alternatives (joined with OR); lowercase
+}
+
+// Parses a query in the subset of Gmail's search syntax that MemMailbox understands:
+// space-separated terms, each optionally negated with "-",
+// of the forms label:NAME, in:NAME, from:ADDR, from:(ADDR OR ADDR ...),
+// after:TIME and before:TIME
+// (where TIME is Unix seconds or YYYY/MM/DD).
+func parseMemQuery(q string) (memQuery, error) {
+	var result memQuery
+	for _, tok := range splitQuery(q) {
+		var t memTerm
+		if strings.HasPrefix(tok, "-") {
+			t.negate = true
+			tok = tok[1:]
+		}
+		op, val, ok := strings.Cut(tok, ":")
+		if !ok {
+			return nil, fmt.Errorf("unsupported query term %q", tok)
+		}
+		t.op = strings.ToLower(op)
+		switch t.op {
+		case "label", "in", "from", "after", "before":
+		default:
+			return nil, fmt.Errorf("unsupported query operator %q", op)
+		}
+		if strings.HasPrefix(val, "(") && strings.HasSuffix(val, ")") {
+			for _, alt := range strings.Fields(val[1 : len(val)-1]) {
+				if alt != "OR" {
+					t.vals = append(t.vals, strings.ToLower(alt))
+				}
+			}
+		} else {
+			t.vals = []string{strings.ToLower(val)}
+		}
+		result = append(result, t)
+	}
+	return result, nil
+}
+
+// Splits a query on spaces outside of parentheses.
+func splitQuery(q string) []string {
+	var (
+		result []string
+		depth  int
+		start  = -1
+	)
+	for i, r := range q {
+		switch {
+		case r == '(':
+			depth++
+		case r == ')':
+			depth--
+		case r == ' ' && depth == 0:
+			if start >= 0 {
+				result = append(result, q[start:i])
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		result = append(result, q[start:])
+	}
+	return result
+}
+
+// Tells whether the thread matches the query.
+// The caller must hold m.mu.
+func (m *MemMailbox) matchThread(q memQuery, thread *Thread) (bool, error) {
+	for _, msg := range thread.Messages {
+		ok, err := m.matchMessage(q, msg)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+func (m *MemMailbox) matchMessage(q memQuery, msg *Message) (bool, error) {
+	for _, t := range q {
+		var ok bool
+		for _, val := range t.vals {
+			match, err := m.matchTerm(t.op, val, msg)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				ok = true
+				break
+			}
+		}
+		if ok == t.negate {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func (m *MemMailbox) matchTerm(op, val string, msg *Message) (bool, error) {
+	switch op {
+	case "label", "in":
+		for _, labelID := range msg.LabelIDs {
+			if strings.EqualFold(labelID, val) {
+				return true, nil
+			}
+			for _, label := range m.labels {
+				if label.ID == labelID && searchLabel(label.Name) == val {
+					return true, nil
+				}
+			}
+		}
+		return false, nil
+
+	case "from":
+		for _, h := range msg.Headers {
+			if !strings.EqualFold(h.Name, "From") {
+				continue
+			}
+			a, err := mail.ParseAddress(h.Value)
+			if err != nil {
+				return false, nil
+			}
+			addr := strings.ToLower(a.Address)
+			if strings.Contains(val, "@") {
+				return addr == val, nil
+			}
+			domain := addr[strings.LastIndex(addr, "@")+1:]
+			return domain == val || strings.HasSuffix(domain, "."+val), nil
+		}
+		return false, nil
+
+	case "after", "before":
+		t, err := parseQueryTime(val)
+		if err != nil {
+			return false, err
+		}
+		if op == "after" {
+			return msg.Time.After(t), nil
+		}
+		return msg.Time.Before(t), nil
+	}
+	return false, fmt.Errorf("unsupported query operator %q", op)
+}
+
+func parseQueryTime(val string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(val, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	t, err := time.Parse("2006/01/02", val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("unsupported query time %q", val)
+	}
+	return t, nil
+}
@@ -2,8 +2,9 @@ package unclog
 
 import (
 	"context"
-	"encoding/json"
+	"log"
 	"net/http"
+	"sync"
 
 	"github.com/bobg/aesite"
 	"github.com/pkg/errors"
@@ -25,7 +26,7 @@ func (s *Server) getOauthConf(ctx context.Context) (*oauth2.Config, error) {
 	defer s.mu.Unlock()
 
 	if s.oauthConf == nil {
-		oauthConfJSON, err := aesite.GetSetting(ctx, s.dsClient, "oauthConf")
+		oauthConfJSON, err := s.store.GetSetting(ctx, "oauthConf")
 		if err != nil {
 			return nil, errors.Wrap(err, "getting oauth config")
 		}
@@ -41,6 +42,9 @@ func (s *Server) getOauthConf(ctx context.Context) (*oauth2.Config, error) {
 var errNoToken = errors.New("no token")
 
 // Produces an oauth-authenticated http client for the given user.
+// Whenever its token is refreshed,
+// the new token is stored in the user's record
+// (see persistingTokenSource).
 func (s *Server) oauthClient(ctx context.Context, u *user) (*http.Client, error) {
 	if u.Token == "" {
 		return nil, errNoToken
@@ -51,11 +55,106 @@ func (s *Server) oauthClient(ctx context.Context, u *user) (*http.Client, error)
 		return nil, errors.Wrap(err, "getting oauth config")
 	}
 
-	var token oauth2.Token
-	err = json.Unmarshal([]byte(u.Token), &token)
+	token, err := s.decodeToken(ctx, u.Email, u.Token)
 	if err != nil {
-		return nil, errors.Wrap(err, "JSON-unmarshaling token")
+		return nil, errors.Wrapf(err, "decoding token for %s", u.Email)
 	}
 
-	return oauthConf.Client(ctx, &token), nil
+	src := &persistingTokenSource{
+		ctx:   ctx,
+		s:     s,
+		email: u.Email,
+		src:   oauthConf.TokenSource(ctx, token),
+		last:  token.AccessToken,
+	}
+	return oauth2.NewClient(ctx, src), nil
+}
+
+// persistingTokenSource is an oauth2.TokenSource for a user's token
+// that stores the token in the user's record whenever it changes,
+// as when it is refreshed.
+// That way later tasks can use it rather than refreshing it again,
+// and a new refresh token issued by Google is not lost.
+//
+// Several tasks for the same user may refresh the token at once,
+// each getting a different, valid access token.
+// See Server.storeToken for how they are reconciled.
+type persistingTokenSource struct {
+	ctx   context.Context
+	s     *Server
+	email string
+	src   oauth2.TokenSource // refreshes the token as needed
+
+	mu   sync.Mutex
+	last string // the access token last loaded or stored
+}
+
+// Token implements oauth2.TokenSource.
+// A failure to store a new token is logged but is not an error,
+// since the token is good regardless.
+func (p *persistingTokenSource) Token() (*oauth2.Token, error) {
+	token, err := p.src.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if token.AccessToken == p.last {
+		return token, nil
+	}
+	if err := p.s.storeToken(p.ctx, p.email, token); err != nil {
+		log.Printf("storing refreshed token for %s: %s", p.email, err)
+		return token, nil
+	}
+	p.last = token.AccessToken
+	return token, nil
+}
+
+// How many times storeToken tries again after a conflicting update of the user record.
+const storeTokenAttempts = 3
+
+// errTokenCurrent is for abandoning an update in storeToken.
+var errTokenCurrent = errors.New("stored token is current")
+
+// Stores a refreshed token in the user's record, transactionally.
+// If the stored token expires later than this one,
+// another task has stored a fresher token, and it is kept.
+// If this token lacks a refresh token (Google usually sends one only at first authorization),
+// the stored one's is kept.
+// If the user has no stored token (e.g. because they have disconnected Unclog),
+// nothing is stored.
+func (s *Server) storeToken(ctx context.Context, email string, token *oauth2.Token) error {
+	// Load the token keys before the transaction, not in it.
+	if _, err := s.getTokenKeys(ctx, false); err != nil {
+		return err
+	}
+	for attempt := 1; ; attempt++ {
+		var u user
+		err := s.store.updateUser(ctx, email, &u, func() error {
+			if u.Token == "" {
+				return errTokenCurrent
+			}
+			newToken := *token
+			if stored, err := s.decodeToken(ctx, email, u.Token); err == nil {
+				if stored.Expiry.After(newToken.Expiry) {
+					return errTokenCurrent
+				}
+				if newToken.RefreshToken == "" {
+					newToken.RefreshToken = stored.RefreshToken
+				}
+			}
+			var err error
+			u.Token, err = s.encodeToken(ctx, email, &newToken)
+			return err
+		})
+		switch {
+		case errors.Is(err, errTokenCurrent):
+			return nil
+		case errors.Is(err, aesite.ErrUpdateConflict) && attempt < storeTokenAttempts:
+			continue
+		}
+		return errors.Wrapf(err, "storing token for %s", email)
+	}
 }
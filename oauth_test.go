@@ -0,0 +1,190 @@
+package unclog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestPersistingTokenSource(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	// The token endpoint issues numbered access tokens,
+	// each expiring later than the one before,
+	// and a new refresh token only when asked for rotated.
+	var (
+		issued int32
+		rotate bool
+	)
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&issued, 1)
+		resp := map[string]any{
+			"access_token": fmt.Sprintf("a%d", n),
+			"token_type":   "Bearer",
+			"expires_in":   3600 + int(n),
+		}
+		if rotate {
+			resp["refresh_token"] = fmt.Sprintf("r%d", n)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer tokenSrv.Close()
+
+	// The API endpoint reports the access token it was called with.
+	apiSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fmt.Fprint(w, req.Header.Get("Authorization"))
+	}))
+	defer apiSrv.Close()
+
+	s := newServer(bs, nil, "")
+	s.oauthConf = &oauth2.Config{
+		ClientID:     "id",
+		ClientSecret: "secret",
+		Endpoint:     oauth2.Endpoint{TokenURL: tokenSrv.URL, AuthStyle: oauth2.AuthStyleInParams},
+	}
+
+	setToken := func(tok *oauth2.Token) *user {
+		j, err := json.Marshal(tok)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var u user
+		err = bs.updateUser(ctx, "alice@example.com", &u, func() error {
+			u.Token = string(j)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &u
+	}
+	storedToken := func() *oauth2.Token {
+		var u user
+		if err := bs.lookupUser(ctx, "alice@example.com", &u); err != nil {
+			t.Fatal(err)
+		}
+		if u.Token == "" {
+			return nil
+		}
+		var tok oauth2.Token
+		if err := json.Unmarshal([]byte(u.Token), &tok); err != nil {
+			t.Fatal(err)
+		}
+		return &tok
+	}
+	call := func(u *user) string {
+		client, err := s.oauthClient(ctx, u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Get(apiSrv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var buf [64]byte
+		n, _ := resp.Body.Read(buf[:])
+		return string(buf[:n])
+	}
+
+	var u user
+	if err = bs.newUser(ctx, "alice@example.com", &u); err != nil {
+		t.Fatal(err)
+	}
+	expired := &oauth2.Token{AccessToken: "a0", RefreshToken: "r0", Expiry: time.Now().Add(-time.Minute)}
+
+	t.Run("refresh is stored", func(t *testing.T) {
+		u := setToken(expired)
+		if got := call(u); got != "Bearer a1" {
+			t.Errorf("got authorization %q, want Bearer a1", got)
+		}
+		tok := storedToken()
+		if tok.AccessToken != "a1" || tok.RefreshToken != "r0" {
+			t.Errorf("got stored token %s/%s, want a1/r0", tok.AccessToken, tok.RefreshToken)
+		}
+
+		// The next client uses the stored token without refreshing.
+		var u2 user
+		if err := bs.lookupUser(ctx, "alice@example.com", &u2); err != nil {
+			t.Fatal(err)
+		}
+		if got := call(&u2); got != "Bearer a1" {
+			t.Errorf("got authorization %q, want Bearer a1", got)
+		}
+		if issued != 1 {
+			t.Errorf("got %d refreshes, want 1", issued)
+		}
+	})
+
+	t.Run("rotated refresh token", func(t *testing.T) {
+		rotate = true
+		defer func() { rotate = false }()
+
+		u := setToken(expired)
+		call(u)
+		if tok := storedToken(); tok.RefreshToken != fmt.Sprintf("r%d", issued) {
+			t.Errorf("got stored refresh token %s, want r%d", tok.RefreshToken, issued)
+		}
+	})
+
+	t.Run("concurrent refreshes", func(t *testing.T) {
+		u := setToken(expired)
+		start := issued
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				u := *u
+				call(&u)
+			}()
+		}
+		wg.Wait()
+
+		// Each parallel client refreshed on its own;
+		// the one expiring latest wins.
+		if issued-start != 8 {
+			t.Errorf("got %d refreshes, want 8", issued-start)
+		}
+		tok := storedToken()
+		if want := fmt.Sprintf("a%d", issued); tok.AccessToken != want {
+			t.Errorf("got stored access token %s, want %s", tok.AccessToken, want)
+		}
+		if tok.RefreshToken == "" {
+			t.Error("lost the refresh token")
+		}
+	})
+
+	t.Run("disconnected user", func(t *testing.T) {
+		u := setToken(expired)
+		var cleared user
+		err := bs.updateUser(ctx, "alice@example.com", &cleared, func() error {
+			cleared.Token = ""
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		call(u)
+		if tok := storedToken(); tok != nil {
+			t.Errorf("got stored token %+v, want none", tok)
+		}
+	})
+}
@@ -0,0 +1,212 @@
+package unclog
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// scanStrategy says how an update that searches the mailbox
+// (rather than following its history; see Server.doUpdate)
+// chooses the threads to examine.
+type scanStrategy string
+
+const (
+	// scanFull examines every thread in the search window.
+	scanFull scanStrategy = "full"
+
+	// scanPlanned examines only the threads in the search window
+	// that could need a label change (see planQueries).
+	scanPlanned scanStrategy = "planned"
+)
+
+// Parses a scan strategy given by the user.
+func parseScanStrategy(val string) (scanStrategy, error) {
+	switch s := scanStrategy(strings.ToLower(strings.TrimSpace(val))); s {
+	case scanFull, scanPlanned:
+		return s, nil
+	}
+	return "", fmt.Errorf("unknown scan strategy %q", val)
+}
+
+// maxQueryLen is the longest Gmail search query planQueries produces,
+// staying well under the length of URL that Gmail accepts.
+const maxQueryLen = 1500
+
+// Builds Gmail search queries that together find every thread matching window
+// that could need a label change,
+// so that an update need not examine every thread in the window.
+// For each tier, in order of precedence, there are:
+//
+//   - queries for threads with a message from one of the tier's senders
+//     that lacks the tier's label,
+//     like `-label:✔ from:(a@example.com OR b@example.com)`,
+//     in as many chunks as it takes to keep each query under maxQueryLen;
+//   - a query for threads with a message carrying the tier's label
+//     that is not from one of the tier's senders,
+//     like `label:✔ -from:(a@example.com OR b@example.com)`,
+//     or just `label:✔` where that can't be narrowed safely.
+//
+// Senders are matched only by From
+// and only as precisely as Gmail's search allows,
+// so addresses in domains where canonicalization joins different spellings
+// (Gmail, and those with plus rules)
+// are searched for by domain.
+//
+// Planning is not possible if the policy allows senders in other headers,
+// which Gmail can't search for,
+// or if the tiers' addresses are hashed.
+// The boolean result reports whether planning was possible.
+//
+// The queries look only at messages in the window,
+// and assume a thread's labels are all applied by Unclog,
+// which labels whole threads.
+// A thread that could need a change only because of an older message
+// (say, from a sender added to the contacts since)
+// is left for a full scan.
+func planQueries(window string, tiers []*tier, index *tierIndex, policy matchPolicy) ([]string, bool) {
+	if index.hash != nil {
+		return nil, false
+	}
+	if headers := policy.headers(); len(headers) != 1 || headers[0] != "From" {
+		return nil, false
+	}
+
+	var queries []string
+	for i, t := range tiers {
+		label := searchLabel(t.name)
+
+		var terms []string
+		for _, c := range t.contacts {
+			for _, addr := range c.Addrs {
+				terms = append(terms, policy.addrTerms(addr)...)
+			}
+		}
+		for _, r := range t.rules {
+			terms = append(terms, domainTerms(strings.TrimPrefix(r.Domain, "*."))...)
+		}
+		terms = dedupe(terms)
+
+		prefix := strings.TrimSpace(window + " -label:" + label)
+		queries = append(queries, chunkQueries(prefix, "from", terms)...)
+
+		if q, ok := unlabelQuery(window, label, i, t, index, policy); ok {
+			queries = append(queries, q)
+		} else {
+			queries = append(queries, strings.TrimSpace(window+" label:"+label))
+		}
+	}
+	return queries, true
+}
+
+// Tries to build a query for threads in the window carrying the label of tiers[i]
+// with a message not from one of that tier's senders.
+// This is safe only under threadAny,
+// since other policies can remove a label because of who sent a message
+// that doesn't carry it;
+// only for tiers without allow rules,
+// since Gmail's domain search is looser than allow rules are;
+// and only with the tier's exact addresses whose best tier it is,
+// since a thread from a sender with a better tier also needs its label removed.
+func unlabelQuery(window, label string, i int, t *tier, index *tierIndex, policy matchPolicy) (string, bool) {
+	if policy.threadPolicy() != threadAny || len(t.rules) > 0 {
+		return "", false
+	}
+	var terms []string
+	for _, c := range t.contacts {
+		for _, addr := range c.Addrs {
+			if index.lookup(addr) == i {
+				terms = append(terms, addr)
+			}
+		}
+	}
+	terms = dedupe(terms)
+	if len(terms) == 0 {
+		return "", false
+	}
+	q := strings.TrimSpace(window + " label:" + label + " -from:(" + strings.Join(terms, " OR ") + ")")
+	if len(q) > maxQueryLen {
+		return "", false
+	}
+	return q, true
+}
+
+// Returns the terms for a from: search that find mail from any spelling of the canonical address addr.
+func (p matchPolicy) addrTerms(addr string) []string {
+	idx := strings.LastIndex(addr, "@")
+	if idx < 0 {
+		return nil
+	}
+	domain := addr[idx+1:]
+	if domain == "gmail.com" {
+		return []string{"gmail.com", "googlemail.com"}
+	}
+	for _, r := range p.PlusRules {
+		if r.Domain == domain {
+			return domainTerms(domain)
+		}
+	}
+	result := []string{addr}
+	if u, err := idna.Lookup.ToUnicode(domain); err == nil && u != domain {
+		result = append(result, addr[:idx+1]+u)
+	}
+	return result
+}
+
+// Returns the terms for a from: search that find mail from a domain (or its subdomains),
+// in both its ASCII and Unicode forms if they differ.
+func domainTerms(domain string) []string {
+	result := []string{domain}
+	if u, err := idna.Lookup.ToUnicode(domain); err == nil && u != domain {
+		result = append(result, u)
+	}
+	return result
+}
+
+// Produces queries of the form `prefix op:(t1 OR t2 ...)`
+// covering all the terms, each query no longer than maxQueryLen
+// (unless a single term makes it longer).
+func chunkQueries(prefix, op string, terms []string) []string {
+	var (
+		result []string
+		chunk  []string
+	)
+	query := func(terms []string) string {
+		return prefix + " " + op + ":(" + strings.Join(terms, " OR ") + ")"
+	}
+	for _, term := range terms {
+		if len(chunk) > 0 && len(query(append(chunk, term))) > maxQueryLen {
+			result = append(result, query(chunk))
+			chunk = nil
+		}
+		chunk = append(chunk, term)
+	}
+	if len(chunk) > 0 {
+		result = append(result, query(chunk))
+	}
+	return result
+}
+
+// Returns the form of a label name used in Gmail searches:
+// lowercase, with spaces and slashes (for nested labels) replaced by hyphens.
+func searchLabel(name string) string {
+	return strings.NewReplacer(" ", "-", "/", "-").Replace(strings.ToLower(name))
+}
+
+// Returns the distinct strings of strs, sorted.
+func dedupe(strs []string) []string {
+	if len(strs) == 0 {
+		return nil
+	}
+	strs = append([]string(nil), strs...)
+	sort.Strings(strs)
+	result := strs[:1]
+	for _, s := range strs[1:] {
+		if s != result[len(result)-1] {
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,231 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPlanQueries(t *testing.T) {
+	u := &user{
+		ContactsLabelID: "c",
+		StarredLabelID:  "s",
+		AllowRules:      []allowRule{{Domain: "ourcompany.com"}},
+	}
+	contacts := []*Contact{
+		u.keyContact(&Contact{Addrs: []string{"Alice@Example.com"}, Groups: []string{starredGroup}}),
+		u.keyContact(&Contact{Addrs: []string{"bob@example.com", "Z.E.D@googlemail.com"}}),
+	}
+	tiers := u.labelTiers(contacts, nil)
+	index := newTierIndex(tiers, u.addrHasher())
+
+	got, ok := planQueries("in:inbox", tiers, index, matchPolicy{})
+	if !ok {
+		t.Fatal("planning not possible")
+	}
+	want := []string{
+		"in:inbox -label:✔-★ from:(alice@example.com)",
+		"in:inbox label:✔-★ -from:(alice@example.com)",
+		"in:inbox -label:✔ from:(bob@example.com OR gmail.com OR googlemail.com OR ourcompany.com)",
+		"in:inbox label:✔",
+	}
+	if !sameStrings(got, want) {
+		t.Errorf("got:\n  %s\nwant:\n  %s", strings.Join(got, "\n  "), strings.Join(want, "\n  "))
+	}
+
+	if _, ok := planQueries("", tiers, index, matchPolicy{Headers: []string{"From", "Reply-To"}}); ok {
+		t.Error("planned queries for Reply-To senders")
+	}
+
+	u.HashContacts = true
+	u.Secret = []byte("xyzzy")
+	tiers = u.labelTiers([]*Contact{u.keyContact(&Contact{Addrs: []string{"bob@example.com"}})}, nil)
+	if _, ok := planQueries("", tiers, newTierIndex(tiers, u.addrHasher()), matchPolicy{}); ok {
+		t.Error("planned queries for hashed contacts")
+	}
+}
+
+func TestChunkQueries(t *testing.T) {
+	var terms []string
+	for i := 0; i < 500; i++ {
+		terms = append(terms, fmt.Sprintf("person%d@example.com", i))
+	}
+	queries := chunkQueries("-label:✔", "from", terms)
+	if len(queries) < 2 {
+		t.Fatalf("got %d queries, want several", len(queries))
+	}
+	var n int
+	for _, q := range queries {
+		if len(q) > maxQueryLen {
+			t.Errorf("query of length %d exceeds %d", len(q), maxQueryLen)
+		}
+		n += strings.Count(q, "@")
+	}
+	if n != len(terms) {
+		t.Errorf("got %d terms in all queries, want %d", n, len(terms))
+	}
+}
+
+// Checks that the planned scan makes the same changes as the full scan,
+// while examining fewer threads.
+func TestPlannedScanEquivalence(t *testing.T) {
+	var (
+		ctx    = context.Background()
+		base   = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+		window = fmt.Sprintf("in:inbox after:%d", base.Unix())
+	)
+
+	senders := []string{
+		"Alice <alice@example.com>",         // starred
+		"fran@family.example",               // family group
+		"bob@example.com",                   // contact
+		"Bob Jr <BOB@Example.COM>",          // contact, different case
+		"Z.E.D+news@googlemail.com",         // contact, Gmail variant
+		"zoe@gmail.com",                     // stranger at Gmail
+		"jo@bücher.example",                 // contact, IDN
+		"pat+lists@plus.example",            // contact, plus rule
+		"kim@ourcompany.com",                // domain rule
+		"lee@eng.partner.org",               // starred wildcard rule
+		"lee@partner.org",                   // stranger; wildcard excludes the bare domain
+		"stranger@example.com",              // stranger
+		"another.stranger@elsewhere.com",    // stranger
+		"not an address",                    // unparseable
+		"Mallory <mallory@family.example.>", // stranger
+	}
+	strangers := []string{
+		"zoe@gmail.com",
+		"lee@partner.org",
+		"stranger@example.com",
+		"another.stranger@elsewhere.com",
+	}
+
+	newMailbox := func() (*MemMailbox, *user, []*Contact) {
+		mb := NewMemMailbox()
+		mb.Search = true
+
+		u := &user{
+			GroupLabels: []groupLabel{{GroupID: "family", Name: "✔/Family"}},
+			AllowRules:  []allowRule{{Domain: "ourcompany.com"}, {Domain: "*.partner.org", Starred: true}},
+		}
+		u.MatchPolicy.PlusRules = []plusRule{{Domain: "plus.example", Sep: "+"}}
+		if err := (&Server{}).ensureLabels(ctx, mb, u); err != nil {
+			t.Fatal(err)
+		}
+
+		rnd := rand.New(rand.NewSource(1))
+		labelIDs := []string{"", u.StarredLabelID, u.GroupLabels[0].LabelID, u.ContactsLabelID}
+		for i := 0; i < 400; i++ {
+			// Each thread is either wholly in the window or wholly before it,
+			// and its tier labels, if any, are on all its messages.
+			threadTime := base.Add(time.Duration(1+rnd.Intn(1000)) * time.Minute)
+			if rnd.Intn(5) == 0 {
+				threadTime = base.Add(-time.Duration(1+rnd.Intn(1000)) * time.Minute)
+			}
+			var labels []string
+			if id := labelIDs[rnd.Intn(len(labelIDs))]; id != "" {
+				labels = append(labels, id)
+			}
+			if rnd.Intn(10) == 0 {
+				labels = append(labels, labelIDs[1+rnd.Intn(len(labelIDs)-1)])
+			}
+			inbox := rnd.Intn(4) > 0
+
+			// Most mail is from strangers and needs no change.
+			from := senders
+			if rnd.Intn(3) > 0 {
+				from, labels = strangers, nil
+			}
+
+			thread := &Thread{ID: fmt.Sprintf("t%03d", i)}
+			for j, n := 0, 1+rnd.Intn(4); j < n; j++ {
+				msgLabels := append([]string(nil), labels...)
+				if inbox {
+					msgLabels = append(msgLabels, "INBOX")
+				}
+				thread.Messages = append(thread.Messages, &Message{
+					ID:       fmt.Sprintf("%s-%d", thread.ID, j),
+					Time:     threadTime.Add(time.Duration(j) * time.Second),
+					LabelIDs: msgLabels,
+					Headers:  []Header{{Name: "From", Value: from[rnd.Intn(len(from))]}},
+				})
+			}
+			mb.AddThread(thread)
+		}
+
+		var contacts []*Contact
+		for i, c := range []*Contact{
+			{Addrs: []string{"alice@example.com"}, Groups: []string{starredGroup}},
+			{Addrs: []string{"fran@family.example"}, Groups: []string{"family"}},
+			{Addrs: []string{"bob@example.com", "zed@gmail.com"}},
+			{Addrs: []string{"jo@xn--bcher-kva.example", "pat@plus.example"}},
+		} {
+			c.ID = fmt.Sprintf("c%d", i)
+			contacts = append(contacts, u.keyContact(c))
+		}
+		return mb, u, contacts
+	}
+
+	for _, policy := range []threadPolicy{threadAny, threadFirst, threadLatest} {
+		t.Run(string(policy), func(t *testing.T) {
+			var (
+				results [2]map[string][]string
+				changes [2]int
+				fetches [2]int32
+			)
+			for i, planned := range []bool{false, true} {
+				mb, u, contacts := newMailbox()
+				u.MatchPolicy.Thread = policy
+
+				var fetched int32
+				mb.GetErr = func(string) error {
+					atomic.AddInt32(&fetched, 1)
+					return nil
+				}
+
+				tiers := u.labelTiers(contacts, nil)
+				index := newTierIndex(tiers, u.addrHasher())
+				queries := []string{window}
+				if planned {
+					var ok bool
+					queries, ok = planQueries(window, tiers, index, u.MatchPolicy)
+					if !ok {
+						t.Fatal("planning not possible")
+					}
+				}
+
+				nchanges, _, err := processThreads(ctx, mb, queries, 4, time.Time{}, index, u.MatchPolicy)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				results[i] = make(map[string][]string)
+				for j := 0; j < 400; j++ {
+					threadID := fmt.Sprintf("t%03d", j)
+					results[i][threadID] = mb.Thread(threadID).Messages[0].LabelIDs
+				}
+				changes[i] = nchanges
+				fetches[i] = atomic.LoadInt32(&fetched)
+			}
+
+			if changes[0] == 0 {
+				t.Fatal("full scan made no changes")
+			}
+			if changes[0] != changes[1] {
+				t.Errorf("full scan changed %d thread(s), planned scan %d", changes[0], changes[1])
+			}
+			for threadID, full := range results[0] {
+				if planned := results[1][threadID]; !sameStrings(full, planned) {
+					t.Errorf("thread %s: full scan gave labels %v, planned scan %v", threadID, full, planned)
+				}
+			}
+			if fetches[1] >= fetches[0] {
+				t.Errorf("planned scan fetched %d thread(s), full scan %d", fetches[1], fetches[0])
+			}
+			t.Logf("full scan fetched %d thread(s), planned scan %d, for %d change(s)", fetches[0], fetches[1], changes[0])
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package unclog
+
+import (
+	"fmt"
+	"log"
+	"net/mail"
+	"strings"
+)
+
+// senderHeaders are the message headers that can identify who a message is from.
+// Only From is trustworthy:
+// Gmail checks it (via SPF, DKIM and DMARC) and shows it to the user.
+// The others are easy to forge,
+// but mail sent through ticketing systems, mailing lists, Google Groups, and "on behalf of" services
+// often names the real person only in one of them.
+var senderHeaders = []string{"From", "Sender", "Reply-To", "X-Original-From"}
+
+// matchPolicy says how a thread's senders are determined for labeling.
+type matchPolicy struct {
+	// Headers are the headers (from senderHeaders) whose addresses may confer a label.
+	// If empty, only From is used.
+	Headers []string
+
+	// Thread says which of a thread's messages may confer a label.
+	// If empty, threadAny is used.
+	Thread threadPolicy
+
+	// PlusRules are the domains, besides Gmail, whose addresses may carry a tag
+	// that is ignored when matching senders to contacts.
+	// See matchPolicy.canonicalAddr.
+	PlusRules []plusRule
+
+	// self is the canonical address of the mailbox's owner
+	// (see user.matchPolicy).
+	// Under threadFirst and threadLatest,
+	// the owner's own messages don't count.
+	self string
+}
+
+// threadPolicy says which messages in a thread may confer a label.
+// Whichever messages those are,
+// the thread gets the label of the highest-precedence tier among their senders,
+// and the label is applied to (or removed from) every message in the thread.
+type threadPolicy string
+
+const (
+	// threadAny labels a thread by the best sender of any of its messages.
+	// A thread started by a stranger gets a label once a contact replies,
+	// and keeps it as long as any message from a contact remains.
+	threadAny threadPolicy = "any"
+
+	// threadFirst labels a thread by the sender of its earliest message,
+	// i.e. whoever started the conversation.
+	// Later replies, even from starred contacts, do not change the label.
+	threadFirst threadPolicy = "first"
+
+	// threadLatest labels a thread by the sender of its latest message.
+	// The label changes as the conversation goes on,
+	// and is removed when a stranger has the last word.
+	threadLatest threadPolicy = "latest"
+)
+
+// Returns the user's match policy,
+// knowing the user's own address.
+func (u *user) matchPolicy() matchPolicy {
+	p := u.MatchPolicy
+	p.self = p.canonicalAddr(u.Email)
+	return p
+}
+
+// Returns the thread policy of p.
+func (p matchPolicy) threadPolicy() threadPolicy {
+	if p.Thread == "" {
+		return threadAny
+	}
+	return p.Thread
+}
+
+// Parses a thread policy given by the user.
+func parseThreadPolicy(val string) (threadPolicy, error) {
+	switch p := threadPolicy(strings.ToLower(strings.TrimSpace(val))); p {
+	case threadAny, threadFirst, threadLatest:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown thread policy %q", val)
+}
+
+// Returns the messages of thread that p allows to confer a label.
+// For threadFirst and threadLatest,
+// the mailbox owner's own messages are skipped
+// (see matchPolicy.fromSelf),
+// so that the user's replies don't decide a thread's label;
+// and ties in message time are broken by the order of messages in the thread.
+func (p matchPolicy) senderMessages(thread *Thread) []*Message {
+	policy := p.threadPolicy()
+	if policy == threadAny {
+		return thread.Messages
+	}
+
+	var result *Message
+	for _, msg := range thread.Messages {
+		if p.fromSelf(msg) {
+			continue
+		}
+		switch {
+		case result == nil:
+			result = msg
+		case policy == threadFirst && msg.Time.Before(result.Time):
+			result = msg
+		case policy == threadLatest && !msg.Time.Before(result.Time):
+			result = msg
+		}
+	}
+	if result == nil {
+		return nil
+	}
+	return []*Message{result}
+}
+
+// Tells whether msg was sent by the mailbox's owner:
+// it has the SENT label,
+// or its From address is the owner's.
+func (p matchPolicy) fromSelf(msg *Message) bool {
+	if contains(msg.LabelIDs, "SENT") {
+		return true
+	}
+	if p.self == "" {
+		return false
+	}
+	for _, header := range msg.Headers {
+		if !strings.EqualFold(header.Name, "From") {
+			continue
+		}
+		addr, err := mail.ParseAddress(header.Value)
+		return err == nil && p.canonicalAddr(addr.Address) == p.self
+	}
+	return false
+}
+
+// Returns the headers that p allows to confer a label.
+func (p matchPolicy) headers() []string {
+	if len(p.Headers) == 0 {
+		return []string{"From"}
+	}
+	return p.Headers
+}
+
+// Produces a list of sender headers from header names given by the user,
+// checking them for validity and canonicalizing their case.
+func parseSenderHeaders(vals []string) ([]string, error) {
+	var (
+		result []string
+		seen   = make(map[string]bool)
+	)
+	for _, val := range vals {
+		var name string
+		for _, h := range senderHeaders {
+			if strings.EqualFold(h, strings.TrimSpace(val)) {
+				name = h
+				break
+			}
+		}
+		if name == "" {
+			return nil, fmt.Errorf("unknown header %q", val)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("duplicate header %s", name)
+		}
+		seen[name] = true
+		result = append(result, name)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no headers")
+	}
+	return result, nil
+}
+
+// Returns the addresses in the headers of msg that p allows to confer a label,
+// in canonical form (see matchPolicy.canonicalAddr)
+// and in the order of p's headers.
+// Only the first instance of each header is used.
+func (p matchPolicy) senderAddrs(msg *Message) []string {
+	var result []string
+	for _, name := range p.headers() {
+		for _, header := range msg.Headers {
+			if !strings.EqualFold(header.Name, name) {
+				continue
+			}
+			addrs, err := mail.ParseAddressList(header.Value)
+			if err != nil {
+				log.Printf("skipping unparseable %s address %s: %s", name, header.Value, err)
+				break
+			}
+			for _, addr := range addrs {
+				result = append(result, p.canonicalAddr(addr.Address))
+			}
+			break
+		}
+	}
+	return result
+}
@@ -0,0 +1,231 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/bobg/aesite"
+)
+
+func TestParseSenderHeaders(t *testing.T) {
+	got, err := parseSenderHeaders([]string{"from", " reply-to ", "X-ORIGINAL-FROM"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"From", "Reply-To", "X-Original-From"}
+	if len(got) != len(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("got %v, want %v", got, want)
+			break
+		}
+	}
+
+	for _, bad := range [][]string{nil, {"To"}, {"From", "FROM"}} {
+		if _, err := parseSenderHeaders(bad); err == nil {
+			t.Errorf("got no error for %v", bad)
+		}
+	}
+}
+
+func TestMatchPolicyHeaders(t *testing.T) {
+	var (
+		ctx = context.Background()
+		mb  = NewMemMailbox()
+	)
+
+	mb.AddThread(&Thread{ID: "t", Messages: []*Message{{
+		ID: "m",
+		Headers: []Header{
+			{Name: "From", Value: "Helpdesk <support@tickets.example>"},
+			{Name: "Sender", Value: "list@groups.example"},
+			{Name: "Reply-To", Value: "Alice <alice@example.com>, support@tickets.example"},
+			{Name: "X-Original-From", Value: "bob@example.com"},
+		},
+	}}})
+
+	index := newTierIndex([]*tier{
+		{labelID: "starred", contacts: []*Contact{{Addrs: []string{"alice@example.com"}}}},
+		{labelID: "contacts", contacts: []*Contact{{Addrs: []string{"bob@example.com", "list@groups.example"}}}},
+	}, nil)
+
+	cases := []struct {
+		name    string
+		headers []string
+		want    []string
+	}{
+		{"default", nil, nil},
+		{"from only", []string{"From"}, nil},
+		{"sender", []string{"From", "Sender"}, []string{"contacts"}},
+		{"reply-to", []string{"From", "Reply-To"}, []string{"starred"}},
+		{"original", []string{"X-Original-From"}, []string{"contacts"}},
+		{"all", senderHeaders, []string{"starred"}},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			err := mb.ModifyThread(ctx, "t", nil, []string{"starred", "contacts"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			policy := matchPolicy{Headers: c.headers}
+			thread, err := mb.GetThread(ctx, "t", policy.headers()...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b := newLabelBatcher(mb)
+			handleThread(ctx, b, thread, index, policy)
+			if err = b.flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+			got := mb.Thread("t").Messages[0].LabelIDs
+			if !sameStrings(got, c.want) {
+				t.Errorf("got labels %v, want %v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestThreadPolicy(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		base = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	index := newTierIndex([]*tier{
+		{labelID: "starred", contacts: []*Contact{{Addrs: []string{"alice@example.com"}}}},
+		{labelID: "contacts", contacts: []*Contact{{Addrs: []string{"bob@example.com"}}}},
+	}, nil)
+
+	const (
+		alice    = "alice@example.com"
+		bob      = "bob@example.com"
+		stranger = "stranger@example.com"
+		me       = "Me <ME@example.com>"
+	)
+
+	cases := []struct {
+		name string
+
+		// Senders of the thread's messages, in thread order,
+		// at one-minute intervals unless times is given.
+		from  []string
+		times []int // minutes after base
+
+		want map[threadPolicy]string // label wanted under each policy; "" for none
+	}{{
+		name: "stranger then starred",
+		from: []string{stranger, alice},
+		want: map[threadPolicy]string{threadAny: "starred", threadFirst: "", threadLatest: "starred"},
+	}, {
+		name: "starred then stranger",
+		from: []string{alice, stranger},
+		want: map[threadPolicy]string{threadAny: "starred", threadFirst: "starred", threadLatest: ""},
+	}, {
+		name: "contact, starred, contact",
+		from: []string{bob, alice, bob},
+		want: map[threadPolicy]string{threadAny: "starred", threadFirst: "contacts", threadLatest: "contacts"},
+	}, {
+		name: "stranger, contact, stranger",
+		from: []string{stranger, bob, stranger},
+		want: map[threadPolicy]string{threadAny: "contacts", threadFirst: "", threadLatest: ""},
+	}, {
+		name:  "out of order",
+		from:  []string{bob, alice},
+		times: []int{5, 1},
+		want:  map[threadPolicy]string{threadAny: "starred", threadFirst: "starred", threadLatest: "contacts"},
+	}, {
+		name:  "tied times",
+		from:  []string{bob, stranger, alice},
+		times: []int{1, 1, 1},
+		want:  map[threadPolicy]string{threadAny: "starred", threadFirst: "contacts", threadLatest: "starred"},
+	}, {
+		name: "single message",
+		from: []string{bob},
+		want: map[threadPolicy]string{threadAny: "contacts", threadFirst: "contacts", threadLatest: "contacts"},
+	}, {
+		name: "strangers only",
+		from: []string{stranger, stranger},
+		want: map[threadPolicy]string{threadAny: "", threadFirst: "", threadLatest: ""},
+	}, {
+		name: "user replies last",
+		from: []string{alice, stranger, bob, me},
+		want: map[threadPolicy]string{threadAny: "starred", threadFirst: "starred", threadLatest: "contacts"},
+	}, {
+		name: "user starts thread",
+		from: []string{me, bob, stranger},
+		want: map[threadPolicy]string{threadAny: "contacts", threadFirst: "contacts", threadLatest: ""},
+	}, {
+		name: "user only",
+		from: []string{me, me},
+		want: map[threadPolicy]string{threadAny: "", threadFirst: "", threadLatest: ""},
+	}}
+
+	for _, c := range cases {
+		for _, policy := range []threadPolicy{"", threadAny, threadFirst, threadLatest} {
+			want := c.want[policy]
+			if policy == "" {
+				want = c.want[threadAny] // the default
+			}
+
+			t.Run(fmt.Sprintf("%s/%s", c.name, policy), func(t *testing.T) {
+				mb := NewMemMailbox()
+				thread := &Thread{ID: "t"}
+				for i, from := range c.from {
+					minutes := i
+					if c.times != nil {
+						minutes = c.times[i]
+					}
+					thread.Messages = append(thread.Messages, &Message{
+						ID:       fmt.Sprintf("m%d", i),
+						Time:     base.Add(time.Duration(minutes) * time.Minute),
+						LabelIDs: []string{"starred", "contacts"}, // all wrong, or one right
+						Headers:  []Header{{Name: "From", Value: from}},
+					})
+				}
+				mb.AddThread(thread)
+
+				mp := (&user{User: aesite.User{Email: "me@example.com"}, MatchPolicy: matchPolicy{Thread: policy}}).matchPolicy()
+				thread, err := mb.GetThread(ctx, "t", mp.headers()...)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b := newLabelBatcher(mb)
+				handleThread(ctx, b, thread, index, mp)
+				if err = b.flush(ctx); err != nil {
+					t.Fatal(err)
+				}
+
+				var wantLabels []string
+				if want != "" {
+					wantLabels = []string{want}
+				}
+				for _, msg := range mb.Thread("t").Messages {
+					if !sameStrings(msg.LabelIDs, wantLabels) {
+						t.Errorf("message %s: got labels %v, want %v", msg.ID, msg.LabelIDs, wantLabels)
+					}
+				}
+			})
+		}
+	}
+
+	// A message with the SENT label is the user's own, whatever its From.
+	var (
+		mp   = matchPolicy{Thread: threadLatest}
+		sent = &Message{ID: "m2", Time: base.Add(time.Minute), LabelIDs: []string{"SENT"}, Headers: []Header{{Name: "From", Value: "alias@example.net"}}}
+		recv = &Message{ID: "m1", Time: base, Headers: []Header{{Name: "From", Value: bob}}}
+	)
+	if got := mp.senderMessages(&Thread{Messages: []*Message{recv, sent}}); len(got) != 1 || got[0] != recv {
+		t.Errorf("got sender messages %v, want only %s", got, recv.ID)
+	}
+
+	for _, bad := range []string{"", "all", "last"} {
+		if _, err := parseThreadPolicy(bad); err == nil {
+			t.Errorf("got no error parsing thread policy %q", bad)
+		}
+	}
+}
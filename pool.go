@@ -0,0 +1,138 @@
+package unclog
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+)
+
+// threadPool fetches and labels batches of threads concurrently
+// with a bounded number of workers.
+// Its page method is a callback for MailProvider.ListThreads or MailProvider.History.
+// The first worker to fail cancels the others and the listing.
+type threadPool struct {
+	parent context.Context // for applying label changes
+	ctx    context.Context // canceled when a worker fails
+	g      *errgroup.Group
+	mp     MailProvider
+	index  *tierIndex
+	policy matchPolicy
+	seen   map[string]bool // thread IDs already handed to workers; used only by page
+
+	b *labelBatcher // safe for concurrent use
+
+	mu       sync.Mutex // protects the following
+	nchanges int
+	latest   time.Time
+}
+
+// Produces a new threadPool with the given number of workers.
+// The latest thread time it reports
+// is the later of latestThreadTime and that of the latest message seen.
+func newThreadPool(ctx context.Context, mp MailProvider, workers int, index *tierIndex, policy matchPolicy, latestThreadTime time.Time) *threadPool {
+	if workers < 1 {
+		workers = 1
+	}
+	g, gctx := errgroup.WithContext(ctx)
+	g.SetLimit(workers)
+	return &threadPool{
+		parent: ctx,
+		ctx:    gctx,
+		g:      g,
+		mp:     mp,
+		index:  index,
+		policy: policy,
+		seen:   make(map[string]bool),
+		b:      newLabelBatcher(mp),
+		latest: latestThreadTime,
+	}
+}
+
+// Hands a page of thread IDs to the workers, maxBatchGet at a time,
+// blocking while all of them are busy.
+// Threads already handed to the workers
+// (by an earlier page or listing)
+// are skipped.
+func (p *threadPool) page(threadIDs []string) error {
+	var fresh []string
+	for _, threadID := range threadIDs {
+		if !p.seen[threadID] {
+			p.seen[threadID] = true
+			fresh = append(fresh, threadID)
+		}
+	}
+	threadIDs = fresh
+
+	for len(threadIDs) > 0 {
+		n := maxBatchGet
+		if n > len(threadIDs) {
+			n = len(threadIDs)
+		}
+		chunk := threadIDs[:n]
+		threadIDs = threadIDs[n:]
+
+		// Don't start more work if a worker has failed.
+		// (This also stops the listing.)
+		if err := p.ctx.Err(); err != nil {
+			return err
+		}
+		p.g.Go(func() error {
+			return p.work(chunk)
+		})
+	}
+	return nil
+}
+
+func (p *threadPool) work(threadIDs []string) error {
+	if err := p.ctx.Err(); err != nil {
+		return err // another worker has failed
+	}
+
+	threads, err := p.mp.GetThreads(p.ctx, threadIDs, p.policy.headers()...)
+	if err != nil {
+		return errors.Wrap(err, "getting thread members")
+	}
+
+	var (
+		nchanges int
+		latest   time.Time
+	)
+	for _, thread := range threads {
+		threadTime, changed := handleThread(p.parent, p.b, thread, p.index, p.policy)
+		if changed {
+			nchanges++
+		}
+		if threadTime.After(latest) {
+			latest = threadTime
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nchanges += nchanges
+	if latest.After(p.latest) {
+		p.latest = latest
+	}
+	return nil
+}
+
+// Waits for the workers to finish and applies the pending label changes.
+// The argument is the result of the listing that fed the pool with page.
+// Returns the number of threads changed,
+// the timestamp of the latest message seen (see newThreadPool),
+// and the first error from a worker, the listing, or applying the changes, in that order.
+// Changes already decided are applied even after an error.
+func (p *threadPool) wait(listErr error) (int, time.Time, error) {
+	err := p.g.Wait()
+	if err == nil {
+		err = listErr
+	}
+	if ferr := p.b.flush(p.parent); err == nil {
+		err = ferr
+	}
+	return p.nchanges, p.latest, err
+}
@@ -0,0 +1,120 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestThreadPool(t *testing.T) {
+	const nthreads = 1000
+
+	var (
+		ctx  = context.Background()
+		mb   = NewMemMailbox()
+		base = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	index := newTierIndex([]*tier{
+		{labelID: "contacts", contacts: []*Contact{{Addrs: []string{"alice@example.com"}}}},
+	}, nil)
+
+	var latestWant time.Time
+	for i := 0; i < nthreads; i++ {
+		from := "stranger@example.com"
+		if i%3 == 0 {
+			from = "alice@example.com"
+		}
+		// Make the latest thread come early in the listing.
+		msgTime := base.Add(time.Duration((i*7919)%nthreads) * time.Second)
+		if msgTime.After(latestWant) {
+			latestWant = msgTime
+		}
+		mb.AddThread(&Thread{ID: fmt.Sprintf("t%d", i), Messages: []*Message{{
+			ID:      fmt.Sprintf("m%d", i),
+			Time:    msgTime,
+			Headers: []Header{{Name: "From", Value: from}},
+		}}})
+	}
+	mb.PageSize = 150
+
+	for _, workers := range []int{1, 8} {
+		t.Run(fmt.Sprintf("workers=%d", workers), func(t *testing.T) {
+			for i := 0; i < nthreads; i += 3 {
+				if err := mb.ModifyThread(ctx, fmt.Sprintf("t%d", i), nil, []string{"contacts"}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			nchanges, latest, err := processThreads(ctx, mb, []string{""}, workers, base, index, matchPolicy{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := (nthreads + 2) / 3; nchanges != want {
+				t.Errorf("got %d changes, want %d", nchanges, want)
+			}
+			if !latest.Equal(latestWant) {
+				t.Errorf("got latest thread time %s, want %s", latest, latestWant)
+			}
+			for i := 0; i < nthreads; i++ {
+				got := mb.Thread(fmt.Sprintf("t%d", i)).Messages[0].LabelIDs
+				if i%3 == 0 {
+					if !sameStrings(got, []string{"contacts"}) {
+						t.Errorf("thread t%d: got labels %v, want [contacts]", i, got)
+					}
+				} else if len(got) > 0 {
+					t.Errorf("thread t%d: got labels %v, want none", i, got)
+				}
+			}
+		})
+	}
+}
+
+func TestThreadPoolError(t *testing.T) {
+	const nthreads = 1000
+
+	var (
+		ctx     = context.Background()
+		mb      = NewMemMailbox()
+		errGet  = errors.New("get failed")
+		fetched int32
+	)
+
+	for i := 0; i < nthreads; i++ {
+		mb.AddThread(&Thread{ID: fmt.Sprintf("t%d", i), Messages: []*Message{{
+			ID:      fmt.Sprintf("m%d", i),
+			Headers: []Header{{Name: "From", Value: "alice@example.com"}},
+		}}})
+	}
+	mb.GetErr = func(threadID string) error {
+		atomic.AddInt32(&fetched, 1)
+		if threadID == "t233" { // in the second batch, in listing order
+			return errGet
+		}
+		return nil
+	}
+
+	index := newTierIndex([]*tier{
+		{labelID: "contacts", contacts: []*Contact{{Addrs: []string{"alice@example.com"}}}},
+	}, nil)
+
+	nchanges, _, err := processThreads(ctx, mb, []string{""}, 1, time.Time{}, index, matchPolicy{})
+	if !errors.Is(err, errGet) {
+		t.Fatalf("got error %v, want %v", err, errGet)
+	}
+	if n := atomic.LoadInt32(&fetched); n >= nthreads {
+		t.Errorf("fetched all %d threads despite the error", n)
+	}
+
+	// Changes decided before the error were still applied.
+	if nchanges == 0 {
+		t.Error("got no changes")
+	}
+	if got := mb.Thread("t0").Messages[0].LabelIDs; !sameStrings(got, []string{"contacts"}) {
+		t.Errorf("thread t0: got labels %v, want [contacts]", got)
+	}
+}
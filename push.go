@@ -8,25 +8,18 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"net/mail"
 	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
-	"cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
-	"cloud.google.com/go/datastore"
 	"github.com/bobg/aesite"
 	"github.com/bobg/basexx"
 	"github.com/bobg/mid"
-	"github.com/golang/protobuf/ptypes/timestamp"
 	"github.com/pkg/errors"
 	"google.golang.org/api/gmail/v1"
-	"google.golang.org/api/googleapi"
 	"google.golang.org/api/option"
 	"google.golang.org/api/people/v1"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
 )
 
 // PushMessage is for parsing the message delivered by the gmail pubsub notification.
@@ -40,6 +33,10 @@ type PushMessage struct {
 // PushPayload is for parsing the content of PushMessage.Message.Data after decoding.
 type PushPayload struct {
 	Addr string `json:"emailAddress"`
+
+	// HistoryID is the ID of the latest record in the mailbox history.
+	// Gmail sends it as a number or as a string.
+	HistoryID json.Number `json:"historyId"`
 }
 
 // POST /push
@@ -80,10 +77,19 @@ func (s *Server) handlePush(_ http.ResponseWriter, req *http.Request) (err error
 		return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "JSON-decoding request payload")}
 	}
 
-	log.Printf("got push for %s", payload.Addr)
+	log.Printf("got push for %s (history %s)", payload.Addr, payload.HistoryID)
+
+	if historyID, err := strconv.ParseUint(payload.HistoryID.String(), 10, 64); err == nil {
+		var u user
+		err = s.store.lookupUser(req.Context(), payload.Addr, &u)
+		if err == nil && u.HistoryID > 0 && historyID <= uint64(u.HistoryID) {
+			log.Printf("ignoring push for %s: history %d already processed", payload.Addr, historyID)
+			return nil
+		}
+	}
 
 	err = s.queueUpdate(req.Context(), payload.Addr, msg.Date, false)
-	if errors.Is(err, datastore.ErrNoSuchEntity) {
+	if errors.Is(err, ErrNotFound) {
 		log.Printf("ignoring push for unknown user %s", payload.Addr)
 		return nil
 	}
@@ -111,7 +117,7 @@ func (s *Server) queueUpdate(ctx context.Context, email, date string, isCatchup
 		u    user
 		when time.Time
 	)
-	err := aesite.UpdateUser(ctx, s.dsClient, email, &u, func(*datastore.Transaction) error {
+	err := s.store.updateUser(ctx, email, &u, func() error {
 		if u.NextUpdate.After(now) {
 			when = u.NextUpdate
 		} else {
@@ -120,6 +126,10 @@ func (s *Server) queueUpdate(ctx context.Context, email, date string, isCatchup
 		}
 		return nil
 	})
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("not queueing update for unknown user %s", email)
+		return nil
+	}
 	if err != nil && !errors.Is(err, aesite.ErrUpdateConflict) { // OK to ignore ErrUpdateConflict
 		return errors.Wrapf(err, "getting user %s and updating next-update time", email)
 	}
@@ -128,36 +138,20 @@ func (s *Server) queueUpdate(ctx context.Context, email, date string, isCatchup
 		log.Printf("not queueing update for disabled user %s", email)
 		return nil
 	}
+	if u.Token == "" {
+		log.Printf("not queueing update for user %s, who has no token", email)
+		return nil
+	}
 
-	var (
-		secs  = when.Unix()
-		nanos = int32(when.UnixNano() % int64(time.Second))
-	)
-
-	_, err = s.ctClient.CreateTask(ctx, &cloudtaskspb.CreateTaskRequest{
-		Parent: s.queueName(),
-		Task: &cloudtaskspb.Task{
-			Name: s.taskName(email, when),
-			MessageType: &cloudtaskspb.Task_AppEngineHttpRequest{
-				AppEngineHttpRequest: &cloudtaskspb.AppEngineHttpRequest{
-					HttpMethod:  cloudtaskspb.HttpMethod_GET,
-					RelativeUri: s.taskURL(email, date, isCatchup),
-				},
-			},
-			ScheduleTime: &timestamp.Timestamp{
-				Seconds: secs,
-				Nanos:   nanos,
-			},
-		},
-	})
-	if status.Code(err) == codes.AlreadyExists {
+	err = s.tasks.Enqueue(ctx, taskName(email, when), s.taskURL(email, date, isCatchup), when)
+	if errors.Is(err, ErrTaskExists) {
 		log.Printf("deduped update task for %s at %s", email, when)
 		return nil
 	}
 	return errors.Wrapf(err, "enqueueing update task for %s at %s", email, when)
 }
 
-func (s *Server) taskName(email string, when time.Time) string {
+func taskName(email string, when time.Time) string {
 	hasher := sha256.New()
 	hasher.Write([]byte{1}) // version of this hash
 	fmt.Fprintf(hasher, "%s %s", email, when)
@@ -169,16 +163,11 @@ func (s *Server) taskName(email string, when time.Time) string {
 	if err != nil {
 		panic(err)
 	}
-	converted := dest.Written()
-	return fmt.Sprintf("%s/tasks/%s", s.queueName(), string(converted))
+	return string(dest.Written())
 }
 
 const queueName = "update"
 
-func (s *Server) queueName() string {
-	return fmt.Sprintf("projects/%s/locations/%s/queues/%s", s.projectID, s.locationID, queueName)
-}
-
 func (s *Server) taskURL(email, date string, isCatchup bool) string {
 	u, _ := url.Parse("/t/update")
 
@@ -195,6 +184,25 @@ func (s *Server) taskURL(email, date string, isCatchup bool) string {
 	return u.String()
 }
 
+// Returns a function telling whether a task URL
+// (from taskURL or cleanupTaskURL)
+// is for the given user.
+func isTaskFor(email string) func(string) bool {
+	return func(taskURL string) bool {
+		u, err := url.Parse(taskURL)
+		return err == nil && strings.HasPrefix(u.Path, "/t/") && strings.EqualFold(u.Query().Get("email"), email)
+	}
+}
+
+// Returns a function telling whether a task URL
+// is for an update (see taskURL) of the given user.
+func isUpdateTaskFor(email string) func(string) bool {
+	return func(taskURL string) bool {
+		u, err := url.Parse(taskURL)
+		return err == nil && u.Path == "/t/update" && strings.EqualFold(u.Query().Get("email"), email)
+	}
+}
+
 // GET/POST /t/update
 func (s *Server) handleUpdate(_ http.ResponseWriter, req *http.Request) (err error) {
 	defer func() {
@@ -214,20 +222,34 @@ func (s *Server) handleUpdate(_ http.ResponseWriter, req *http.Request) (err err
 }
 
 // Executes an update task.
-// This adds and removes labels for e-mail newer than `date` (default: one week ago)
-// for the user with address `email`.
+// This adds and removes labels for the user with address `email`
+// on e-mail from the given `date`,
+// or by default on e-mail that has arrived since the last update
+// (according to the mailbox history,
+// or, if that is unavailable, the time of the latest message seen, but no more than one week ago).
 //
 // If `isCatchup` is true, and changes were needed,
 // this is a signal that pubsub notifications have prematurely stopped arriving.
 // In that case we try to renew the pubsub subscription.
 //
 // This function updates the NextUpdate and LastUpdate times for the user.
-func (s *Server) doUpdate(ctx context.Context, email, date string, isCatchup bool) error {
+func (s *Server) doUpdate(ctx context.Context, email, date string, isCatchup bool) (err error) {
+	// If the user's OAuth grant turns out to be dead,
+	// the update has not failed in a way that retrying would fix.
+	defer func() {
+		if reason := revocation(err); reason != "" {
+			err = s.expireUser(ctx, email, reason)
+		}
+	}()
+
 	var (
 		now = time.Now()
 		u   user
 	)
-	err := aesite.UpdateUser(ctx, s.dsClient, email, &u, func(*datastore.Transaction) error {
+	err = s.store.updateUser(ctx, email, &u, func() error {
+		if u.WatchExpiry.IsZero() || u.Cleanup.running() {
+			return nil // see below
+		}
 		nextUpdate := now.Add(time.Minute)
 		if nextUpdate.After(u.NextUpdate) {
 			u.NextUpdate = nextUpdate
@@ -235,121 +257,167 @@ func (s *Server) doUpdate(ctx context.Context, email, date string, isCatchup boo
 		u.LastUpdate = now
 		return nil
 	})
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("not updating %s, who has been deleted", email)
+		return nil
+	}
 	if err != nil {
 		return errors.Wrapf(err, "setting NextUpdate and LastUpdate for %s", email)
 	}
 
-	oauthClient, err := s.oauthClient(ctx, &u) // xxx check for errNoToken
+	// An update queued before the user disabled Unclog
+	// must not relabel threads that a cleanup job has stripped.
+	if u.WatchExpiry.IsZero() {
+		log.Printf("not updating disabled user %s", email)
+		return nil
+	}
+	if u.Cleanup.running() {
+		log.Printf("not updating %s, whose labels are being cleaned up", email)
+		return nil
+	}
+
+	oauthClient, err := s.oauthClient(ctx, &u)
+	if errors.Is(err, errNoToken) {
+		log.Printf("not updating %s, who has no token", email)
+		return nil
+	}
 	if err != nil {
 		return errors.Wrap(err, "getting oauth client")
 	}
 
 	// Part 1: get user's contacts.
 
-	var starred, unstarred []*people.Person
-
 	peopleSvc, err := people.NewService(ctx, option.WithHTTPClient(oauthClient))
 	if err != nil {
 		return errors.Wrap(err, "allocating people service")
 	}
-	peopleConnSvc := people.NewPeopleConnectionsService(peopleSvc)
-	err = peopleConnSvc.List("people/me").PersonFields("emailAddresses,names,memberships").Pages(ctx, func(resp *people.ListConnectionsResponse) error {
-		for _, person := range resp.Connections {
-			var anyAddrs bool
-			for _, a := range person.EmailAddresses {
-				if a.Value != "" {
-					anyAddrs = true
-					break
-				}
-			}
-			if !anyAddrs {
-				continue
-			}
-			var isStarred bool
-			for _, m := range person.Memberships {
-				if m.ContactGroupMembership != nil && m.ContactGroupMembership.ContactGroupId == "starred" {
-					isStarred = true
-					break
-				}
-			}
-			if isStarred {
-				starred = append(starred, person)
-			} else {
-				unstarred = append(unstarred, person)
-			}
-		}
-		return nil
-	})
+	snap, err := s.getContactSnapshot(ctx, &u)
 	if err != nil {
-		return errors.Wrap(err, "listing connections")
+		return err
+	}
+	contacts, err := syncContacts(ctx, NewPeopleContactSource(peopleSvc), &u, snap)
+	if err != nil {
+		return errors.Wrap(err, "syncing contacts")
 	}
-
-	// Part 2: process messages in the right time range.
 
 	gmailSvc, err := gmail.NewService(ctx, option.WithHTTPClient(oauthClient))
 	if err != nil {
 		return errors.Wrap(err, "allocating gmail service")
 	}
-
-	var query string
-	if u.InboxOnly {
-		query = "in:inbox"
-	} else {
-		query = "-in:chats"
+	limits, err := s.getUpdateLimits(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting update limits")
 	}
-	if date != "" {
-		d, err := ParseDate(date)
+	lim, release := s.userLimiter(email, limits)
+	defer release()
+	mp := newLimitedProvider(NewGmailProvider(gmailSvc, oauthClient), lim)
+
+	if u.CorrespondentsLookback > 0 {
+		err = refreshCorrespondents(ctx, mp, &u, snap, now)
 		if err != nil {
-			return errors.Wrap(err, "parsing date")
+			return errors.Wrap(err, "refreshing correspondents")
 		}
-		query += fmt.Sprintf(" after:%d/%02d/%02d", d.Y, d.M, d.D)
-		d = nextDate(d)
-		query += fmt.Sprintf(" before:%d/%02d/%02d", d.Y, d.M, d.D)
 	} else {
-		var (
-			oneWeekAgo = now.Add(-7 * 24 * time.Hour)
-			startTime  = u.LastThreadTime.Add(-5 * time.Second) // a little overlap, so nothing gets missed
-		)
-		if startTime.Before(oneWeekAgo) {
-			startTime = oneWeekAgo
-		}
-		query += fmt.Sprintf(" after:%d", startTime.Unix())
+		snap.forgetCorrespondents()
 	}
+	err = s.putContactSnapshot(ctx, email, snap)
+	if err != nil {
+		return err
+	}
+
+	tiers := u.labelTiers(contacts, snap.Correspondents)
+	index := newTierIndex(tiers, u.addrHasher())
+	policy := u.matchPolicy()
+
+	// Part 2: process new messages.
+	// Normally these are the ones added to the mailbox since the last update,
+	// according to the mailbox history.
+	// Failing that, or if a date is given, they are the ones found by searching in a time range.
 
 	var (
 		nchanges         int
-		latestThreadTime = u.LastThreadTime
+		latestThreadTime time.Time
+		historyID        uint64
+		searched         = true
 	)
 
-	err = gmailSvc.Users.Threads.List("me").Q(query).Pages(ctx, func(resp *gmail.ListThreadsResponse) error {
-		for _, thread := range resp.Threads {
-			threadTime, changed, err := handleThread(ctx, gmailSvc, thread.Id, u.StarredLabelID, u.ContactsLabelID, starred, unstarred)
+	if date == "" && u.HistoryID > 0 {
+		var labelID string
+		if u.InboxOnly {
+			labelID = "INBOX"
+		}
+		nchanges, latestThreadTime, historyID, err = processHistory(ctx, mp, uint64(u.HistoryID), labelID, limits.Workers, u.LastThreadTime, index, policy)
+		switch {
+		case errors.Is(err, ErrHistoryExpired):
+			log.Printf("history %d for %s has expired, searching instead", u.HistoryID, email)
+		case err != nil:
+			return errors.Wrap(err, "processing history")
+		default:
+			searched = false
+		}
+	}
+
+	if searched {
+		if date == "" {
+			// Get this before searching,
+			// so the next update's history covers anything that arrives during the search.
+			historyID, err = mp.CurrentHistoryID(ctx)
+			if err != nil {
+				return errors.Wrap(err, "getting current history ID")
+			}
+		}
+
+		var query string
+		if u.InboxOnly {
+			query = "in:inbox"
+		} else {
+			query = "-in:chats"
+		}
+		if date != "" {
+			d, err := ParseDate(date)
 			if err != nil {
-				return errors.Wrapf(err, "handling thread %s", thread.Id)
+				return errors.Wrap(err, "parsing date")
 			}
-			if changed {
-				nchanges++
+			query += fmt.Sprintf(" after:%d/%02d/%02d", d.Y, d.M, d.D)
+			d = nextDate(d)
+			query += fmt.Sprintf(" before:%d/%02d/%02d", d.Y, d.M, d.D)
+		} else {
+			var (
+				oneWeekAgo = now.Add(-7 * 24 * time.Hour)
+				startTime  = u.LastThreadTime.Add(-5 * time.Second) // a little overlap, so nothing gets missed
+			)
+			if startTime.Before(oneWeekAgo) {
+				startTime = oneWeekAgo
 			}
-			if threadTime.After(latestThreadTime) {
-				latestThreadTime = threadTime
+			query += fmt.Sprintf(" after:%d", startTime.Unix())
+		}
+
+		queries := []string{query}
+		if u.ScanStrategy == scanPlanned {
+			if planned, ok := planQueries(query, tiers, index, policy); ok {
+				queries = planned
 			}
 		}
-		return nil
-	})
-	if err != nil {
-		return errors.Wrap(err, "processing latest threads")
+
+		nchanges, latestThreadTime, err = processThreads(ctx, mp, queries, limits.Workers, u.LastThreadTime, index, policy)
+		if err != nil {
+			return errors.Wrap(err, "processing latest threads")
+		}
 	}
 
-	if latestThreadTime.After(u.LastThreadTime) {
-		err = aesite.UpdateUser(ctx, s.dsClient, email, &u, func(*datastore.Transaction) error {
-			// Recheck the outer condition to prevent races.
+	if latestThreadTime.After(u.LastThreadTime) || historyID > uint64(u.HistoryID) {
+		err = s.store.updateUser(ctx, email, &u, func() error {
+			// Recheck the outer conditions to prevent races.
 			if latestThreadTime.After(u.LastThreadTime) {
 				u.LastThreadTime = latestThreadTime
 			}
+			if historyID > uint64(u.HistoryID) {
+				u.HistoryID = int64(historyID)
+			}
 			return nil
 		})
 		if err != nil && !errors.Is(err, aesite.ErrUpdateConflict) { // OK to ignore ErrUpdateConflict
-			return errors.Wrapf(err, "updating LastThreadTime for %s", email)
+			return errors.Wrapf(err, "updating LastThreadTime and HistoryID for %s", email)
 		}
 	}
 
@@ -367,105 +435,94 @@ func (s *Server) doUpdate(ctx context.Context, email, date string, isCatchup boo
 	return nil
 }
 
-// Add/remove labels on the messages in a given thread.
-// Returns the timestamp of the latest message in the thread
-// and a boolean telling whether any change was made.
-func handleThread(ctx context.Context, gmailSvc *gmail.Service, threadID string, starredLabelID, unstarredLabelID string, starred, unstarred []*people.Person) (time.Time, bool, error) {
-	var threadTime time.Time
-
-	thread, err := gmailSvc.Users.Threads.Get("me", threadID).Format("metadata").MetadataHeaders("from").Do()
-	if err != nil {
-		return threadTime, false, errors.Wrap(err, "getting thread members")
+// Add/remove labels on the threads matching any of the queries,
+// using the given number of concurrent workers.
+// Returns the number of threads changed
+// and the later of latestThreadTime and the timestamp of the latest message seen.
+func processThreads(ctx context.Context, mp MailProvider, queries []string, workers int, latestThreadTime time.Time, index *tierIndex, policy matchPolicy) (int, time.Time, error) {
+	p := newThreadPool(ctx, mp, workers, index, policy, latestThreadTime)
+	var err error
+	for _, query := range queries {
+		if err = mp.ListThreads(p.ctx, query, p.page); err != nil {
+			err = errors.Wrapf(err, "listing threads matching %s", query)
+			break
+		}
 	}
+	return p.wait(err)
+}
 
+// Add/remove labels on the threads with messages added since the mailbox history record startHistoryID
+// (see MailProvider.History),
+// using the given number of concurrent workers.
+// Returns the number of threads changed,
+// the later of latestThreadTime and the timestamp of the latest message seen,
+// and the ID of the latest history record.
+func processHistory(ctx context.Context, mp MailProvider, startHistoryID uint64, labelID string, workers int, latestThreadTime time.Time, index *tierIndex, policy matchPolicy) (int, time.Time, uint64, error) {
+	p := newThreadPool(ctx, mp, workers, index, policy, latestThreadTime)
+	historyID, err := mp.History(p.ctx, startHistoryID, labelID, p.page)
+	nchanges, latestThreadTime, err := p.wait(err)
+	return nchanges, latestThreadTime, historyID, err
+}
+
+// Decide which labels to add to and remove from the messages in a thread,
+// adding the change, if any, to b.
+// The thread should include the headers named in the policy.
+// The thread should carry the label of the highest-precedence tier
+// (the earliest in index) of any of its senders,
+// and none of the other tiers' labels.
+// The policy says which messages and headers identify the thread's senders.
+// Returns the timestamp of the latest message in the thread
+// and a boolean telling whether any change is needed.
+func handleThread(ctx context.Context, b *labelBatcher, thread *Thread, index *tierIndex, policy matchPolicy) (time.Time, bool) {
 	var (
-		starredAddr, unstarredAddr   string
-		foundStarred, foundUnstarred bool
+		threadTime time.Time
+		best       = -1                    // tier index of the best sender found
+		found      = make(map[string]bool) // tier label IDs found on the thread
 	)
 
 	for _, msg := range thread.Messages {
-		msgTime := timeFromMillis(msg.InternalDate)
-		if msgTime.After(threadTime) {
-			threadTime = msgTime
-		}
-		if !foundStarred || !foundUnstarred {
-			for _, labelID := range msg.LabelIds {
-				switch labelID {
-				case starredLabelID:
-					foundStarred = true
-				case unstarredLabelID:
-					foundUnstarred = true
-				}
-			}
+		if msg.Time.After(threadTime) {
+			threadTime = msg.Time
 		}
-		if starredAddr != "" {
-			// No need to keep looking for addresses,
-			// but do keep iterating over messages
-			// to get accurate values for threadTime,
-			// foundStarred, and foundUnstarred.
-			continue
-		}
-		for _, header := range msg.Payload.Headers {
-			if !strings.EqualFold(header.Name, "From") {
-				continue
-			}
-			parsed, err := mail.ParseAddress(header.Value)
-			if err != nil {
-				log.Printf("skipping message with unparseable From address %s: %s", header.Value, err)
-				continue
-			}
-			if addrIn(parsed.Address, starred) {
-				starredAddr = parsed.Address
-			} else if addrIn(parsed.Address, unstarred) {
-				unstarredAddr = parsed.Address
-			}
-			break
+		for _, labelID := range msg.LabelIDs {
+			found[labelID] = true
 		}
 	}
 
-	var req *gmail.ModifyThreadRequest
-
-	if starredAddr != "" {
-		if !foundStarred {
-			req = &gmail.ModifyThreadRequest{
-				AddLabelIds:    []string{starredLabelID},
-				RemoveLabelIds: []string{unstarredLabelID},
-			}
-		}
-	} else if unstarredAddr != "" {
-		if !foundUnstarred {
-			req = &gmail.ModifyThreadRequest{
-				AddLabelIds:    []string{unstarredLabelID},
-				RemoveLabelIds: []string{starredLabelID},
+SENDERS:
+	for _, msg := range policy.senderMessages(thread) {
+		for _, addr := range policy.senderAddrs(msg) {
+			if i := index.lookup(addr); i >= 0 && (best < 0 || i < best) {
+				best = i
+				if best == 0 {
+					break SENDERS // can't do better
+				}
 			}
 		}
-	} else if foundStarred || foundUnstarred {
-		// Thread is labeled but should not be.
-		// (Maybe someone was removed from the user's contacts?)
-		req = &gmail.ModifyThreadRequest{
-			RemoveLabelIds: []string{starredLabelID, unstarredLabelID},
-		}
 	}
 
-	var change bool
-	if req != nil {
-		_, err = gmailSvc.Users.Threads.Modify("me", threadID, req).Do()
-		if err != nil && !googleapi.IsNotModified(err) {
-			return threadTime, false, errors.Wrap(err, "updating thread")
+	// If best < 0, the thread should have none of the tier labels.
+	// (Maybe someone was removed from the user's contacts?)
+	var add, remove []string
+	for i, labelID := range index.labelIDs {
+		if i == best {
+			if !found[labelID] {
+				add = append(add, labelID)
+			}
+		} else if found[labelID] {
+			remove = append(remove, labelID)
 		}
-		change = true
 	}
 
-	return threadTime, change, nil
-}
+	if len(add) == 0 && len(remove) == 0 {
+		return threadTime, false
+	}
 
-func addrIn(addr string, persons []*people.Person) bool {
-	for _, person := range persons {
-		for _, personAddr := range person.EmailAddresses {
-			if strings.EqualFold(addr, personAddr.Value) {
-				return true
-			}
-		}
+	ch := &labelChange{threadID: thread.ID, add: add, remove: remove}
+	for _, msg := range thread.Messages {
+		ch.messageIDs = append(ch.messageIDs, msg.ID)
 	}
-	return false
+	b.add(ctx, ch)
+
+	return threadTime, true
 }
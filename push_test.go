@@ -0,0 +1,320 @@
+package unclog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func TestProcessThreads(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		mb   = NewMemMailbox()
+		base = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	contactsLabel, err := mb.CreateLabel(ctx, "✔")
+	if err != nil {
+		t.Fatal(err)
+	}
+	starredLabel, err := mb.CreateLabel(ctx, "✔/★")
+	if err != nil {
+		t.Fatal(err)
+	}
+	familyLabel, err := mb.CreateLabel(ctx, "✔/Family")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u := &user{
+		ContactsLabelID: contactsLabel.ID,
+		StarredLabelID:  starredLabel.ID,
+		GroupLabels:     []groupLabel{{GroupID: "family", Name: "✔/Family", LabelID: familyLabel.ID}},
+		AllowRules: []allowRule{
+			{Domain: "ourcompany.com"},
+			{Domain: "*.partner.org"},
+			{Domain: "boss.example", Starred: true},
+			{Domain: "xn--bcher-kva.example"},
+		},
+	}
+	index := newTierIndex(u.labelTiers([]*Contact{
+		{Addrs: []string{"alice@example.com"}, Groups: []string{"starred", "family"}},
+		{Addrs: []string{"bob@example.com"}},
+		{Addrs: []string{"erin@example.com"}, Groups: []string{"family"}},
+		{Addrs: []string{"zed@gmail.com"}},
+	}, nil), nil)
+
+	cases := []struct {
+		id         string
+		from       []string
+		labels     []string
+		wantLabels []string
+		wantChange bool
+	}{{
+		id:         "starred-unlabeled",
+		from:       []string{"Alice <alice@example.com>"},
+		wantLabels: []string{starredLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "starred-case",
+		from:       []string{"ALICE@EXAMPLE.COM"},
+		labels:     []string{"INBOX"},
+		wantLabels: []string{"INBOX", starredLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "starred-labeled",
+		from:       []string{"alice@example.com"},
+		labels:     []string{starredLabel.ID},
+		wantLabels: []string{starredLabel.ID},
+	}, {
+		id:         "starred-was-contact",
+		from:       []string{"alice@example.com"},
+		labels:     []string{contactsLabel.ID},
+		wantLabels: []string{starredLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "contact-unlabeled",
+		from:       []string{"Bob <bob@example.com>"},
+		wantLabels: []string{contactsLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "contact-was-starred",
+		from:       []string{"bob@example.com"},
+		labels:     []string{"INBOX", starredLabel.ID},
+		wantLabels: []string{"INBOX", contactsLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "contact-labeled",
+		from:       []string{"bob@example.com"},
+		labels:     []string{contactsLabel.ID},
+		wantLabels: []string{contactsLabel.ID},
+	}, {
+		id:         "stranger-labeled",
+		from:       []string{"carol@example.com"},
+		labels:     []string{"INBOX", contactsLabel.ID},
+		wantLabels: []string{"INBOX"},
+		wantChange: true,
+	}, {
+		id:         "stranger-unlabeled",
+		from:       []string{"carol@example.com"},
+		labels:     []string{"INBOX"},
+		wantLabels: []string{"INBOX"},
+	}, {
+		id:         "family-unlabeled",
+		from:       []string{"erin@example.com"},
+		wantLabels: []string{familyLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "family-and-contact",
+		from:       []string{"bob@example.com", "erin@example.com"},
+		labels:     []string{contactsLabel.ID},
+		wantLabels: []string{familyLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "family-and-starred",
+		from:       []string{"erin@example.com", "alice@example.com"},
+		labels:     []string{familyLabel.ID},
+		wantLabels: []string{starredLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "starred-with-extra-labels",
+		from:       []string{"alice@example.com"},
+		labels:     []string{starredLabel.ID, contactsLabel.ID, familyLabel.ID},
+		wantLabels: []string{starredLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "domain-rule",
+		from:       []string{"Frank <frank@OurCompany.com>"},
+		wantLabels: []string{contactsLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "wildcard-rule",
+		from:       []string{"gina@mail.partner.org"},
+		wantLabels: []string{contactsLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "wildcard-rule-bare-domain",
+		from:       []string{"hank@partner.org"},
+		labels:     []string{contactsLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "starred-rule",
+		from:       []string{"ida@boss.example"},
+		labels:     []string{contactsLabel.ID},
+		wantLabels: []string{starredLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "family-and-domain-rule",
+		from:       []string{"frank@ourcompany.com", "erin@example.com"},
+		wantLabels: []string{familyLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "gmail-variant",
+		from:       []string{"Zed <Z.E.D+news@googlemail.com>"},
+		wantLabels: []string{contactsLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "idn-domain-rule",
+		from:       []string{"jo@xn--bcher-kva.example"},
+		wantLabels: []string{contactsLabel.ID},
+		wantChange: true,
+	}, {
+		id:         "unparseable",
+		from:       []string{"not an address"},
+		labels:     []string{starredLabel.ID},
+		wantChange: true,
+	}}
+
+	var latestWant time.Time
+	for i, c := range cases {
+		thread := &Thread{ID: c.id}
+		for j, from := range c.from {
+			msgTime := base.Add(time.Duration(i)*time.Minute + time.Duration(j)*time.Second)
+			thread.Messages = append(thread.Messages, &Message{
+				ID:       fmt.Sprintf("%s-%d", c.id, j),
+				Time:     msgTime,
+				LabelIDs: c.labels,
+				Headers: []Header{
+					{Name: "Subject", Value: "hello"},
+					{Name: "From", Value: from},
+				},
+			})
+			latestWant = msgTime
+		}
+		mb.AddThread(thread)
+	}
+
+	mb.PageSize = 3
+
+	nchanges, latest, err := processThreads(ctx, mb, []string{""}, 4, base, index, matchPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wantChanges int
+	for _, c := range cases {
+		if c.wantChange {
+			wantChanges++
+		}
+	}
+	if nchanges != wantChanges {
+		t.Errorf("got %d changes, want %d", nchanges, wantChanges)
+	}
+	if !latest.Equal(latestWant) {
+		t.Errorf("got latest thread time %s, want %s", latest, latestWant)
+	}
+
+	for _, c := range cases {
+		t.Run(c.id, func(t *testing.T) {
+			thread := mb.Thread(c.id)
+			for _, msg := range thread.Messages {
+				if !sameStrings(msg.LabelIDs, c.wantLabels) {
+					t.Errorf("message %s: got labels %v, want %v", msg.ID, msg.LabelIDs, c.wantLabels)
+				}
+			}
+			if changed := mb.Modifications(c.id) > 0; changed != c.wantChange {
+				t.Errorf("got change %v, want %v", changed, c.wantChange)
+			}
+		})
+	}
+}
+
+func TestProcessHistory(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		mb   = NewMemMailbox()
+		base = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	)
+
+	index := newTierIndex([]*tier{
+		{labelID: "contacts", contacts: []*Contact{{Addrs: []string{"bob@example.com"}}}},
+	}, nil)
+
+	add := func(id, from string, minutes int, labels ...string) {
+		mb.AddThread(&Thread{ID: id, Messages: []*Message{{
+			ID:       id,
+			Time:     base.Add(time.Duration(minutes) * time.Minute),
+			LabelIDs: labels,
+			Headers:  []Header{{Name: "From", Value: from}},
+		}}})
+	}
+
+	add("old", "bob@example.com", 0, "INBOX")
+	start, err := mb.CurrentHistoryID(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	add("new1", "bob@example.com", 1, "INBOX")
+	add("new2", "carol@example.com", 2, "INBOX")
+	add("archived", "bob@example.com", 3)
+
+	nchanges, latest, historyID, err := processHistory(ctx, mb, start, "INBOX", 4, base, index, matchPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nchanges != 1 {
+		t.Errorf("got %d changes, want 1", nchanges)
+	}
+	if want := base.Add(2 * time.Minute); !latest.Equal(want) {
+		t.Errorf("got latest thread time %s, want %s", latest, want)
+	}
+	if want := start + 3; historyID != want {
+		t.Errorf("got history ID %d, want %d", historyID, want)
+	}
+	for id, want := range map[string]int{"old": 0, "new1": 1, "new2": 0, "archived": 0} {
+		if got := mb.Modifications(id); got != want {
+			t.Errorf("thread %s: got %d modifications, want %d", id, got, want)
+		}
+	}
+
+	// Nothing new since the last call.
+	nchanges, _, historyID2, err := processHistory(ctx, mb, historyID, "", 4, base, index, matchPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nchanges != 0 || historyID2 != historyID {
+		t.Errorf("got %d changes and history ID %d, want 0 and %d", nchanges, historyID2, historyID)
+	}
+
+	mb.ExpireHistory()
+	_, _, _, err = processHistory(ctx, mb, start, "", 4, base, index, matchPolicy{})
+	if !errors.Is(err, ErrHistoryExpired) {
+		t.Errorf("got error %v, want ErrHistoryExpired", err)
+	}
+}
+
+func TestPushPayload(t *testing.T) {
+	for _, data := range []string{
+		`{"emailAddress": "user@example.com", "historyId": "9876543210"}`,
+		`{"emailAddress": "user@example.com", "historyId": 9876543210}`,
+	} {
+		var payload PushPayload
+		if err := json.Unmarshal([]byte(data), &payload); err != nil {
+			t.Fatal(err)
+		}
+		if payload.Addr != "user@example.com" || payload.HistoryID.String() != "9876543210" {
+			t.Errorf("got %+v from %s", payload, data)
+		}
+	}
+}
+
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,331 @@
+package unclog
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// defaultQuotaRate is the default number of Gmail API quota units
+	// an update may spend per second for one user.
+	// Gmail allows 250 per user per second
+	// (https://developers.google.com/gmail/api/reference/quota),
+	// which also has to cover what the user's mail clients spend.
+	defaultQuotaRate = 200
+
+	// defaultUpdateWorkers is the default number of batches of threads
+	// an update fetches and labels concurrently.
+	defaultUpdateWorkers = 4
+)
+
+// Gmail API quota units consumed by each call.
+// See https://developers.google.com/gmail/api/reference/quota.
+// A batch request costs the sum of the requests it contains.
+const (
+	quotaGetProfile     = 1
+	quotaHistoryList    = 2
+	quotaLabelsList     = 1
+	quotaLabelsCreate   = 5
+	quotaLabelsPatch    = 5
+	quotaLabelsDelete   = 5
+	quotaThreadsGet     = 10
+	quotaThreadsList    = 10
+	quotaThreadsModify  = 10
+	quotaMessagesModify = 50 // messages.batchModify
+)
+
+// updateLimits control how hard an update may work the Gmail API.
+type updateLimits struct {
+	// Workers is the number of batches of threads fetched and labeled concurrently.
+	Workers int
+
+	// QuotaRate is the number of Gmail API quota units per second
+	// that updates may spend for one user.
+	QuotaRate int
+}
+
+// Read the update limits from the settings
+// "update-workers" and "gmail-quota-rate",
+// using defaults for any that are missing.
+// The result is cached for settingsTTL.
+// Refreshing the cache also evicts idle rate limiters (see Server.userLimiter).
+func (s *Server) getUpdateLimits(ctx context.Context) (updateLimits, error) {
+	s.mu.Lock()
+	if s.limits != nil && time.Since(s.limitsTime) < settingsTTL {
+		limits := *s.limits
+		s.mu.Unlock()
+		return limits, nil
+	}
+	s.mu.Unlock()
+
+	// Read the settings without holding s.mu,
+	// which would block everything else needing it.
+	// Concurrent callers may each read them; the last one's result is cached.
+	limits := updateLimits{
+		Workers:   defaultUpdateWorkers,
+		QuotaRate: defaultQuotaRate,
+	}
+	for _, setting := range []struct {
+		name string
+		val  *int
+	}{
+		{"update-workers", &limits.Workers},
+		{"gmail-quota-rate", &limits.QuotaRate},
+	} {
+		b, err := s.store.GetSetting(ctx, setting.name)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return limits, errors.Wrapf(err, "getting setting %s", setting.name)
+		}
+		n, err := strconv.Atoi(string(b))
+		if err != nil {
+			return limits, errors.Wrapf(err, "parsing setting %s", setting.name)
+		}
+		if n < 1 {
+			return limits, errors.Errorf("setting %s is %d, must be at least 1", setting.name, n)
+		}
+		*setting.val = n
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.limits = &limits
+	s.limitsTime = now
+	s.evictLimiters(now)
+	return limits, nil
+}
+
+// userLimiterEntry is an element of Server.limiters.
+type userLimiterEntry struct {
+	lim  *rate.Limiter
+	refs int       // number of callers of Server.userLimiter that have not released it
+	idle time.Time // when refs last dropped to zero
+}
+
+// Returns the rate limiter for Gmail API calls on behalf of the given user,
+// creating it if necessary,
+// and setting its rate to limits.QuotaRate if that has changed.
+// Its tokens are quota units.
+// It is shared by all updates for the user in this server instance.
+// The caller must call the returned release function when done with it,
+// so that it can be evicted once idle (see Server.evictLimiters).
+func (s *Server) userLimiter(email string, limits updateLimits) (*rate.Limiter, func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.limiters[email]
+	if ok {
+		if e.lim.Burst() != limits.QuotaRate {
+			e.lim.SetLimit(rate.Limit(limits.QuotaRate))
+			e.lim.SetBurst(limits.QuotaRate)
+		}
+	} else {
+		if s.limiters == nil {
+			s.limiters = make(map[string]*userLimiterEntry)
+		}
+		e = &userLimiterEntry{lim: rate.NewLimiter(rate.Limit(limits.QuotaRate), limits.QuotaRate)}
+		s.limiters[email] = e
+	}
+	e.refs++
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			e.refs--
+			if e.refs == 0 {
+				e.idle = time.Now()
+			}
+		})
+	}
+	return e.lim, release
+}
+
+// Removes from s.limiters the limiters no one has used for settingsTTL.
+// By then their buckets are full,
+// so a new limiter for the same user behaves the same.
+// Caller must hold s.mu.
+func (s *Server) evictLimiters(now time.Time) {
+	for email, e := range s.limiters {
+		if e.refs == 0 && now.Sub(e.idle) >= settingsTTL {
+			delete(s.limiters, email)
+		}
+	}
+}
+
+// limitedProvider is a MailProvider that waits on a token-bucket rate limiter,
+// for the number of quota units each call costs,
+// before calling the MailProvider it wraps.
+type limitedProvider struct {
+	mp  MailProvider
+	lim *rate.Limiter
+}
+
+var _ MailProvider = &limitedProvider{}
+
+func newLimitedProvider(mp MailProvider, lim *rate.Limiter) *limitedProvider {
+	return &limitedProvider{mp: mp, lim: lim}
+}
+
+// Waits until the limiter allows spending n quota units.
+// Waits longer than the limiter's burst size are taken in burst-sized pieces.
+func (l *limitedProvider) wait(ctx context.Context, n int) error {
+	burst := l.lim.Burst()
+	for n > 0 {
+		m := n
+		if m > burst {
+			m = burst
+		}
+		if err := l.lim.WaitN(ctx, m); err != nil {
+			return errors.Wrap(err, "waiting for rate limiter")
+		}
+		n -= m
+	}
+	return nil
+}
+
+// ListThreads implements MailProvider.ListThreads.
+// Each page costs one threads.list call.
+func (l *limitedProvider) ListThreads(ctx context.Context, q string, f func([]string) error) error {
+	if err := l.wait(ctx, quotaThreadsList); err != nil {
+		return err
+	}
+	return l.mp.ListThreads(ctx, q, func(threadIDs []string) error {
+		if err := f(threadIDs); err != nil {
+			return err
+		}
+		return l.wait(ctx, quotaThreadsList) // for the next page
+	})
+}
+
+// LabelThreads implements MailProvider.LabelThreads.
+// Each page costs one threads.list call.
+func (l *limitedProvider) LabelThreads(ctx context.Context, labelID string, f func([]string) error) error {
+	if err := l.wait(ctx, quotaThreadsList); err != nil {
+		return err
+	}
+	return l.mp.LabelThreads(ctx, labelID, func(threadIDs []string) error {
+		if err := f(threadIDs); err != nil {
+			return err
+		}
+		return l.wait(ctx, quotaThreadsList) // for the next page
+	})
+}
+
+// GetThread implements MailProvider.GetThread.
+func (l *limitedProvider) GetThread(ctx context.Context, threadID string, headers ...string) (*Thread, error) {
+	if err := l.wait(ctx, quotaThreadsGet); err != nil {
+		return nil, err
+	}
+	return l.mp.GetThread(ctx, threadID, headers...)
+}
+
+// GetThreads implements MailProvider.GetThreads.
+// If the wrapped provider fetches threads in batches (see batchThreadGetter),
+// the batches are charged after they return,
+// and only for the threads they produced.
+// Threads the batches fail to produce
+// (typically because Gmail is rate-limiting)
+// are fetched one at a time through l.GetThread,
+// which charges for them then.
+func (l *limitedProvider) GetThreads(ctx context.Context, threadIDs []string, headers ...string) ([]*Thread, error) {
+	if b, ok := l.mp.(batchThreadGetter); ok {
+		result := b.batchThreads(ctx, threadIDs, headers...)
+		var n int
+		for _, thread := range result {
+			if thread != nil {
+				n++
+			}
+		}
+		if err := l.wait(ctx, n*quotaThreadsGet); err != nil {
+			return nil, err
+		}
+		return getMissingThreads(ctx, l, threadIDs, result, headers...)
+	}
+
+	if err := l.wait(ctx, len(threadIDs)*quotaThreadsGet); err != nil {
+		return nil, err
+	}
+	return l.mp.GetThreads(ctx, threadIDs, headers...)
+}
+
+// ModifyThread implements MailProvider.ModifyThread.
+func (l *limitedProvider) ModifyThread(ctx context.Context, threadID string, add, remove []string) error {
+	if err := l.wait(ctx, quotaThreadsModify); err != nil {
+		return err
+	}
+	return l.mp.ModifyThread(ctx, threadID, add, remove)
+}
+
+// BatchModify implements MailProvider.BatchModify.
+func (l *limitedProvider) BatchModify(ctx context.Context, messageIDs, add, remove []string) error {
+	if err := l.wait(ctx, quotaMessagesModify); err != nil {
+		return err
+	}
+	return l.mp.BatchModify(ctx, messageIDs, add, remove)
+}
+
+// Labels implements MailProvider.Labels.
+func (l *limitedProvider) Labels(ctx context.Context) ([]*Label, error) {
+	if err := l.wait(ctx, quotaLabelsList); err != nil {
+		return nil, err
+	}
+	return l.mp.Labels(ctx)
+}
+
+// CreateLabel implements MailProvider.CreateLabel.
+func (l *limitedProvider) CreateLabel(ctx context.Context, name string) (*Label, error) {
+	if err := l.wait(ctx, quotaLabelsCreate); err != nil {
+		return nil, err
+	}
+	return l.mp.CreateLabel(ctx, name)
+}
+
+// RenameLabel implements MailProvider.RenameLabel.
+func (l *limitedProvider) RenameLabel(ctx context.Context, labelID, name string) error {
+	if err := l.wait(ctx, quotaLabelsPatch); err != nil {
+		return err
+	}
+	return l.mp.RenameLabel(ctx, labelID, name)
+}
+
+// DeleteLabel implements MailProvider.DeleteLabel.
+func (l *limitedProvider) DeleteLabel(ctx context.Context, labelID string) error {
+	if err := l.wait(ctx, quotaLabelsDelete); err != nil {
+		return err
+	}
+	return l.mp.DeleteLabel(ctx, labelID)
+}
+
+// History implements MailProvider.History.
+// Each page costs one history.list call.
+func (l *limitedProvider) History(ctx context.Context, startHistoryID uint64, labelID string, f func([]string) error) (uint64, error) {
+	if err := l.wait(ctx, quotaHistoryList); err != nil {
+		return 0, err
+	}
+	return l.mp.History(ctx, startHistoryID, labelID, func(threadIDs []string) error {
+		if err := f(threadIDs); err != nil {
+			return err
+		}
+		return l.wait(ctx, quotaHistoryList) // for the next page
+	})
+}
+
+// CurrentHistoryID implements MailProvider.CurrentHistoryID.
+func (l *limitedProvider) CurrentHistoryID(ctx context.Context) (uint64, error) {
+	if err := l.wait(ctx, quotaGetProfile); err != nil {
+		return 0, err
+	}
+	return l.mp.CurrentHistoryID(ctx)
+}
@@ -0,0 +1,141 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+func TestGetUpdateLimits(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	s := newServer(bs, nil, "")
+	limits, err := s.getUpdateLimits(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.Workers != defaultUpdateWorkers || limits.QuotaRate != defaultQuotaRate {
+		t.Errorf("got %+v, want defaults", limits)
+	}
+
+	if err = bs.SetSetting(ctx, "update-workers", []byte("16")); err != nil {
+		t.Fatal(err)
+	}
+	s = newServer(bs, nil, "")
+	limits, err = s.getUpdateLimits(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.Workers != 16 || limits.QuotaRate != defaultQuotaRate {
+		t.Errorf("got %+v, want 16 workers and the default quota rate", limits)
+	}
+
+	// Running servers pick up changes once the cached limits expire.
+	if err = bs.SetSetting(ctx, "gmail-quota-rate", []byte("50")); err != nil {
+		t.Fatal(err)
+	}
+	lim, release := s.userLimiter("a@example.com", limits)
+	defer release()
+	if limits, err = s.getUpdateLimits(ctx); err != nil {
+		t.Fatal(err)
+	} else if limits.QuotaRate != defaultQuotaRate {
+		t.Errorf("got quota rate %d before the cache expired, want %d", limits.QuotaRate, defaultQuotaRate)
+	}
+	s.mu.Lock()
+	s.limitsTime = time.Now().Add(-settingsTTL)
+	s.mu.Unlock()
+	if limits, err = s.getUpdateLimits(ctx); err != nil {
+		t.Fatal(err)
+	} else if limits.QuotaRate != 50 {
+		t.Errorf("got quota rate %d after the cache expired, want 50", limits.QuotaRate)
+	}
+	if lim2, release2 := s.userLimiter("a@example.com", limits); lim2 != lim || lim.Limit() != 50 || lim.Burst() != 50 {
+		t.Errorf("got limiter with rate %v and burst %d, want the same limiter at 50", lim.Limit(), lim.Burst())
+	} else {
+		release2()
+	}
+
+	limB, releaseB := s.userLimiter("b@example.com", limits)
+	if limB == lim {
+		t.Error("got the same limiter for different users")
+	}
+	releaseB()
+
+	// Refreshing the cached limits evicts limiters idle for settingsTTL,
+	// but not those still in use.
+	s.mu.Lock()
+	s.limiters["b@example.com"].idle = time.Now().Add(-settingsTTL)
+	s.limitsTime = time.Now().Add(-settingsTTL)
+	s.mu.Unlock()
+	if _, err = s.getUpdateLimits(ctx); err != nil {
+		t.Fatal(err)
+	}
+	s.mu.Lock()
+	_, okA := s.limiters["a@example.com"]
+	_, okB := s.limiters["b@example.com"]
+	s.mu.Unlock()
+	if !okA {
+		t.Error("limiter in use was evicted")
+	}
+	if okB {
+		t.Error("idle limiter was not evicted")
+	}
+
+	for _, bad := range []string{"0", "x"} {
+		if err = bs.SetSetting(ctx, "gmail-quota-rate", []byte(bad)); err != nil {
+			t.Fatal(err)
+		}
+		s = newServer(bs, nil, "")
+		if _, err = s.getUpdateLimits(ctx); err == nil {
+			t.Errorf("got no error for gmail-quota-rate %q", bad)
+		}
+	}
+}
+
+func TestLimitedProvider(t *testing.T) {
+	var (
+		ctx       = context.Background()
+		mb        = NewMemMailbox()
+		threadIDs []string
+	)
+	for i := 0; i < 30; i++ {
+		id := fmt.Sprintf("t%d", i)
+		mb.AddThread(&Thread{ID: id})
+		threadIDs = append(threadIDs, id)
+	}
+
+	// 30 threads cost 300 quota units.
+	// Starting with a full bucket of 100,
+	// the other 200 take 200ms at 1000 per second,
+	// and must be taken in pieces no bigger than the burst size.
+	lim := rate.NewLimiter(1000, 100)
+	lp := newLimitedProvider(mb, lim)
+
+	start := time.Now()
+	threads, err := lp.GetThreads(ctx, threadIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(threads) != len(threadIDs) {
+		t.Errorf("got %d threads, want %d", len(threads), len(threadIDs))
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("took %s, want at least 150ms", elapsed)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err = lp.GetThreads(ctx, threadIDs); err == nil {
+		t.Error("got no error waiting with a canceled context")
+	}
+}
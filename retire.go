@@ -0,0 +1,195 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/bobg/mid"
+	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+)
+
+// Returns the labels of u's labeling tiers (see user.managedLabels)
+// that have been created.
+func (u *user) tierLabels() []Label {
+	var result []Label
+	for _, ml := range u.managedLabels() {
+		if *ml.id != "" {
+			result = append(result, Label{ID: *ml.id, Name: ml.name})
+		}
+	}
+	return result
+}
+
+// Records as retired (see user.RetiredLabels)
+// those of the labels in prev that no longer belong to any of u's labeling tiers,
+// e.g. because the user has removed a group mapping or turned off correspondents.
+// Retired labels that belong to a tier again are no longer retired.
+// Reports whether any labels were newly retired,
+// in which case the caller should queue a strip task (see Server.queueStrip).
+func (u *user) retireLabels(prev []Label) bool {
+	active := make(map[string]bool)
+	for _, l := range u.tierLabels() {
+		active[l.ID] = true
+	}
+
+	var (
+		retired []Label
+		seen    = make(map[string]bool)
+	)
+	for _, l := range u.RetiredLabels {
+		if !active[l.ID] && !seen[l.ID] {
+			retired = append(retired, l)
+			seen[l.ID] = true
+		}
+	}
+
+	var added bool
+	for _, l := range prev {
+		if !active[l.ID] && !seen[l.ID] {
+			retired = append(retired, l)
+			seen[l.ID] = true
+			added = true
+		}
+	}
+
+	u.RetiredLabels = retired
+	return added
+}
+
+// Drops the labels with the given IDs from u.RetiredLabels,
+// once they have been stripped from all threads.
+func (u *user) dropRetired(ids map[string]bool) {
+	var kept []Label
+	for _, l := range u.RetiredLabels {
+		if !ids[l.ID] {
+			kept = append(kept, l)
+		}
+	}
+	u.RetiredLabels = kept
+}
+
+func (s *Server) stripTaskURL(email string, chunk int) string {
+	u, _ := url.Parse("/t/strip")
+
+	v := url.Values{}
+	v.Set("email", email)
+	v.Set("chunk", strconv.Itoa(chunk))
+	u.RawQuery = v.Encode()
+
+	return u.String()
+}
+
+// Queues the given chunk of the job that strips the user's retired labels, to run now.
+func (s *Server) queueStrip(ctx context.Context, email string, chunk int) error {
+	name := taskName(fmt.Sprintf("%s strip %d", email, chunk), time.Now())
+	err := s.tasks.Enqueue(ctx, name, s.stripTaskURL(email, chunk), time.Now())
+	if errors.Is(err, ErrTaskExists) {
+		return nil
+	}
+	return errors.Wrapf(err, "enqueueing strip task %d for %s", chunk, email)
+}
+
+// GET/POST /t/strip
+func (s *Server) handleStrip(_ http.ResponseWriter, req *http.Request) (err error) {
+	defer func() {
+		if err != nil {
+			log.Printf("ERROR %s", err)
+		}
+	}()
+
+	err = s.checkTaskQueue(req)
+	if err != nil {
+		return err
+	}
+
+	chunk, err := strconv.Atoi(req.FormValue("chunk"))
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "parsing chunk")}
+	}
+
+	return s.doStrip(req.Context(), req.FormValue("email"), chunk)
+}
+
+// Executes one chunk of the job that strips the user's retired labels (see user.RetiredLabels):
+// removes them from up to cleanupChunk threads
+// and queues the next chunk.
+// When no threads carry them,
+// they are no longer recorded as retired.
+func (s *Server) doStrip(ctx context.Context, email string, chunk int) (err error) {
+	defer func() {
+		if reason := revocation(err); reason != "" {
+			err = s.expireUser(ctx, email, reason)
+		}
+	}()
+
+	var u user
+	err = s.store.lookupUser(ctx, email, &u)
+	if errors.Is(err, ErrNotFound) {
+		log.Printf("not stripping retired labels for %s, who has been deleted", email)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrapf(err, "looking up user %s", email)
+	}
+
+	var labels []managedLabel
+	for i := range u.RetiredLabels {
+		l := &u.RetiredLabels[i]
+		if l.ID != "" {
+			labels = append(labels, managedLabel{name: l.Name, id: &l.ID})
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+
+	oauthClient, err := s.oauthClient(ctx, &u)
+	if errors.Is(err, errNoToken) {
+		log.Printf("not stripping retired labels for %s, who has no token", email)
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "getting oauth client")
+	}
+	gmailSvc, err := gmail.NewService(ctx, option.WithHTTPClient(oauthClient))
+	if err != nil {
+		return errors.Wrap(err, "allocating gmail service")
+	}
+	limits, err := s.getUpdateLimits(ctx)
+	if err != nil {
+		return errors.Wrap(err, "getting update limits")
+	}
+	lim, release := s.userLimiter(email, limits)
+	defer release()
+	mp := newLimitedProvider(NewGmailProvider(gmailSvc, oauthClient), lim)
+
+	n, more, err := stripLabels(ctx, mp, labels, cleanupChunk)
+	if err != nil {
+		return errors.Wrapf(err, "stripping retired labels for %s", email)
+	}
+	log.Printf("strip chunk %d for %s stripped retired labels from %d thread(s)", chunk, email, n)
+	if more {
+		return s.queueStrip(ctx, email, chunk+1)
+	}
+
+	stripped := make(map[string]bool)
+	for _, ml := range labels {
+		stripped[*ml.id] = true
+	}
+	err = s.store.updateUser(ctx, email, &u, func() error {
+		u.dropRetired(stripped)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "updating retired labels for %s", email)
+	}
+	log.Printf("stripped %d retired label(s) for %s", len(stripped), email)
+	return nil
+}
@@ -0,0 +1,158 @@
+package unclog
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestRetireLabels(t *testing.T) {
+	u := &user{
+		ContactsLabelID:        "c",
+		StarredLabelID:         "s",
+		CorrespondentsLookback: 30 * dayDur,
+		CorrespondentsLabelID:  "corr",
+		GroupLabels: []groupLabel{
+			{GroupID: "family", Name: "✔/Family", LabelID: "fam"},
+			{GroupID: "work", Name: "✔/Work", LabelID: "work"},
+		},
+	}
+
+	// Dropping a group mapping and turning off correspondents retires their labels.
+	prev := u.tierLabels()
+	u.GroupLabels = u.GroupLabels[:1]
+	u.CorrespondentsLookback = 0
+	if !u.retireLabels(prev) {
+		t.Error("got no newly retired labels")
+	}
+	if got := fmt.Sprint(u.RetiredLabels); got != "[{work ✔/Work} {corr ✔/✉}]" {
+		t.Errorf("got retired labels %s", got)
+	}
+
+	// Retiring again adds nothing.
+	if u.retireLabels(prev) {
+		t.Error("got newly retired labels on second call")
+	}
+
+	// A label that belongs to a tier again is no longer retired.
+	prev = u.tierLabels()
+	u.CorrespondentsLookback = 30 * dayDur
+	if u.retireLabels(prev) {
+		t.Error("got newly retired labels after turning correspondents back on")
+	}
+	if got := fmt.Sprint(u.RetiredLabels); got != "[{work ✔/Work}]" {
+		t.Errorf("got retired labels %s", got)
+	}
+
+	// Retired labels are among those cleaned up or deleted.
+	var owned []string
+	for _, ml := range u.ownedLabels() {
+		owned = append(owned, *ml.id)
+	}
+	if !sameStrings(owned, []string{"c", "s", "fam", "corr", "work"}) {
+		t.Errorf("got owned labels %v", owned)
+	}
+
+	u.dropRetired(map[string]bool{"work": true})
+	if len(u.RetiredLabels) != 0 {
+		t.Errorf("got retired labels %v after dropping", u.RetiredLabels)
+	}
+}
+
+func TestStripRetiredLabels(t *testing.T) {
+	ctx := context.Background()
+
+	mb := NewMemMailbox()
+
+	// A name that a search query can't spell as given.
+	u := &user{GroupLabels: []groupLabel{{GroupID: "work", Name: `✔/Work & "Play" (-ünd)`}}}
+	if err := (&Server{}).ensureLabels(ctx, mb, u); err != nil {
+		t.Fatal(err)
+	}
+	workID := u.GroupLabels[0].LabelID
+	for i := 0; i < 5; i++ {
+		mb.AddThread(&Thread{
+			ID:       fmt.Sprintf("t%d", i),
+			Messages: []*Message{{ID: fmt.Sprintf("m%d", i), LabelIDs: []string{u.ContactsLabelID, workID}}},
+		})
+	}
+
+	prev := u.tierLabels()
+	u.GroupLabels = nil
+	u.retireLabels(prev)
+
+	var labels []managedLabel
+	for i := range u.RetiredLabels {
+		labels = append(labels, managedLabel{name: u.RetiredLabels[i].Name, id: &u.RetiredLabels[i].ID})
+	}
+	n, more, err := stripLabels(ctx, mb, labels, cleanupChunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 5 || more {
+		t.Errorf("got %d thread(s) stripped and more=%v, want 5 and false", n, more)
+	}
+	for i := 0; i < 5; i++ {
+		if got := mb.Thread(fmt.Sprintf("t%d", i)).Messages[0].LabelIDs; !sameStrings(got, []string{u.ContactsLabelID}) {
+			t.Errorf("thread %d: got labels %v, want only the contacts label", i, got)
+		}
+	}
+}
+
+func TestDoStripNoop(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	tasks, err := NewLocalTaskQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newServer(bs, tasks, "")
+
+	// A deleted user, and a user with nothing retired, need no Gmail calls.
+	if err := s.doStrip(ctx, "nobody@example.com", 1); err != nil {
+		t.Fatal(err)
+	}
+	u := user{ContactsLabelID: "c"}
+	if err := bs.newUser(ctx, "alice@example.com", &u); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.doStrip(ctx, "alice@example.com", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A user without a token keeps the retired labels until authorizing again.
+	err = bs.updateUser(ctx, "alice@example.com", &u, func() error {
+		u.RetiredLabels = []Label{{ID: "w", Name: "✔/Work"}}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.doStrip(ctx, "alice@example.com", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := bs.lookupUser(ctx, "alice@example.com", &u); err != nil {
+		t.Fatal(err)
+	}
+	if len(u.RetiredLabels) != 1 {
+		t.Errorf("got retired labels %v, want them kept", u.RetiredLabels)
+	}
+
+	// Strip tasks are among those canceled when the user is deleted.
+	if err := s.queueStrip(ctx, "alice@example.com", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tasks.Cancel(ctx, isTaskFor("alice@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if n := tasks.Pending(); n != 0 {
+		t.Errorf("got %d pending task(s) after canceling, want 0", n)
+	}
+}
@@ -0,0 +1,209 @@
+package unclog
+
+import (
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/googleapi"
+)
+
+// backoff is a policy for retrying Google API calls that fail transiently.
+// Waits between attempts grow exponentially, with full jitter,
+// unless the server asks for a specific wait with Retry-After.
+type backoff struct {
+	Initial    time.Duration // ceiling on the first wait
+	Max        time.Duration // ceiling on any wait not requested by the server
+	MaxElapsed time.Duration // give up rather than wait past this long after the first attempt
+
+	sleep func(context.Context, time.Duration) error // for testing; default sleepCtx
+}
+
+// defaultBackoff is the policy used by retry.
+var defaultBackoff = backoff{
+	Initial:    500 * time.Millisecond,
+	Max:        30 * time.Second,
+	MaxElapsed: 2 * time.Minute,
+}
+
+// Calls f, retrying it according to defaultBackoff
+// for as long as it fails with a retryable error (see isRetryable).
+// The result is nil or the last error from f, unwrapped.
+func retry(ctx context.Context, f func() error) error {
+	return defaultBackoff.retry(ctx, f)
+}
+
+func (b backoff) retry(ctx context.Context, f func() error) error {
+	sleep := b.sleep
+	if sleep == nil {
+		sleep = sleepCtx
+	}
+
+	start := time.Now()
+	ceiling := b.Initial
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		ok, wait := isRetryable(err)
+		if !ok {
+			return err
+		}
+		if wait == 0 {
+			wait = time.Duration(rand.Int63n(int64(ceiling) + 1))
+			if ceiling *= 2; ceiling > b.Max {
+				ceiling = b.Max
+			}
+		}
+		if time.Since(start)+wait > b.MaxElapsed {
+			return err
+		}
+		log.Printf("retrying in %s after error: %s", wait, err)
+		if serr := sleep(ctx, wait); serr != nil {
+			return err
+		}
+	}
+}
+
+// Calls fetch for each page of a paged Google API list call,
+// starting with an empty page token,
+// and passes the result to f.
+// Each call to fetch is retried as with retry.
+// (This replaces the Pages method of the API's call types,
+// which gives up on the first error.)
+func retryPages[T any](ctx context.Context, fetch func(pageToken string) (T, string, error), f func(T) error) error {
+	var pageToken string
+	for {
+		var (
+			resp T
+			next string
+		)
+		err := retry(ctx, func() error {
+			var err error
+			resp, next, err = fetch(pageToken)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if err = f(resp); err != nil {
+			return err
+		}
+		if next == "" {
+			return nil
+		}
+		pageToken = next
+	}
+}
+
+// pagedCall is a Google API list call, such as *gmail.UsersThreadsListCall,
+// that produces its results a page at a time.
+type pagedCall[Call, Resp any] interface {
+	PageToken(string) Call
+	Do(...googleapi.CallOption) (Resp, error)
+}
+
+// Returns a fetch function for retryPages that makes the given list call.
+// The next function gets the token of the following page from a response
+// (its NextPageToken field).
+func pageFetcher[Call pagedCall[Call, Resp], Resp any](call Call, next func(Resp) string) func(pageToken string) (Resp, string, error) {
+	return func(pageToken string) (Resp, string, error) {
+		if pageToken != "" {
+			call.PageToken(pageToken)
+		}
+		resp, err := call.Do()
+		if err != nil {
+			var zero Resp
+			return zero, "", err
+		}
+		return resp, next(resp), nil
+	}
+}
+
+// Reasons in a 403 response that mean "slow down" rather than "forbidden."
+var retryableReasons = map[string]bool{
+	"rateLimitExceeded":     true,
+	"userRateLimitExceeded": true,
+	"backendError":          true,
+}
+
+// Tells whether err is a transient failure worth retrying,
+// and how long the server asked to wait before doing so, if it did.
+func isRetryable(err error) (bool, time.Duration) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+
+	var gerr *googleapi.Error
+	if errors.As(err, &gerr) {
+		switch gerr.Code {
+		case http.StatusRequestTimeout, http.StatusTooManyRequests,
+			http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true, retryAfter(gerr.Header)
+
+		case http.StatusForbidden:
+			for _, item := range gerr.Errors {
+				if retryableReasons[item.Reason] {
+					return true, retryAfter(gerr.Header)
+				}
+			}
+		}
+		return false, 0
+	}
+
+	// A failure to refresh the OAuth token won't fix itself.
+	var rerr *oauth2.RetrieveError
+	if errors.As(err, &rerr) {
+		return false, 0
+	}
+
+	var nerr net.Error
+	if errors.As(err, &nerr) && nerr.Timeout() {
+		return true, 0
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, syscall.ECONNRESET) {
+		return true, 0
+	}
+
+	return false, 0
+}
+
+// Parses the Retry-After header field,
+// which is either a number of seconds or an HTTP date.
+// Returns 0 if there is none.
+func retryAfter(h http.Header) time.Duration {
+	val := h.Get("Retry-After")
+	if val == "" {
+		return 0
+	}
+	if secs, err := strconv.Atoi(val); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(val); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,197 @@
+package unclog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+)
+
+func TestIsRetryable(t *testing.T) {
+	cases := []struct {
+		name      string
+		err       error
+		want      bool
+		wantAfter time.Duration
+	}{
+		{"429", &googleapi.Error{Code: 429}, true, 0},
+		{"500", &googleapi.Error{Code: 500}, true, 0},
+		{"503 with Retry-After", &googleapi.Error{Code: 503, Header: http.Header{"Retry-After": {"7"}}}, true, 7 * time.Second},
+		{"wrapped 503", errors.Wrap(&googleapi.Error{Code: 503}, "getting thread"), true, 0},
+		{"400", &googleapi.Error{Code: 400}, false, 0},
+		{"404", &googleapi.Error{Code: 404}, false, 0},
+		{"403", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "forbidden"}}}, false, 0},
+		{"403 rate limit", &googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "userRateLimitExceeded"}}}, true, 0},
+		{"oauth", &oauth2.RetrieveError{ErrorCode: "invalid_grant"}, false, 0},
+		{"canceled", context.Canceled, false, 0},
+		{"unexpected EOF", io.ErrUnexpectedEOF, true, 0},
+		{"other", errors.New("other"), false, 0},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, after := isRetryable(c.err)
+			if got != c.want || after != c.wantAfter {
+				t.Errorf("got %v, %s; want %v, %s", got, after, c.want, c.wantAfter)
+			}
+		})
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	var (
+		ctx   = context.Background()
+		slept []time.Duration
+	)
+	b := backoff{
+		Initial:    time.Second,
+		Max:        4 * time.Second,
+		MaxElapsed: time.Hour,
+		sleep: func(_ context.Context, d time.Duration) error {
+			slept = append(slept, d)
+			return nil
+		},
+	}
+
+	t.Run("success after transient errors", func(t *testing.T) {
+		slept = nil
+		var calls int
+		err := b.retry(ctx, func() error {
+			calls++
+			if calls < 6 {
+				return &googleapi.Error{Code: 503}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if calls != 6 {
+			t.Errorf("got %d calls, want 6", calls)
+		}
+		for i, d := range slept {
+			ceiling := time.Second << i
+			if ceiling > b.Max {
+				ceiling = b.Max
+			}
+			if d < 0 || d > ceiling {
+				t.Errorf("wait %d is %s, want at most %s", i, d, ceiling)
+			}
+		}
+	})
+
+	t.Run("permanent error", func(t *testing.T) {
+		slept = nil
+		var calls int
+		wantErr := &googleapi.Error{Code: 400}
+		err := b.retry(ctx, func() error {
+			calls++
+			return wantErr
+		})
+		if err != wantErr {
+			t.Errorf("got error %v, want %v", err, wantErr)
+		}
+		if calls != 1 {
+			t.Errorf("got %d calls, want 1", calls)
+		}
+	})
+
+	t.Run("Retry-After", func(t *testing.T) {
+		slept = nil
+		var calls int
+		err := b.retry(ctx, func() error {
+			calls++
+			if calls == 1 {
+				return &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": {"10"}}}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(slept) != 1 || slept[0] != 10*time.Second {
+			t.Errorf("got waits %v, want [10s]", slept)
+		}
+	})
+
+	t.Run("elapsed cap", func(t *testing.T) {
+		slept = nil
+		b := b
+		b.MaxElapsed = 5 * time.Second
+		var calls int
+		err := b.retry(ctx, func() error {
+			calls++
+			return &googleapi.Error{Code: 429, Header: http.Header{"Retry-After": {"10"}}}
+		})
+		if err == nil {
+			t.Fatal("got no error")
+		}
+		if calls != 1 {
+			t.Errorf("got %d calls, want 1", calls)
+		}
+	})
+}
+
+func TestRetryPages(t *testing.T) {
+	defer func(b backoff) { defaultBackoff = b }(defaultBackoff)
+	defaultBackoff.sleep = func(context.Context, time.Duration) error { return nil }
+
+	var (
+		ctx      = context.Background()
+		requests int32
+	)
+
+	// Serves three pages of threads,
+	// failing the first request for each with 503.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		if n%2 == 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			fmt.Fprint(w, `{"error": {"code": 503, "message": "try again"}}`)
+			return
+		}
+		page := n / 2
+		resp := gmail.ListThreadsResponse{Threads: []*gmail.Thread{{Id: fmt.Sprintf("t%d", page)}}}
+		if page < 3 {
+			resp.NextPageToken = fmt.Sprintf("p%d", page+1)
+		}
+		if got, want := req.URL.Query().Get("pageToken"), map[int32]string{1: "", 2: "p2", 3: "p3"}[page]; got != want {
+			t.Errorf("page %d: got page token %q, want %q", page, got, want)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+
+	svc, err := gmail.NewService(ctx, option.WithHTTPClient(srv.Client()), option.WithEndpoint(srv.URL+"/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := NewGmailProvider(svc, nil)
+
+	var got []string
+	err = g.ListThreads(ctx, "", func(threadIDs []string) error {
+		got = append(got, threadIDs...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"t1", "t2", "t3"}; !sameStrings(got, want) {
+		t.Errorf("got threads %v, want %v", got, want)
+	}
+	if requests != 6 {
+		t.Errorf("got %d requests, want 6", requests)
+	}
+}
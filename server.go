@@ -2,14 +2,17 @@ package unclog
 
 import (
 	"context"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
-	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
 	"cloud.google.com/go/datastore"
+	"github.com/bobg/aesite"
 	"github.com/bobg/mid"
+	"github.com/pkg/errors"
 	"golang.org/x/oauth2"
 	"google.golang.org/appengine"
 )
@@ -17,19 +20,41 @@ import (
 // Server is the type of the Unclog server.
 type Server struct {
 	addr       string
-	dsClient   *datastore.Client
-	ctClient   *cloudtasks.Client
-	projectID  string
-	locationID string
+	store      store
+	tasks      TaskQueue
 	contentDir string
 
-	mu        sync.Mutex // protects the following cached values
-	oauthConf *oauth2.Config
-	masterKey string
+	cronMu sync.Mutex // held while a cron job runs; see runCronJob
+
+	mu            sync.Mutex // protects the following cached values
+	oauthConf     *oauth2.Config
+	masterKey     string
+	tokenKeys     *tokenKeys
+	tokenKeysFile string // if set, where tokenKeys come from instead of the token-keys setting
+	tokenKeysTime time.Time
+	limits        *updateLimits
+	limitsTime    time.Time
+	limiters      map[string]*userLimiterEntry // per-user Gmail API limiters, keyed by e-mail address
 }
 
-// NewServer produces a new Server.
-func NewServer(dsClient *datastore.Client, ctClient *cloudtasks.Client, projectID, locationID, contentDir string) *Server {
+// settingsTTL is how long a server caches settings that can change while it runs
+// (the token keys and the update limits)
+// before reading them again.
+const settingsTTL = 5 * time.Minute
+
+// NewBoltServer produces a new Server keeping its data in the given BoltStore.
+// Update tasks are queued on the given TaskQueue.
+func NewBoltServer(bs *BoltStore, tasks TaskQueue, contentDir string) *Server {
+	return newServer(bs, tasks, contentDir)
+}
+
+// NewDatastoreServer produces a new Server keeping its data in the given DatastoreStore.
+// Update tasks are queued on the given TaskQueue.
+func NewDatastoreServer(ds *DatastoreStore, tasks TaskQueue, contentDir string) *Server {
+	return newServer(ds, tasks, contentDir)
+}
+
+func newServer(store store, tasks TaskQueue, contentDir string) *Server {
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
@@ -38,10 +63,8 @@ func NewServer(dsClient *datastore.Client, ctClient *cloudtasks.Client, projectI
 
 	return &Server{
 		addr:       addr,
-		dsClient:   dsClient,
-		ctClient:   ctClient,
-		projectID:  projectID,
-		locationID: locationID,
+		store:      store,
+		tasks:      tasks,
 		contentDir: contentDir,
 	}
 }
@@ -59,6 +82,16 @@ func (s *Server) Serve(ctx context.Context) error {
 	mux.Handle("/s/auth", mid.Err(s.handleAuth))
 	mux.Handle("/s/enable", mid.Err(s.handleEnable))
 	mux.Handle("/s/disable", mid.Err(s.handleDisable))
+	mux.Handle("/s/groups", mid.Err(s.handleGroups))
+	mux.Handle("/s/labels", mid.Err(s.handleLabels))
+	mux.Handle("/s/allow", mid.Err(s.handleAllow))
+	mux.Handle("/s/correspondents", mid.Err(s.handleCorrespondents))
+	mux.Handle("/s/headers", mid.Err(s.handleHeaders))
+	mux.Handle("/s/thread", mid.Err(s.handleThreadPolicy))
+	mux.Handle("/s/plus", mid.Err(s.handlePlus))
+	mux.Handle("/s/contacts", mid.Err(s.handleContactSettings))
+	mux.Handle("/s/scan", mid.Err(s.handleScanStrategy))
+	mux.Handle("/s/delete", mid.Err(s.handleDelete))
 
 	// OAuth-flow-initiated.
 	mux.Handle("/auth2", mid.Err(s.handleAuth2))
@@ -70,13 +103,34 @@ func (s *Server) Serve(ctx context.Context) error {
 	mux.Handle("/t/cron", mid.Log(mid.Err(s.handleCron)))
 
 	// Taskqueue-initiated.
-	mux.Handle("/t/update", mid.Log(mid.Err(s.handleUpdate)))
+	// An in-process task queue delivers its tasks directly to a separate mux,
+	// so these URLs are not served to the network at all.
+	r, local := s.tasks.(taskRunner)
+	taskMux := mux
+	if local {
+		taskMux = http.NewServeMux()
+	}
+	taskMux.Handle("/t/update", mid.Log(mid.Err(s.handleUpdate)))
+	taskMux.Handle("/t/cleanup", mid.Log(mid.Err(s.handleCleanup)))
+	taskMux.Handle("/t/strip", mid.Log(mid.Err(s.handleStrip)))
 
 	httpSrv := &http.Server{
 		Addr:    s.addr,
 		Handler: mux,
 	}
 
+	var wg sync.WaitGroup
+	if local {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := r.Run(ctx, localTasks(taskMux))
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("ERROR running task queue: %s", err)
+			}
+		}()
+	}
+
 	if appengine.IsAppEngine() {
 		return httpSrv.ListenAndServe()
 	}
@@ -85,11 +139,34 @@ func (s *Server) Serve(ctx context.Context) error {
 	go func() {
 		<-ctx.Done()
 		httpSrv.Shutdown(context.TODO())
+		close(done)
 	}()
 
 	err := httpSrv.ListenAndServe()
+	if !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
 	<-done
-	return err
+	wg.Wait()
+	return nil
+}
+
+type taskRunner interface {
+	Run(context.Context, http.Handler) error
+}
+
+// localTaskKey is the context key marking a request
+// delivered in-process by a taskRunner.
+// See localTasks and checkTaskQueue.
+type localTaskKey struct{}
+
+// Wraps h, the handler for an in-process task queue,
+// so that checkTaskQueue admits its requests.
+func localTasks(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), localTaskKey{}, true)
+		h.ServeHTTP(w, req.WithContext(ctx))
+	})
 }
 
 func (s *Server) handleStatic(w http.ResponseWriter, req *http.Request) {
@@ -99,3 +176,20 @@ func (s *Server) handleStatic(w http.ResponseWriter, req *http.Request) {
 	}
 	http.ServeFile(w, req, filepath.Join(s.contentDir, path))
 }
+
+// GetSetting gets the value of a setting.
+// If the setting does not exist, the result is ErrNotFound.
+func (s *Server) GetSetting(ctx context.Context, name string) ([]byte, error) {
+	return s.store.GetSetting(ctx, name)
+}
+
+// SetSetting creates or updates the value of a setting.
+// A running server may take up to five minutes to notice changes to some settings.
+func (s *Server) SetSetting(ctx context.Context, name string, value []byte) error {
+	return s.store.SetSetting(ctx, name, value)
+}
+
+// GetSessionByKey gets the session with the given key.
+func (s *Server) GetSessionByKey(ctx context.Context, key *datastore.Key) (*aesite.Session, error) {
+	return s.store.GetSessionByKey(ctx, key)
+}
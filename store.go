@@ -0,0 +1,224 @@
+package unclog
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/datastore"
+	"github.com/bobg/aesite"
+	"github.com/pkg/errors"
+	"google.golang.org/api/iterator"
+)
+
+// store is persistent storage for users, sessions, and settings.
+// DatastoreStore is the production implementation, using Google Cloud Datastore.
+// BoltStore is an embedded single-file implementation for self-hosting.
+//
+// Sessions are aesite.Session objects in either case,
+// so the error conventions of aesite apply
+// (e.g. aesite.IsNoSession works with the errors from GetSession).
+type store interface {
+	// GetSetting gets the value of a setting.
+	// If the setting does not exist, the result is ErrNotFound.
+	GetSetting(ctx context.Context, name string) ([]byte, error)
+
+	// SetSetting creates or updates the value of a setting.
+	SetSetting(ctx context.Context, name string, value []byte) error
+
+	// NewSession creates and stores a new anonymous session lasting for the given duration.
+	NewSession(ctx context.Context, dur time.Duration) (*aesite.Session, error)
+
+	// GetSession gets the session identified by the cookie in an HTTP request.
+	// See aesite.GetSession.
+	GetSession(ctx context.Context, req *http.Request) (*aesite.Session, error)
+
+	// GetSessionByKey gets the session with the given key.
+	// See aesite.GetSessionByKey.
+	GetSessionByKey(ctx context.Context, key *datastore.Key) (*aesite.Session, error)
+
+	// PutSession stores a session.
+	PutSession(ctx context.Context, sess *aesite.Session) error
+
+	// lookupUser gets the user with the given e-mail address.
+	// If there is no such user, the result is ErrNotFound.
+	lookupUser(ctx context.Context, email string, u *user) error
+
+	// sessionUser gets the user associated with the given session.
+	// If there is none, the result is aesite.ErrAnonymous.
+	sessionUser(ctx context.Context, sess *aesite.Session, u *user) error
+
+	// newUser creates and stores a new user with the given e-mail address,
+	// using the remaining contents of u.
+	newUser(ctx context.Context, email string, u *user) error
+
+	// putUser stores a user.
+	putUser(ctx context.Context, u *user) error
+
+	// updateUser atomically updates a user,
+	// looking it up, placing it in u, calling f to modify u, and storing the result.
+	// If the update loses a race with another concurrent update,
+	// the result is aesite.ErrUpdateConflict.
+	// See aesite.UpdateUser.
+	updateUser(ctx context.Context, email string, u *user, f func() error) error
+
+	// forUsersWatchExpiring calls f on each user whose WatchExpiry is after `after` and before `before`.
+	forUsersWatchExpiring(ctx context.Context, after, before time.Time, f func(*user) error) error
+
+	// forUsersUpdatedBefore calls f on each user whose LastUpdate is before t.
+	forUsersUpdatedBefore(ctx context.Context, t time.Time, f func(*user) error) error
+
+	// forEachUser calls f on every user.
+	forEachUser(ctx context.Context, f func(*user) error) error
+
+	// getContacts gets the encoded contact snapshot of the user with the given e-mail address
+	// (see contactSnapshot).
+	// If there is none, the result is ErrNotFound.
+	getContacts(ctx context.Context, email string) ([]byte, error)
+
+	// putContacts stores the encoded contact snapshot of the user with the given e-mail address.
+	putContacts(ctx context.Context, email string, data []byte) error
+
+	// deleteUser deletes the user with the given e-mail address,
+	// together with the user's sessions and contact snapshot.
+	// It is not an error if there is no such user.
+	deleteUser(ctx context.Context, email string) error
+}
+
+// ErrNotFound is the error produced by a store when a requested item does not exist.
+// It is the same as datastore.ErrNoSuchEntity,
+// so aesite.IsNoSession recognizes it.
+var ErrNotFound = datastore.ErrNoSuchEntity
+
+// DatastoreStore is a store using Google Cloud Datastore.
+type DatastoreStore struct {
+	client *datastore.Client
+}
+
+var _ store = &DatastoreStore{}
+
+// NewDatastoreStore produces a new DatastoreStore using the given client.
+func NewDatastoreStore(client *datastore.Client) *DatastoreStore {
+	return &DatastoreStore{client: client}
+}
+
+// GetSetting implements store.GetSetting.
+func (d *DatastoreStore) GetSetting(ctx context.Context, name string) ([]byte, error) {
+	return aesite.GetSetting(ctx, d.client, name)
+}
+
+// SetSetting implements store.SetSetting.
+func (d *DatastoreStore) SetSetting(ctx context.Context, name string, value []byte) error {
+	return aesite.SetSetting(ctx, d.client, name, value)
+}
+
+// NewSession implements store.NewSession.
+func (d *DatastoreStore) NewSession(ctx context.Context, dur time.Duration) (*aesite.Session, error) {
+	return aesite.NewSessionWithDuration(ctx, d.client, nil, dur)
+}
+
+// GetSession implements store.GetSession.
+func (d *DatastoreStore) GetSession(ctx context.Context, req *http.Request) (*aesite.Session, error) {
+	return aesite.GetSession(ctx, d.client, req)
+}
+
+// GetSessionByKey implements store.GetSessionByKey.
+func (d *DatastoreStore) GetSessionByKey(ctx context.Context, key *datastore.Key) (*aesite.Session, error) {
+	return aesite.GetSessionByKey(ctx, d.client, key)
+}
+
+// PutSession implements store.PutSession.
+func (d *DatastoreStore) PutSession(ctx context.Context, sess *aesite.Session) error {
+	_, err := d.client.Put(ctx, sess.Key(), sess)
+	return err
+}
+
+func (d *DatastoreStore) lookupUser(ctx context.Context, email string, u *user) error {
+	return aesite.LookupUser(ctx, d.client, email, u)
+}
+
+func (d *DatastoreStore) sessionUser(ctx context.Context, sess *aesite.Session, u *user) error {
+	return sess.GetUser(ctx, d.client, u)
+}
+
+func (d *DatastoreStore) newUser(ctx context.Context, email string, u *user) error {
+	return aesite.NewUser(ctx, d.client, email, "", u)
+}
+
+func (d *DatastoreStore) putUser(ctx context.Context, u *user) error {
+	_, err := d.client.Put(ctx, u.Key(), u)
+	return err
+}
+
+func (d *DatastoreStore) updateUser(ctx context.Context, email string, u *user, f func() error) error {
+	return aesite.UpdateUser(ctx, d.client, email, u, func(*datastore.Transaction) error { return f() })
+}
+
+func (d *DatastoreStore) forUsersWatchExpiring(ctx context.Context, after, before time.Time, f func(*user) error) error {
+	q := datastore.NewQuery("User").Filter("WatchExpiry >", after).Filter("WatchExpiry <", before)
+	return d.forUsers(ctx, q, f)
+}
+
+func (d *DatastoreStore) forUsersUpdatedBefore(ctx context.Context, t time.Time, f func(*user) error) error {
+	q := datastore.NewQuery("User").Filter("LastUpdate <", t)
+	return d.forUsers(ctx, q, f)
+}
+
+func (d *DatastoreStore) forEachUser(ctx context.Context, f func(*user) error) error {
+	return d.forUsers(ctx, datastore.NewQuery("User"), f)
+}
+
+// contactsEntity is the Datastore entity holding a user's contact snapshot.
+type contactsEntity struct {
+	Data []byte `datastore:",noindex"`
+}
+
+func (d *DatastoreStore) getContacts(ctx context.Context, email string) ([]byte, error) {
+	var ent contactsEntity
+	err := d.client.Get(ctx, datastore.NameKey("Contacts", email, nil), &ent)
+	if err != nil {
+		return nil, err
+	}
+	return ent.Data, nil
+}
+
+func (d *DatastoreStore) putContacts(ctx context.Context, email string, data []byte) error {
+	_, err := d.client.Put(ctx, datastore.NameKey("Contacts", email, nil), &contactsEntity{Data: data})
+	return err
+}
+
+func (d *DatastoreStore) deleteUser(ctx context.Context, email string) error {
+	email, err := aesite.CanonicalizeEmail(email)
+	if err != nil {
+		return errors.Wrapf(err, "canonicalizing e-mail address %s", email)
+	}
+	userKey := (&aesite.User{Email: email}).Key()
+
+	q := datastore.NewQuery("Session").Filter("UserKey =", userKey).KeysOnly()
+	keys, err := d.client.GetAll(ctx, q, nil)
+	if err != nil {
+		return errors.Wrapf(err, "finding sessions of %s", email)
+	}
+	keys = append(keys, userKey, datastore.NameKey("Contacts", email, nil))
+
+	// Deleting a nonexistent entity is not an error.
+	return d.client.DeleteMulti(ctx, keys)
+}
+
+func (d *DatastoreStore) forUsers(ctx context.Context, q *datastore.Query, f func(*user) error) error {
+	it := d.client.Run(ctx, q)
+	for {
+		var u user
+		_, err := it.Next(&u)
+		if errors.Is(err, iterator.Done) {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "iterating over users")
+		}
+		err = f(&u)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,437 @@
+package unclog
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	cloudtasks "cloud.google.com/go/cloudtasks/apiv2"
+	"cloud.google.com/go/cloudtasks/apiv2/cloudtaskspb"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/errgroup"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// TaskQueue is a queue of delayed tasks,
+// each of which is a GET request to a URL on the Unclog server.
+// CloudTaskQueue is the production implementation.
+// LocalTaskQueue is an in-process implementation
+// for running outside Google Cloud and in tests.
+type TaskQueue interface {
+	// Enqueue schedules a task that will GET the given relative URL at the given time.
+	// Tasks are deduplicated by name:
+	// if a task with the same name was recently enqueued,
+	// the result is ErrTaskExists.
+	Enqueue(ctx context.Context, name, url string, when time.Time) error
+
+	// Cancel deletes the pending tasks whose URLs satisfy f
+	// and returns how many there were.
+	Cancel(ctx context.Context, f func(url string) bool) (int, error)
+}
+
+// ErrTaskExists is the error returned by TaskQueue.Enqueue for a duplicate task name.
+var ErrTaskExists = errors.New("task exists")
+
+// CloudTaskQueue is a TaskQueue backed by Google Cloud Tasks.
+// Tasks are App Engine HTTP requests.
+type CloudTaskQueue struct {
+	client     *cloudtasks.Client
+	projectID  string
+	locationID string
+}
+
+var _ TaskQueue = &CloudTaskQueue{}
+
+// NewCloudTaskQueue produces a new CloudTaskQueue
+// for the Unclog update queue in the given project and location.
+func NewCloudTaskQueue(client *cloudtasks.Client, projectID, locationID string) *CloudTaskQueue {
+	return &CloudTaskQueue{
+		client:     client,
+		projectID:  projectID,
+		locationID: locationID,
+	}
+}
+
+func (q *CloudTaskQueue) queueName() string {
+	return fmt.Sprintf("projects/%s/locations/%s/queues/%s", q.projectID, q.locationID, queueName)
+}
+
+// Enqueue implements TaskQueue.Enqueue.
+func (q *CloudTaskQueue) Enqueue(ctx context.Context, name, url string, when time.Time) error {
+	var (
+		secs  = when.Unix()
+		nanos = int32(when.UnixNano() % int64(time.Second))
+	)
+
+	_, err := q.client.CreateTask(ctx, &cloudtaskspb.CreateTaskRequest{
+		Parent: q.queueName(),
+		Task: &cloudtaskspb.Task{
+			Name: fmt.Sprintf("%s/tasks/%s", q.queueName(), name),
+			MessageType: &cloudtaskspb.Task_AppEngineHttpRequest{
+				AppEngineHttpRequest: &cloudtaskspb.AppEngineHttpRequest{
+					HttpMethod:  cloudtaskspb.HttpMethod_GET,
+					RelativeUri: url,
+				},
+			},
+			ScheduleTime: &timestamp.Timestamp{
+				Seconds: secs,
+				Nanos:   nanos,
+			},
+		},
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrTaskExists
+	}
+	return err
+}
+
+// Cancel implements TaskQueue.Cancel.
+func (q *CloudTaskQueue) Cancel(ctx context.Context, f func(url string) bool) (int, error) {
+	var (
+		n  int
+		it = q.client.ListTasks(ctx, &cloudtaskspb.ListTasksRequest{Parent: q.queueName()})
+	)
+	for {
+		task, err := it.Next()
+		if errors.Is(err, iterator.Done) {
+			return n, nil
+		}
+		if err != nil {
+			return n, errors.Wrap(err, "listing tasks")
+		}
+		if !f(task.GetAppEngineHttpRequest().GetRelativeUri()) {
+			continue
+		}
+		err = q.client.DeleteTask(ctx, &cloudtaskspb.DeleteTaskRequest{Name: task.Name})
+		if status.Code(err) == codes.NotFound {
+			continue // it ran in the meantime
+		}
+		if err != nil {
+			return n, errors.Wrapf(err, "deleting task %s", task.Name)
+		}
+		n++
+	}
+}
+
+// LocalTaskQueue is an in-process TaskQueue.
+// Tasks are delivered by LocalTaskQueue.Run to an http.Handler at their scheduled times.
+//
+// Like Cloud Tasks, it deduplicates task names,
+// including the names of tasks completed within the past hour.
+// A task that fails (with an HTTP status other than 2xx) is retried with exponential backoff.
+// Up to localTaskWorkers tasks are delivered at a time.
+//
+// If the queue was created with a filename,
+// its state is saved to that file on every change
+// and reloaded by NewLocalTaskQueue,
+// so pending tasks survive a restart.
+type LocalTaskQueue struct {
+	path string
+	wake chan struct{}
+
+	mu      sync.Mutex
+	tasks   map[string]*localTask
+	running map[string]bool // names of tasks being delivered
+}
+
+type localTask struct {
+	Name     string    `json:"name"`
+	URL      string    `json:"url"`
+	When     time.Time `json:"when"`
+	Attempts int       `json:"attempts,omitempty"`
+	Done     time.Time `json:"done,omitempty"` // zero while pending
+}
+
+const (
+	localTaskDedupDur    = time.Hour
+	localTaskMaxAttempts = 10
+	localTaskMaxBackoff  = time.Hour
+	localTaskWorkers     = 4
+)
+
+var _ TaskQueue = &LocalTaskQueue{}
+
+// NewLocalTaskQueue produces a new LocalTaskQueue persisted in the file at path.
+// If the file exists, the queue is loaded from it.
+// If path is "", the queue is not persisted.
+func NewLocalTaskQueue(path string) (*LocalTaskQueue, error) {
+	q := &LocalTaskQueue{
+		path:    path,
+		wake:    make(chan struct{}, 1),
+		tasks:   make(map[string]*localTask),
+		running: make(map[string]bool),
+	}
+	if path == "" {
+		return q, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return q, nil
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "opening %s", path)
+	}
+	defer f.Close()
+
+	var tasks []*localTask
+	err = json.NewDecoder(f).Decode(&tasks)
+	if err != nil {
+		return nil, errors.Wrapf(err, "JSON-decoding %s", path)
+	}
+	for _, t := range tasks {
+		q.tasks[t.Name] = t
+	}
+	return q, nil
+}
+
+// Enqueue implements TaskQueue.Enqueue.
+func (q *LocalTaskQueue) Enqueue(_ context.Context, name, url string, when time.Time) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if _, ok := q.tasks[name]; ok {
+		return ErrTaskExists
+	}
+	q.tasks[name] = &localTask{Name: name, URL: url, When: when}
+	if err := q.save(); err != nil {
+		return err
+	}
+
+	q.signal()
+	return nil
+}
+
+// Wakes up Run to look for due tasks.
+func (q *LocalTaskQueue) signal() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Cancel implements TaskQueue.Cancel.
+// Canceled tasks are marked done,
+// so their names are still deduplicated.
+func (q *LocalTaskQueue) Cancel(_ context.Context, f func(url string) bool) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var (
+		n   int
+		now = time.Now()
+	)
+	for _, t := range q.tasks {
+		if t.Done.IsZero() && f(t.URL) {
+			t.Done = now
+			n++
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+	return n, q.save()
+}
+
+// Pending tells how many tasks are waiting to be delivered.
+func (q *LocalTaskQueue) Pending() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var n int
+	for _, t := range q.tasks {
+		if t.Done.IsZero() {
+			n++
+		}
+	}
+	return n
+}
+
+// Run delivers tasks to h as they come due,
+// up to localTaskWorkers at a time.
+// It returns when ctx is canceled,
+// after any deliveries in progress finish.
+func (q *LocalTaskQueue) Run(ctx context.Context, h http.Handler) error {
+	var g errgroup.Group
+	g.SetLimit(localTaskWorkers)
+	defer g.Wait()
+
+	for {
+		due, next := q.due(time.Now())
+		for _, t := range due {
+			g.Go(func() error {
+				q.deliver(ctx, h, t)
+				return nil
+			})
+		}
+
+		var timer *time.Timer
+		if next.IsZero() {
+			timer = time.NewTimer(time.Hour) // for expiring completed tasks
+		} else {
+			timer = time.NewTimer(time.Until(next))
+		}
+
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-q.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// Returns copies of the pending tasks due as of now,
+// and the scheduled time of the earliest pending task not yet due (zero if none).
+// Tasks already being delivered are skipped,
+// and the returned ones are marked as being delivered.
+// Also expires old completed tasks.
+func (q *LocalTaskQueue) due(now time.Time) ([]localTask, time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var (
+		due     []localTask
+		next    time.Time
+		expired bool
+	)
+	for name, t := range q.tasks {
+		if !t.Done.IsZero() {
+			if now.Sub(t.Done) > localTaskDedupDur {
+				delete(q.tasks, name)
+				expired = true
+			}
+			continue
+		}
+		if q.running[name] {
+			continue
+		}
+		if !t.When.After(now) {
+			due = append(due, *t)
+			q.running[name] = true
+		} else if next.IsZero() || t.When.Before(next) {
+			next = t.When
+		}
+	}
+	if expired {
+		if err := q.save(); err != nil {
+			log.Printf("saving local task queue: %s", err)
+		}
+	}
+	return due, next
+}
+
+func (q *LocalTaskQueue) deliver(ctx context.Context, h http.Handler, t localTask) {
+	code := http.StatusInternalServerError
+
+	req, err := http.NewRequestWithContext(ctx, "GET", t.URL, nil)
+	if err != nil {
+		log.Printf("creating request for task %s: %s", t.Name, err)
+	} else {
+		w := &taskResponseWriter{header: make(http.Header)}
+		h.ServeHTTP(w, req)
+		code = w.code
+		if code == 0 {
+			code = http.StatusOK // nothing written
+		}
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	delete(q.running, t.Name)
+	defer q.signal() // the task may have been rescheduled
+
+	task, ok := q.tasks[t.Name]
+	if !ok {
+		return
+	}
+
+	switch {
+	case code >= 200 && code < 300:
+		task.Done = time.Now()
+
+	case ctx.Err() != nil:
+		// Shutting down. Leave the task for next time.
+		return
+
+	default:
+		task.Attempts++
+		if task.Attempts >= localTaskMaxAttempts {
+			log.Printf("giving up on task %s (%s) after %d attempts", task.Name, task.URL, task.Attempts)
+			task.Done = time.Now()
+			break
+		}
+		backoff := time.Duration(1<<task.Attempts) * time.Second
+		if backoff > localTaskMaxBackoff {
+			backoff = localTaskMaxBackoff
+		}
+		log.Printf("task %s (%s) got status %d, retrying in %s", task.Name, task.URL, code, backoff)
+		task.When = time.Now().Add(backoff)
+	}
+
+	if err := q.save(); err != nil {
+		log.Printf("saving local task queue: %s", err)
+	}
+}
+
+// Caller must hold q.mu.
+func (q *LocalTaskQueue) save() error {
+	if q.path == "" {
+		return nil
+	}
+
+	tasks := make([]*localTask, 0, len(q.tasks))
+	for _, t := range q.tasks {
+		tasks = append(tasks, t)
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(q.path), filepath.Base(q.path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "creating temp file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	err = json.NewEncoder(f).Encode(tasks)
+	if err != nil {
+		return errors.Wrap(err, "JSON-encoding tasks")
+	}
+	err = f.Close()
+	if err != nil {
+		return errors.Wrap(err, "closing temp file")
+	}
+	return os.Rename(f.Name(), q.path)
+}
+
+type taskResponseWriter struct {
+	header http.Header
+	code   int
+}
+
+func (w *taskResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *taskResponseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	return len(b), nil
+}
+
+func (w *taskResponseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+}
@@ -0,0 +1,171 @@
+package unclog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLocalTaskQueue(t *testing.T) {
+	var (
+		ctx  = context.Background()
+		path = filepath.Join(t.TempDir(), "tasks.json")
+		now  = time.Now()
+	)
+
+	q, err := NewLocalTaskQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = q.Enqueue(ctx, "a", "/t/update?email=a", now.Add(200*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.Enqueue(ctx, "b", "/t/update?email=b", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = q.Enqueue(ctx, "a", "/t/update?email=a", now)
+	if !errors.Is(err, ErrTaskExists) {
+		t.Errorf("got error %v for duplicate task, want ErrTaskExists", err)
+	}
+
+	// Reload from the file.
+	q, err = NewLocalTaskQueue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := q.Pending(); n != 2 {
+		t.Fatalf("got %d pending tasks after reload, want 2", n)
+	}
+
+	var (
+		mu   sync.Mutex
+		got  []string
+		when = make(map[string]time.Time)
+		done = make(chan struct{})
+	)
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		email := req.FormValue("email")
+		got = append(got, email)
+		when[email] = time.Now()
+		if len(got) == 2 {
+			close(done)
+		}
+	})
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go q.Run(ctx, h)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for task delivery")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(got) != 2 || got[0] != "b" || got[1] != "a" {
+		t.Errorf("got deliveries %v, want [b a]", got)
+	}
+	if when["a"].Before(now.Add(200 * time.Millisecond)) {
+		t.Errorf("task a delivered early, at %s", when["a"])
+	}
+
+	// Completed task names are still deduplicated.
+	err = q.Enqueue(ctx, "a", "/t/update?email=a", time.Now())
+	if !errors.Is(err, ErrTaskExists) {
+		t.Errorf("got error %v for completed duplicate task, want ErrTaskExists", err)
+	}
+}
+
+func TestLocalTaskQueueRetry(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q, err := NewLocalTaskQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		calls int
+		done  = make(chan struct{})
+	)
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		if calls == 1 {
+			http.Error(w, "try again", http.StatusServiceUnavailable)
+			return
+		}
+		close(done)
+	})
+
+	err = q.Enqueue(ctx, "x", "/t/update", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	go q.Run(ctx, h)
+
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timed out waiting for retry")
+	}
+}
+
+func TestLocalTaskQueueConcurrent(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q, err := NewLocalTaskQueue("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Each delivery waits for all the others to start,
+	// so this finishes only if they are delivered concurrently.
+	var (
+		started = make(chan struct{}, localTaskWorkers)
+		done    = make(chan struct{}, localTaskWorkers)
+	)
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		started <- struct{}{}
+		for len(started) < localTaskWorkers {
+			time.Sleep(10 * time.Millisecond)
+		}
+		done <- struct{}{}
+	})
+
+	now := time.Now()
+	for i := 0; i < localTaskWorkers; i++ {
+		name := fmt.Sprintf("task%d", i)
+		if err := q.Enqueue(ctx, name, "/t/update?email="+name, now); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	go q.Run(ctx, h)
+
+	timeout := time.After(5 * time.Second)
+	for i := 0; i < localTaskWorkers; i++ {
+		select {
+		case <-done:
+		case <-timeout:
+			t.Fatal("timed out waiting for concurrent task delivery")
+		}
+	}
+}
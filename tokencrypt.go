@@ -0,0 +1,362 @@
+package unclog
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bobg/aesite"
+	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
+)
+
+// Users' OAuth tokens are stored encrypted,
+// using envelope encryption:
+// each token is encrypted with a fresh random data key,
+// and the data key is encrypted ("wrapped") with a key-encryption key
+// from the server's tokenKeys.
+// The stored value names the key-encryption key it used,
+// so keys can be rotated:
+// add a new key, make it current,
+// wait for running servers to read it (see settingsTTL),
+// re-encrypt the stored tokens (see Server.ReencryptTokens),
+// and only then drop the old key.
+//
+// A stored value has the form
+//
+//	enc1:KEYID:WRAPPEDKEY:CIPHERTEXT
+//
+// where WRAPPEDKEY and CIPHERTEXT are unpadded URL-safe base64,
+// each an AES-256-GCM nonce followed by the sealed data.
+// The data key is sealed with KEYID as additional data,
+// and the token with the user's e-mail address,
+// so a stored value can't be moved to another key ID or user.
+//
+// Tokens stored before encryption was enabled are plain JSON,
+// and still decode.
+const encTokenPrefix = "enc1:"
+
+// tokenKeys is the set of key-encryption keys for users' OAuth tokens.
+// It is read from the token-keys setting,
+// or from a file (see Server.LoadTokenKeys),
+// as JSON of the form
+//
+//	{"current": "k2", "keys": {"k1": "BASE64", "k2": "BASE64"}}
+//
+// where each key is 32 random bytes, base64-encoded.
+// New tokens are encrypted with the current key;
+// the others are for decrypting tokens not yet re-encrypted.
+// If there are no keys, tokens are stored unencrypted.
+type tokenKeys struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+var errNoTokenKeys = errors.New("no token keys")
+
+// Parses and checks the JSON form of a tokenKeys.
+func parseTokenKeys(j []byte) (*tokenKeys, error) {
+	var keys tokenKeys
+	if err := json.Unmarshal(j, &keys); err != nil {
+		return nil, errors.Wrap(err, "JSON-unmarshaling token keys")
+	}
+	for id, key := range keys.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid token key ID %q", id)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("token key %s has %d bytes, want 32", id, len(key))
+		}
+	}
+	if keys.Current == "" && len(keys.Keys) > 0 {
+		return nil, errors.New("no current token key")
+	}
+	if _, ok := keys.Keys[keys.Current]; keys.Current != "" && !ok {
+		return nil, fmt.Errorf("current token key %s not found", keys.Current)
+	}
+	return &keys, nil
+}
+
+// Encrypts a token for the user with the given e-mail address.
+func (k *tokenKeys) seal(email string, plaintext []byte) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", errors.Wrap(err, "generating data key")
+	}
+	ciphertext, err := gcmSeal(dataKey, plaintext, []byte(email))
+	if err != nil {
+		return "", errors.Wrap(err, "encrypting token")
+	}
+	wrapped, err := gcmSeal(k.Keys[k.Current], dataKey, []byte(k.Current))
+	if err != nil {
+		return "", errors.Wrap(err, "wrapping data key")
+	}
+	enc := base64.RawURLEncoding
+	return encTokenPrefix + k.Current + ":" + enc.EncodeToString(wrapped) + ":" + enc.EncodeToString(ciphertext), nil
+}
+
+// Decrypts a value produced by seal for the user with the given e-mail address.
+func (k *tokenKeys) open(email, stored string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, encTokenPrefix), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed encrypted token")
+	}
+	keyID := parts[0]
+	kek, ok := k.Keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown token key %s", keyID)
+	}
+	enc := base64.RawURLEncoding
+	wrapped, err := enc.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding wrapped data key")
+	}
+	ciphertext, err := enc.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding encrypted token")
+	}
+	dataKey, err := gcmOpen(kek, wrapped, []byte(keyID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "unwrapping data key with token key %s", keyID)
+	}
+	plaintext, err := gcmOpen(dataKey, ciphertext, []byte(email))
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypting token")
+	}
+	return plaintext, nil
+}
+
+// Returns the ID of the key that encrypted a stored token,
+// or "" if it is not encrypted.
+func tokenKeyID(stored string) string {
+	if !strings.HasPrefix(stored, encTokenPrefix) {
+		return ""
+	}
+	keyID, _, _ := strings.Cut(strings.TrimPrefix(stored, encTokenPrefix), ":")
+	return keyID
+}
+
+// Encrypts plaintext with AES-256-GCM, returning the nonce followed by the sealed data.
+func gcmSeal(key, plaintext, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "generating nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, additional), nil
+}
+
+// Decrypts the output of gcmSeal.
+func gcmOpen(key, sealed, additional []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data too short")
+	}
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additional)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "creating cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// LoadTokenKeys reads the keys for encrypting users' OAuth tokens from a file,
+// in place of the token-keys setting.
+// See tokenKeys for the file's format.
+// Like the setting, the file is read again from time to time
+// (see settingsTTL).
+func (s *Server) LoadTokenKeys(filename string) error {
+	keys, err := readTokenKeysFile(filename)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.tokenKeysFile = filename
+	s.tokenKeys = keys
+	s.tokenKeysTime = time.Now()
+	s.mu.Unlock()
+
+	return nil
+}
+
+func readTokenKeysFile(filename string) (*tokenKeys, error) {
+	j, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading token keys")
+	}
+	keys, err := parseTokenKeys(j)
+	return keys, errors.Wrapf(err, "parsing %s", filename)
+}
+
+// Returns the token keys,
+// from the file named in LoadTokenKeys if there is one,
+// otherwise from the token-keys setting.
+// The result is cached for settingsTTL,
+// so that running servers pick up a new current key;
+// reload forces it to be read again.
+// If the setting does not exist, the result is an empty tokenKeys.
+func (s *Server) getTokenKeys(ctx context.Context, reload bool) (*tokenKeys, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tokenKeys != nil && !reload && time.Since(s.tokenKeysTime) < settingsTTL {
+		return s.tokenKeys, nil
+	}
+
+	var keys *tokenKeys
+	if s.tokenKeysFile != "" {
+		var err error
+		keys, err = readTokenKeysFile(s.tokenKeysFile)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		j, err := s.store.GetSetting(ctx, "token-keys")
+		switch {
+		case errors.Is(err, ErrNotFound):
+			keys = &tokenKeys{}
+		case err != nil:
+			return nil, errors.Wrap(err, "getting token keys")
+		default:
+			keys, err = parseTokenKeys(j)
+			if err != nil {
+				return nil, errors.Wrap(err, "parsing token-keys setting")
+			}
+		}
+	}
+
+	s.tokenKeys = keys
+	s.tokenKeysTime = time.Now()
+	return keys, nil
+}
+
+// Produces the stored form of a user's OAuth token:
+// its JSON encoding, encrypted with the current token key if there is one.
+func (s *Server) encodeToken(ctx context.Context, email string, token *oauth2.Token) (string, error) {
+	j, err := json.Marshal(token)
+	if err != nil {
+		return "", errors.Wrap(err, "JSON-marshaling token")
+	}
+	keys, err := s.getTokenKeys(ctx, false)
+	if err != nil {
+		return "", err
+	}
+	if keys.Current == "" {
+		return string(j), nil
+	}
+	return keys.seal(email, j)
+}
+
+// Parses the stored form of a user's OAuth token (see encodeToken).
+// If the token was encrypted with a key this server doesn't know,
+// e.g. one added to the token-keys setting since it was last read,
+// the keys are read again before giving up.
+func (s *Server) decodeToken(ctx context.Context, email, stored string) (*oauth2.Token, error) {
+	j := []byte(stored)
+	if strings.HasPrefix(stored, encTokenPrefix) {
+		keys, err := s.getTokenKeys(ctx, false)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := keys.Keys[tokenKeyID(stored)]; !ok {
+			keys, err = s.getTokenKeys(ctx, true)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(keys.Keys) == 0 {
+			return nil, errNoTokenKeys
+		}
+		j, err = keys.open(email, stored)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var token oauth2.Token
+	if err := json.Unmarshal(j, &token); err != nil {
+		return nil, errors.Wrap(err, "JSON-unmarshaling token")
+	}
+	return &token, nil
+}
+
+// ReencryptTokens re-encrypts every user's stored OAuth token with the current token key,
+// encrypting any that are stored unencrypted.
+// It returns the number of tokens re-encrypted.
+// A user whose token can't be re-encrypted is logged and skipped,
+// and the result is then an error, after all users are processed.
+func (s *Server) ReencryptTokens(ctx context.Context) (int, error) {
+	keys, err := s.getTokenKeys(ctx, true)
+	if err != nil {
+		return 0, err
+	}
+	if keys.Current == "" {
+		return 0, errNoTokenKeys
+	}
+
+	var n, failed int
+	err = s.store.forEachUser(ctx, func(u *user) error {
+		if u.Token == "" || tokenKeyID(u.Token) == keys.Current {
+			return nil
+		}
+		err := s.reencryptToken(ctx, u.Email, keys.Current)
+		switch {
+		case errors.Is(err, errTokenCurrent):
+		case err != nil:
+			log.Printf("re-encrypting token for %s: %s", u.Email, err)
+			failed++
+		default:
+			n++
+		}
+		return nil
+	})
+	if err != nil {
+		return n, err
+	}
+	if failed > 0 {
+		return n, fmt.Errorf("could not re-encrypt %d token(s)", failed)
+	}
+	return n, nil
+}
+
+// Re-encrypts one user's stored token transactionally
+// (retrying after conflicting updates, as in storeToken).
+// The result is errTokenCurrent if there is nothing to do.
+func (s *Server) reencryptToken(ctx context.Context, email, keyID string) error {
+	for attempt := 1; ; attempt++ {
+		var u user
+		err := s.store.updateUser(ctx, email, &u, func() error {
+			if u.Token == "" || tokenKeyID(u.Token) == keyID {
+				return errTokenCurrent
+			}
+			token, err := s.decodeToken(ctx, email, u.Token)
+			if err != nil {
+				return errors.Wrap(err, "decoding token")
+			}
+			u.Token, err = s.encodeToken(ctx, email, token)
+			return err
+		})
+		if errors.Is(err, aesite.ErrUpdateConflict) && attempt < storeTokenAttempts {
+			continue
+		}
+		return err
+	}
+}
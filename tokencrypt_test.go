@@ -0,0 +1,179 @@
+package unclog
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func TestTokenKeys(t *testing.T) {
+	ctx := context.Background()
+
+	bs, err := OpenBoltStore(filepath.Join(t.TempDir(), "unclog.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bs.Close()
+
+	token := &oauth2.Token{AccessToken: "access-secret-0123456789", RefreshToken: "refresh-secret-0123456789", Expiry: time.Now().Add(time.Hour).Round(0)}
+
+	// With no keys, tokens are stored as plain JSON.
+	s := newServer(bs, nil, "")
+	plain, err := s.encodeToken(ctx, "alice@example.com", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(plain, "{") {
+		t.Errorf("got %q, want plain JSON", plain)
+	}
+
+	k1 := `"` + strings.Repeat("A", 43) + `="`
+	k2 := `"` + strings.Repeat("B", 43) + `="`
+	err = bs.SetSetting(ctx, "token-keys", []byte(`{"current": "k1", "keys": {"k1": `+k1+`}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newServer(bs, nil, "")
+
+	enc1, err := s.encodeToken(ctx, "alice@example.com", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tokenKeyID(enc1) != "k1" {
+		t.Errorf("got key ID %q, want k1", tokenKeyID(enc1))
+	}
+	if strings.Contains(enc1, token.RefreshToken) {
+		t.Errorf("refresh token visible in %q", enc1)
+	}
+
+	check := func(s *Server, email, stored string) {
+		t.Helper()
+		got, err := s.decodeToken(ctx, email, stored)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.AccessToken != token.AccessToken || got.RefreshToken != token.RefreshToken || !got.Expiry.Equal(token.Expiry) {
+			t.Errorf("got token %+v, want %+v", got, token)
+		}
+	}
+	check(s, "alice@example.com", enc1)
+	check(s, "alice@example.com", plain)
+
+	if _, err := s.decodeToken(ctx, "bob@example.com", enc1); err == nil {
+		t.Error("decoded alice's token as bob's")
+	}
+	if _, err := s.decodeToken(ctx, "alice@example.com", strings.Replace(enc1, ":k1:", ":k2:", 1)); err == nil {
+		t.Error("decoded token with the wrong key ID")
+	}
+
+	// Rotate to k2. Tokens under k1 still decode.
+	stale := newServer(bs, nil, "")
+	if _, err := stale.getTokenKeys(ctx, false); err != nil {
+		t.Fatal(err)
+	}
+	err = bs.SetSetting(ctx, "token-keys", []byte(`{"current": "k2", "keys": {"k1": `+k1+`, "k2": `+k2+`}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newServer(bs, nil, "")
+	check(s, "alice@example.com", enc1)
+
+	// A server that read the keys before the rotation
+	// starts using the new key once its cached keys expire,
+	// and decodes tokens under the new key right away.
+	enc2, err := s.encodeToken(ctx, "alice@example.com", token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := stale.encodeToken(ctx, "alice@example.com", token); err != nil {
+		t.Fatal(err)
+	} else if tokenKeyID(got) != "k1" {
+		t.Errorf("got key ID %q from server with cached keys, want k1", tokenKeyID(got))
+	}
+	stale.mu.Lock()
+	stale.tokenKeysTime = time.Now().Add(-settingsTTL)
+	stale.mu.Unlock()
+	if got, err := stale.encodeToken(ctx, "alice@example.com", token); err != nil {
+		t.Fatal(err)
+	} else if tokenKeyID(got) != "k2" {
+		t.Errorf("got key ID %q from server with expired keys, want k2", tokenKeyID(got))
+	}
+
+	stale = newServer(bs, nil, "")
+	stale.tokenKeys, stale.tokenKeysTime = &tokenKeys{Current: "k1", Keys: map[string][]byte{"k1": make([]byte, 32)}}, time.Now()
+	check(stale, "alice@example.com", enc2)
+
+	for email, stored := range map[string]string{
+		"alice@example.com": enc1,
+		"bob@example.com":   plain,
+		"carol@example.com": "",
+	} {
+		u := user{Token: stored}
+		if err := bs.newUser(ctx, email, &u); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := s.ReencryptTokens(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 2 {
+		t.Errorf("re-encrypted %d token(s), want 2", n)
+	}
+
+	// Now k1 can be dropped.
+	err = bs.SetSetting(ctx, "token-keys", []byte(`{"current": "k2", "keys": {"k2": `+k2+`}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s = newServer(bs, nil, "")
+	for _, email := range []string{"alice@example.com", "bob@example.com"} {
+		var u user
+		if err := bs.lookupUser(ctx, email, &u); err != nil {
+			t.Fatal(err)
+		}
+		if tokenKeyID(u.Token) != "k2" {
+			t.Errorf("%s: got key ID %q, want k2", email, tokenKeyID(u.Token))
+		}
+		check(s, email, u.Token)
+	}
+	var carol user
+	if err := bs.lookupUser(ctx, "carol@example.com", &carol); err != nil {
+		t.Fatal(err)
+	}
+	if carol.Token != "" {
+		t.Errorf("got token %q for carol, want none", carol.Token)
+	}
+}
+
+func TestParseTokenKeys(t *testing.T) {
+	key := func(n int) string {
+		j, _ := json.Marshal(make([]byte, n))
+		return string(j)
+	}
+	cases := []struct {
+		name, j string
+		ok      bool
+	}{
+		{"empty", `{}`, true},
+		{"one key", `{"current": "k1", "keys": {"k1": ` + key(32) + `}}`, true},
+		{"short key", `{"current": "k1", "keys": {"k1": ` + key(16) + `}}`, false},
+		{"missing current", `{"current": "k2", "keys": {"k1": ` + key(32) + `}}`, false},
+		{"no current", `{"keys": {"k1": ` + key(32) + `}}`, false},
+		{"bad ID", `{"current": "k:1", "keys": {"k:1": ` + key(32) + `}}`, false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := parseTokenKeys([]byte(c.j))
+			if (err == nil) != c.ok {
+				t.Errorf("got error %v, want ok=%v", err, c.ok)
+			}
+		})
+	}
+}
@@ -1,11 +1,18 @@
 package unclog
 
 import (
+	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bobg/aesite"
+	"github.com/bobg/mid"
 	"github.com/pkg/errors"
+	"google.golang.org/api/gmail/v1"
+	"google.golang.org/api/option"
+	"google.golang.org/api/people/v1"
 )
 
 const pubsubTopic = "projects/unclog/topics/gmail"
@@ -17,7 +24,8 @@ type user struct {
 	// If false, all new messages are checked.
 	InboxOnly bool
 
-	// Token is the user's OAuth token, if any.
+	// Token is the user's OAuth token, if any,
+	// in the form produced by Server.encodeToken.
 	Token string
 
 	// ContactsLabelID is the user's Gmail id for unstarred contacts.
@@ -26,6 +34,49 @@ type user struct {
 	// StarredLabelID is the user's Gmail id for starred contacts.
 	StarredLabelID string
 
+	// ContactsLabelName is the name of the user's Gmail label for unstarred contacts.
+	// If empty, "✔" is used.
+	ContactsLabelName string
+
+	// StarredLabelName is the name of the user's Gmail label for starred contacts.
+	// If empty, "✔/★" is used.
+	StarredLabelName string
+
+	// GroupLabels maps some of the user's contact groups to Gmail labels of their own,
+	// in order of precedence.
+	// See user.labelTiers.
+	GroupLabels []groupLabel
+
+	// AllowRules treat senders in certain domains as contacts.
+	// See user.labelTiers.
+	AllowRules []allowRule
+
+	// HashContacts tells whether the user's stored contact snapshot
+	// holds only hashes of addresses, rather than the addresses themselves.
+	// See contactSnapshot and user.addrKey.
+	HashContacts bool
+
+	// MatchPolicy says how the senders of a thread are determined for labeling.
+	MatchPolicy matchPolicy
+
+	// ScanStrategy says how an update that searches the mailbox chooses threads to examine.
+	// If empty, scanFull is used.
+	// See planQueries.
+	ScanStrategy scanStrategy
+
+	// CorrespondentsLookback is how far back in the user's sent mail to look for correspondents
+	// (people the user has written to),
+	// who are labeled as a tier of their own after all contacts.
+	// If zero, there is no correspondents tier.
+	CorrespondentsLookback time.Duration
+
+	// CorrespondentsLabelID is the user's Gmail id for correspondents.
+	CorrespondentsLabelID string
+
+	// CorrespondentsLabelName is the name of the user's Gmail label for correspondents.
+	// If empty, "✔/✉" is used.
+	CorrespondentsLabelName string
+
 	// NextUpdate is set when a new update task is queued, to prevent a second from being queued too soon.
 	// See Server.queueUpdate.
 	NextUpdate time.Time
@@ -36,8 +87,40 @@ type user struct {
 	// LastThreadTime is the latest timestamp of a message contemplated in an update task.
 	LastThreadTime time.Time
 
+	// HistoryID is the ID of the latest Gmail history record processed in an update task,
+	// or zero if none has been.
+	// (It is a uint64 in the Gmail API, but Datastore has no unsigned integers.)
+	HistoryID int64
+
 	// WatchExpiry is when the current gmail pubsub subscription expires, if any.
 	WatchExpiry time.Time
+
+	// ExpiredReason tells why the user's token was discarded
+	// when their OAuth grant was found to be revoked or expired,
+	// at ExpiredTime.
+	// It is cleared when the user authorizes Unclog again.
+	// See Server.expireUser.
+	ExpiredReason string
+	ExpiredTime   time.Time
+
+	// CreatedLabels are the IDs of the labels Unclog created in the user's mailbox,
+	// as opposed to existing labels it adopted by name (see Server.ensureLabels).
+	// Only these are deleted when the user asks for Unclog's labels to be removed;
+	// the others are only stripped from threads.
+	// See Server.deleteLabels.
+	CreatedLabels []string
+
+	// RetiredLabels are labels that no longer belong to any labeling tier,
+	// because the user removed a group mapping or turned off correspondents,
+	// but may still be on threads.
+	// A background job strips them from all threads
+	// and then drops them from this list.
+	// See Server.doStrip.
+	RetiredLabels []Label
+
+	// Cleanup is the user's label cleanup job, if any.
+	// See cleanupJob.
+	Cleanup cleanupJob
 }
 
 // GetUser implements aesite.UserWrapper.
@@ -54,7 +137,7 @@ func (u *user) SetUser(au *aesite.User) {
 func (s *Server) handleEnable(w http.ResponseWriter, req *http.Request) error {
 	ctx := req.Context()
 
-	sess, err := aesite.GetSession(ctx, s.dsClient, req)
+	sess, err := s.store.GetSession(ctx, req)
 	if err != nil {
 		return errors.Wrap(err, "getting session")
 	}
@@ -66,7 +149,7 @@ func (s *Server) handleEnable(w http.ResponseWriter, req *http.Request) error {
 	}
 
 	var u user
-	err = sess.GetUser(ctx, s.dsClient, &u)
+	err = s.store.sessionUser(ctx, sess, &u)
 	if err != nil {
 		return errors.Wrap(err, "getting user record")
 	}
@@ -76,6 +159,11 @@ func (s *Server) handleEnable(w http.ResponseWriter, req *http.Request) error {
 	// 	// xxx already enabled
 	// }
 
+	err = s.resumeFromCleanup(ctx, &u)
+	if err != nil {
+		return errors.Wrap(err, "ending label cleanup")
+	}
+
 	err = s.watch(ctx, &u)
 	if err != nil {
 		return errors.Wrap(err, "renewing gmail push-notice subscription")
@@ -87,10 +175,16 @@ func (s *Server) handleEnable(w http.ResponseWriter, req *http.Request) error {
 }
 
 // GET/POST /s/disable
+//
+// If the "cleanup" value is true,
+// this also starts a background job to strip Unclog's labels from all threads
+// (see cleanupJob),
+// and if "delete_labels" is true as well,
+// the job deletes the labels afterwards.
 func (s *Server) handleDisable(w http.ResponseWriter, req *http.Request) error {
 	ctx := req.Context()
 
-	sess, err := aesite.GetSession(ctx, s.dsClient, req)
+	sess, err := s.store.GetSession(ctx, req)
 	if err != nil {
 		return errors.Wrap(err, "getting session")
 	}
@@ -101,21 +195,683 @@ func (s *Server) handleDisable(w http.ResponseWriter, req *http.Request) error {
 		return errors.Wrap(err, "checking CSRF token")
 	}
 
+	var cleanup, deleteLabels bool
+	if val := req.FormValue("cleanup"); val != "" {
+		cleanup, err = strconv.ParseBool(val)
+		if err != nil {
+			return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "parsing cleanup value")}
+		}
+	}
+	if val := req.FormValue("delete_labels"); val != "" {
+		deleteLabels, err = strconv.ParseBool(val)
+		if err != nil {
+			return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "parsing delete_labels value")}
+		}
+	}
+
 	now := time.Now()
 
 	var u user
-	err = sess.GetUser(ctx, s.dsClient, &u)
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	if u.WatchExpiry.Before(now) && !cleanup {
+		return nil
+	}
+
+	if u.WatchExpiry.After(now) {
+		err = s.stop(ctx, &u)
+		if err != nil {
+			return errors.Wrap(err, "stopping gmail push-notice subscription")
+		}
+	}
+
+	if cleanup {
+		err = s.startCleanup(ctx, u.Email, deleteLabels, false)
+		if err != nil {
+			return errors.Wrap(err, "starting label cleanup")
+		}
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// POST /s/groups
+//
+// Sets the user's contact-group labels (see user.GroupLabels).
+// The request has repeated "group" and "label" values in parallel:
+// the contact group in each "group" value
+// (the ID or the name of one of the user's contact groups)
+// gets the label named in the corresponding "label" value.
+// Earlier groups take precedence over later ones.
+// The labels are created as needed.
+func (s *Server) handleGroups(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	var (
+		groupVals = req.Form["group"]
+		labelVals = req.Form["label"]
+	)
+	if len(groupVals) != len(labelVals) {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: fmt.Errorf("got %d group(s) but %d label(s)", len(groupVals), len(labelVals))}
+	}
+
+	oauthClient, err := s.oauthClient(ctx, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting oauth client")
+	}
+	peopleSvc, err := people.NewService(ctx, option.WithHTTPClient(oauthClient))
+	if err != nil {
+		return errors.Wrap(err, "allocating people service")
+	}
+	groups, err := NewPeopleContactSource(peopleSvc).Groups(ctx)
+	if err != nil {
+		return errors.Wrap(err, "listing contact groups")
+	}
+
+	gls, err := resolveGroupLabels(groups, groupVals, labelVals, u.contactsLabel(), u.starredLabel(), u.correspondentsLabel())
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: err}
+	}
+	for i := range gls {
+		// Keep the label of a group that remains mapped, renaming it if needed.
+		for _, gl := range u.GroupLabels {
+			if gl.GroupID == gls[i].GroupID {
+				gls[i].LabelID = gl.LabelID
+				break
+			}
+		}
+	}
+
+	gmailSvc, err := gmail.NewService(ctx, option.WithHTTPClient(oauthClient))
+	if err != nil {
+		return errors.Wrap(err, "allocating gmail service")
+	}
+	updated := u
+	updated.GroupLabels = gls
+	err = s.ensureLabels(ctx, NewGmailProvider(gmailSvc, oauthClient), &updated)
+	if err != nil {
+		return errors.Wrap(err, "creating labels")
+	}
+
+	var strip bool
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		prev := u.tierLabels()
+		u.ContactsLabelID = updated.ContactsLabelID
+		u.StarredLabelID = updated.StarredLabelID
+		u.CorrespondentsLabelID = updated.CorrespondentsLabelID
+		u.CreatedLabels = updated.CreatedLabels
+		u.GroupLabels = updated.GroupLabels
+		strip = u.retireLabels(prev)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+	if strip {
+		err = s.queueStrip(ctx, u.Email, 1)
+		if err != nil {
+			return errors.Wrap(err, "queueing strip task")
+		}
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// Produces groupLabels (without label IDs) from parallel lists of group IDs or names and label names,
+// checking them for validity.
+// The reserved label names are the ones already in use for other purposes.
+func resolveGroupLabels(groups []*ContactGroup, groupVals, labelVals []string, reserved ...string) ([]groupLabel, error) {
+	var (
+		result     []groupLabel
+		seenGroups = make(map[string]bool)
+		seenLabels = make(map[string]bool)
+	)
+	for _, name := range reserved {
+		seenLabels[name] = true
+	}
+	for i, groupVal := range groupVals {
+		var group *ContactGroup
+		for _, g := range groups {
+			if g.ID == groupVal {
+				group = g
+				break
+			}
+		}
+		if group == nil {
+			for _, g := range groups {
+				if strings.EqualFold(g.Name, groupVal) {
+					group = g
+					break
+				}
+			}
+		}
+		if group == nil {
+			return nil, fmt.Errorf("unknown contact group %s", groupVal)
+		}
+		if group.ID == starredGroup {
+			return nil, fmt.Errorf("cannot remap the starred group")
+		}
+		if seenGroups[group.ID] {
+			return nil, fmt.Errorf("duplicate contact group %s", groupVal)
+		}
+		seenGroups[group.ID] = true
+
+		label := strings.TrimSpace(labelVals[i])
+		if label == "" {
+			return nil, fmt.Errorf("empty label for contact group %s", groupVal)
+		}
+		if seenLabels[label] {
+			return nil, fmt.Errorf("duplicate label %s", label)
+		}
+		seenLabels[label] = true
+
+		result = append(result, groupLabel{GroupID: group.ID, Name: label})
+	}
+	return result, nil
+}
+
+// POST /s/labels
+//
+// Sets the names of the user's labels for contacts, starred contacts, and correspondents
+// (see user.ContactsLabelName, user.StarredLabelName, and user.CorrespondentsLabelName)
+// from the "contacts", "starred", and "correspondents" values, whichever are present.
+// An empty value restores the default name.
+// Existing labels are renamed in place,
+// so threads already labeled keep their labels.
+func (s *Server) handleLabels(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
 	if err != nil {
 		return errors.Wrap(err, "getting user")
 	}
 
-	if u.WatchExpiry.Before(now) {
+	updated := u
+	updated.GroupLabels = append([]groupLabel(nil), u.GroupLabels...)
+	if vals, ok := req.Form["contacts"]; ok && len(vals) > 0 {
+		updated.ContactsLabelName = strings.TrimSpace(vals[0])
+	}
+	if vals, ok := req.Form["starred"]; ok && len(vals) > 0 {
+		updated.StarredLabelName = strings.TrimSpace(vals[0])
+	}
+	if vals, ok := req.Form["correspondents"]; ok && len(vals) > 0 {
+		updated.CorrespondentsLabelName = strings.TrimSpace(vals[0])
+	}
+	err = checkLabelNames(&updated)
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: err}
+	}
+
+	oauthClient, err := s.oauthClient(ctx, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting oauth client")
+	}
+	gmailSvc, err := gmail.NewService(ctx, option.WithHTTPClient(oauthClient))
+	if err != nil {
+		return errors.Wrap(err, "allocating gmail service")
+	}
+	err = s.ensureLabels(ctx, NewGmailProvider(gmailSvc, oauthClient), &updated)
+	if errors.Is(err, ErrLabelExists) {
+		return mid.CodeErr{C: http.StatusConflict, Err: err}
+	}
+	if err != nil {
+		return errors.Wrap(err, "renaming labels")
+	}
+
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		u.ContactsLabelName = updated.ContactsLabelName
+		u.StarredLabelName = updated.StarredLabelName
+		u.CorrespondentsLabelName = updated.CorrespondentsLabelName
+		u.ContactsLabelID = updated.ContactsLabelID
+		u.StarredLabelID = updated.StarredLabelID
+		u.CorrespondentsLabelID = updated.CorrespondentsLabelID
+		u.CreatedLabels = updated.CreatedLabels
+		u.GroupLabels = updated.GroupLabels
 		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// Checks that u's labels all have different names.
+func checkLabelNames(u *user) error {
+	seen := make(map[string]bool)
+	for _, ml := range u.managedLabels() {
+		if seen[ml.name] {
+			return fmt.Errorf("duplicate label %s", ml.name)
+		}
+		seen[ml.name] = true
+	}
+	return nil
+}
+
+// POST /s/allow
+//
+// Sets the user's domain allow rules (see user.AllowRules).
+// The request has repeated "pattern" and "tier" values in parallel:
+// senders matching the domain pattern in each "pattern" value
+// (e.g. "@ourcompany.com" or "*.partner.org")
+// are treated as contacts of the tier in the corresponding "tier" value,
+// "contacts" or "starred".
+func (s *Server) handleAllow(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	rules, err := parseAllowRules(req.Form["pattern"], req.Form["tier"])
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: err}
+	}
+
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		u.AllowRules = rules
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// Produces allowRules from parallel lists of domain patterns and tier names,
+// checking them for validity.
+func parseAllowRules(patternVals, tierVals []string) ([]allowRule, error) {
+	if len(patternVals) != len(tierVals) {
+		return nil, fmt.Errorf("got %d pattern(s) but %d tier(s)", len(patternVals), len(tierVals))
+	}
+
+	var (
+		result []allowRule
+		seen   = make(map[string]bool)
+	)
+	for i, patternVal := range patternVals {
+		var starred bool
+		switch tierVal := strings.TrimSpace(tierVals[i]); tierVal {
+		case "contacts":
+		case "starred":
+			starred = true
+		default:
+			return nil, fmt.Errorf("unknown tier %q for pattern %s", tierVal, patternVal)
+		}
+		r, err := parseAllowRule(patternVal, starred)
+		if err != nil {
+			return nil, err
+		}
+		if seen[r.Domain] {
+			return nil, fmt.Errorf("duplicate pattern %s", patternVal)
+		}
+		seen[r.Domain] = true
+		result = append(result, r)
+	}
+	return result, nil
+}
+
+// Longest allowed value of user.CorrespondentsLookback.
+const maxCorrespondentsLookback = 365 * dayDur
+
+// POST /s/correspondents
+//
+// Sets how many days back in the user's sent mail to look for correspondents
+// (see user.CorrespondentsLookback)
+// from the "days" value.
+// Zero turns off the correspondents tier.
+// The correspondents label is created as needed.
+func (s *Server) handleCorrespondents(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
 	}
 
-	err = s.stop(ctx, &u)
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	days, err := strconv.Atoi(strings.TrimSpace(req.FormValue("days")))
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "parsing days")}
+	}
+	lookback := time.Duration(days) * dayDur
+	if lookback < 0 || lookback > maxCorrespondentsLookback {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: fmt.Errorf("days must be between 0 and %d", maxCorrespondentsLookback/dayDur)}
+	}
+
+	updated := u
+	updated.GroupLabels = append([]groupLabel(nil), u.GroupLabels...)
+	updated.CorrespondentsLookback = lookback
+	if lookback > 0 {
+		oauthClient, err := s.oauthClient(ctx, &u)
+		if err != nil {
+			return errors.Wrap(err, "getting oauth client")
+		}
+		gmailSvc, err := gmail.NewService(ctx, option.WithHTTPClient(oauthClient))
+		if err != nil {
+			return errors.Wrap(err, "allocating gmail service")
+		}
+		err = s.ensureLabels(ctx, NewGmailProvider(gmailSvc, oauthClient), &updated)
+		if err != nil {
+			return errors.Wrap(err, "creating labels")
+		}
+	}
+
+	var strip bool
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		prev := u.tierLabels()
+		// The next update rescans from the start of a longer lookback period
+		// (see refreshCorrespondents).
+		u.CorrespondentsLookback = lookback
+		u.CorrespondentsLabelID = updated.CorrespondentsLabelID
+		u.CreatedLabels = updated.CreatedLabels
+		strip = u.retireLabels(prev)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+	if lookback == 0 {
+		err = s.forgetCorrespondents(ctx, &u)
+		if err != nil {
+			return errors.Wrap(err, "forgetting correspondents")
+		}
+	}
+	if strip {
+		err = s.queueStrip(ctx, u.Email, 1)
+		if err != nil {
+			return errors.Wrap(err, "queueing strip task")
+		}
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// POST /s/headers
+//
+// Sets the message headers whose addresses may confer a label
+// (see matchPolicy.Headers)
+// from repeated "header" values:
+// any of From, Sender, Reply-To, and X-Original-From.
+func (s *Server) handleHeaders(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	headers, err := parseSenderHeaders(req.Form["header"])
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: err}
+	}
+
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		u.MatchPolicy.Headers = headers
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// POST /s/thread
+//
+// Sets which messages in a thread may confer a label
+// (see matchPolicy.Thread)
+// from the "policy" value:
+// "any", "first", or "latest".
+func (s *Server) handleThreadPolicy(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	policy, err := parseThreadPolicy(req.FormValue("policy"))
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: err}
+	}
+
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		u.MatchPolicy.Thread = policy
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// POST /s/plus
+//
+// Sets the domains whose addresses may carry an ignorable tag
+// (see matchPolicy.PlusRules).
+// The request has repeated "domain" and "sep" values in parallel:
+// in each domain, the part of an address's local part
+// from the corresponding separator onward
+// (e.g. "+news" in "alice+news@example.com" for the separator "+")
+// is ignored when matching senders to contacts.
+// An empty separator means "+".
+// Gmail addresses are always treated this way.
+func (s *Server) handlePlus(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	rules, err := parsePlusRules(req.Form["domain"], req.Form["sep"])
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: err}
+	}
+
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		u.MatchPolicy.PlusRules = rules
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// POST /s/contacts
+//
+// Sets whether the user's stored contacts hold only hashed addresses
+// (see user.HashContacts)
+// from the boolean "hash" value.
+// The snapshot is rebuilt in the new form on the next update.
+func (s *Server) handleContactSettings(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	hash, err := strconv.ParseBool(req.FormValue("hash"))
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: errors.Wrap(err, "parsing hash")}
+	}
+
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		u.HashContacts = hash
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "updating user")
+	}
+
+	http.Redirect(w, req, "/", http.StatusSeeOther)
+
+	return nil
+}
+
+// POST /s/scan
+//
+// Sets how an update that searches the mailbox chooses threads to examine
+// (see user.ScanStrategy)
+// from the "strategy" value:
+// "full" or "planned".
+func (s *Server) handleScanStrategy(w http.ResponseWriter, req *http.Request) error {
+	ctx := req.Context()
+
+	sess, err := s.store.GetSession(ctx, req)
+	if err != nil {
+		return errors.Wrap(err, "getting session")
+	}
+
+	csrf := req.FormValue("csrf")
+	err = sess.CSRFCheck(csrf)
+	if err != nil {
+		return errors.Wrap(err, "checking CSRF token")
+	}
+
+	var u user
+	err = s.store.sessionUser(ctx, sess, &u)
+	if err != nil {
+		return errors.Wrap(err, "getting user")
+	}
+
+	strategy, err := parseScanStrategy(req.FormValue("strategy"))
+	if err != nil {
+		return mid.CodeErr{C: http.StatusBadRequest, Err: err}
+	}
+
+	err = s.store.updateUser(ctx, u.Email, &u, func() error {
+		u.ScanStrategy = strategy
+		return nil
+	})
 	if err != nil {
-		return errors.Wrap(err, "stopping gmail push-notice subscription")
+		return errors.Wrap(err, "updating user")
 	}
 
 	http.Redirect(w, req, "/", http.StatusSeeOther)
@@ -2,6 +2,7 @@ package unclog
 
 import (
 	"context"
+	"log"
 	"time"
 
 	"github.com/pkg/errors"
@@ -17,7 +18,18 @@ func (s *Server) stop(ctx context.Context, u *user) error {
 	return s.watchHelper(ctx, u, false)
 }
 
-func (s *Server) watchHelper(ctx context.Context, u *user, watch bool) error {
+// If the user's OAuth grant turns out to be dead,
+// the user is expired (see Server.expireUser)
+// and the error is still returned.
+func (s *Server) watchHelper(ctx context.Context, u *user, watch bool) (err error) {
+	defer func() {
+		if reason := revocation(err); reason != "" {
+			if err2 := s.expireUser(ctx, u.Email, reason); err2 != nil {
+				log.Printf("%s", err2)
+			}
+		}
+	}()
+
 	client, err := s.oauthClient(ctx, u)
 	if err != nil {
 		return errors.Wrap(err, "getting oauth client")
@@ -28,23 +40,34 @@ func (s *Server) watchHelper(ctx context.Context, u *user, watch bool) error {
 		return errors.Wrap(err, "allocating gmail service")
 	}
 
+	var expiry time.Time
 	if watch {
 		watchReq := &gmail.WatchRequest{
 			TopicName: pubsubTopic,
 		}
-		watchResp, err := gmailSvc.Users.Watch("me", watchReq).Do()
+		var watchResp *gmail.WatchResponse
+		err := retry(ctx, func() (err error) {
+			watchResp, err = gmailSvc.Users.Watch("me", watchReq).Context(ctx).Do()
+			return err
+		})
 		if err != nil {
 			return errors.Wrap(err, "subscribing to gmail push notices")
 		}
-		u.WatchExpiry = timeFromMillis(watchResp.Expiration)
+		expiry = timeFromMillis(watchResp.Expiration)
 	} else {
-		err := gmailSvc.Users.Stop("me").Do()
+		err := retry(ctx, func() error {
+			return gmailSvc.Users.Stop("me").Context(ctx).Do()
+		})
 		if err != nil {
 			return errors.Wrap(err, "unsubscribing from gmail push notices")
 		}
-		u.WatchExpiry = time.Time{}
 	}
 
-	_, err = s.dsClient.Put(ctx, u.Key(), u)
+	// Update the stored record rather than overwriting it with u,
+	// which may hold an outdated token (see persistingTokenSource).
+	err = s.store.updateUser(ctx, u.Email, u, func() error {
+		u.WatchExpiry = expiry
+		return nil
+	})
 	return errors.Wrap(err, "updating user")
 }
@@ -11,6 +11,7 @@ interface State {
   email?: string
   enabled?: boolean
   expired?: boolean
+  expiredReason?: string
   loaded: boolean
 }
 
@@ -26,12 +27,13 @@ class App extends React.Component<{}, State> {
     try {
       const resp = await fetch('/s/data', { method: 'GET' })
       const data = await resp.json()
-      const { csrf, email, enabled, expired } = data
+      const { csrf, email, enabled, expired, expired_reason } = data
       this.setState({
         csrf,
         email,
         enabled,
         expired,
+        expiredReason: expired_reason,
         loaded: true,
       })
     } catch (error) {
@@ -61,7 +63,7 @@ class App extends React.Component<{}, State> {
   public componentDidMount = () => this.getData()
 
   public render() {
-    const { email, enabled, expired, loaded } = this.state
+    const { email, enabled, expired, expiredReason, loaded } = this.state
 
     return (
       <div className='App'>
@@ -88,6 +90,11 @@ class App extends React.Component<{}, State> {
                         The authorization for Unclog to access {email} has
                         expired
                       </Card.Text>
+                      {expiredReason && (
+                        <Card.Text>
+                          <small>Reason: {expiredReason}</small>
+                        </Card.Text>
+                      )}
                       <Button onClick={this.reauth}>Reauthorize</Button>
                     </>
                   ) : (